@@ -10,6 +10,10 @@ package knoxite
 import (
 	"errors"
 	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 // Backend is used to store and access data
@@ -23,6 +27,9 @@ type Backend interface {
 	// Description returns a user-friendly description for this backend
 	Description() string
 
+	// Capabilities returns which optional operations the backend supports
+	Capabilities() Capabilities
+
 	// Close the backend
 	Close() error
 
@@ -30,11 +37,22 @@ type Backend interface {
 	LoadChunk(shasum string, part, totalParts uint) (*[]byte, error)
 	// StoreChunk stores a single Chunk
 	StoreChunk(shasum string, part, totalParts uint, data *[]byte) (size uint64, err error)
+	// StatChunk returns the size of a stored Chunk, or ErrChunkNotFound
+	StatChunk(shasum string, part, totalParts uint) (size uint64, err error)
+
+	// ListChunks returns the names of all stored chunk parts
+	ListChunks() ([]string, error)
+	// DeleteChunk deletes a single Chunk
+	DeleteChunk(shasum string, part, totalParts uint) error
 
 	// LoadSnapshot loads a snapshot
 	LoadSnapshot(id string) ([]byte, error)
 	// SaveSnapshot stores a snapshot
 	SaveSnapshot(id string, data []byte) error
+	// ListSnapshots returns the IDs of all stored snapshots
+	ListSnapshots() ([]string, error)
+	// DeleteSnapshot deletes a snapshot
+	DeleteSnapshot(id string) error
 
 	// InitRepository creates a new repository
 	InitRepository() error
@@ -44,11 +62,135 @@ type Backend interface {
 	SaveRepository(data []byte) error
 }
 
+// Capabilities describes which optional operations a backend supports.
+// Backends return ErrNotSupported for operations they lack
+type Capabilities struct {
+	List   bool // ListChunks and ListSnapshots
+	Delete bool // DeleteChunk and DeleteSnapshot, false for append-only storage
+}
+
+// SpaceReporter is implemented by backends which can tell how much storage
+// space is left on them
+type SpaceReporter interface {
+	// AvailableSpace returns the free and the total space in bytes
+	AvailableSpace() (free, total uint64, err error)
+}
+
 // Error declarations
 var (
 	ErrInvalidRepositoryURL = errors.New("Invalid repository url specified")
+	ErrNotSupported         = errors.New("Operation not supported by this storage backend")
+	ErrInvalidChunkName     = errors.New("Invalid chunk name")
+	ErrAccessDenied         = errors.New("Access denied by storage backend")
 )
 
+// BackendSpace returns the free and the total space of a backend in bytes, or
+// ErrNotSupported if the backend can't report it
+func BackendSpace(backend Backend) (free, total uint64, err error) {
+	if sr, ok := backend.(SpaceReporter); ok {
+		return sr.AvailableSpace()
+	}
+	return 0, 0, ErrNotSupported
+}
+
+// chunkName returns the name a part of a chunk gets stored as
+func chunkName(shasum string, part, totalParts uint) string {
+	return shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10)
+}
+
+// ParseChunkName splits the name of a stored chunk part into its components
+func ParseChunkName(name string) (shasum string, part, totalParts uint, err error) {
+	dot := strings.LastIndex(name, ".")
+	sep := strings.LastIndex(name, "_")
+	if dot <= 0 || sep < dot {
+		return "", 0, 0, ErrInvalidChunkName
+	}
+
+	p, err := strconv.ParseUint(name[dot+1:sep], 10, 32)
+	if err != nil {
+		return "", 0, 0, ErrInvalidChunkName
+	}
+	t, err := strconv.ParseUint(name[sep+1:], 10, 32)
+	if err != nil {
+		return "", 0, 0, ErrInvalidChunkName
+	}
+
+	return name[:dot], uint(p), uint(t), nil
+}
+
+// BackendFactory creates a Backend for a URL
+type BackendFactory func(u url.URL) (Backend, error)
+
+// BackendInfo describes a registered storage backend
+type BackendInfo struct {
+	Scheme      string
+	Description string
+}
+
+var (
+	backendsMutex sync.RWMutex
+	backends      = make(map[string]BackendFactory)
+	backendInfos  = make(map[string]BackendInfo)
+)
+
+// RegisterBackend makes a storage backend available for URLs with the given
+// scheme. Local paths use the empty scheme. If RegisterBackend is called twice
+// for the same scheme or if factory is nil, it panics
+func RegisterBackend(scheme string, factory func(url.URL) (Backend, error)) {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+
+	if factory == nil {
+		panic("knoxite: RegisterBackend factory is nil")
+	}
+	if _, dup := backends[scheme]; dup {
+		panic("knoxite: RegisterBackend called twice for scheme " + scheme)
+	}
+	backends[scheme] = factory
+	backendInfos[scheme] = BackendInfo{Scheme: scheme}
+}
+
+// RegisterBackendDescription sets the description shown to users when listing
+// the available backends. If scheme hasn't been registered yet, it panics
+func RegisterBackendDescription(scheme, description string) {
+	backendsMutex.Lock()
+	defer backendsMutex.Unlock()
+
+	if _, ok := backends[scheme]; !ok {
+		panic("knoxite: RegisterBackendDescription called for unknown scheme " + scheme)
+	}
+	backendInfos[scheme] = BackendInfo{Scheme: scheme, Description: description}
+}
+
+// RegisterBackendType registers factory for all schemes backend supports,
+// see Backend.Protocols. backend is only used to query its protocols and
+// description, so it doesn't need to be connected
+func RegisterBackendType(backend Backend, factory func(url.URL) (Backend, error)) {
+	for _, scheme := range backend.Protocols() {
+		RegisterBackend(scheme, factory)
+		RegisterBackendDescription(scheme, backend.Description())
+	}
+}
+
+// RegisteredBackends returns all registered storage backends, sorted by scheme
+func RegisteredBackends() []BackendInfo {
+	backendsMutex.RLock()
+	defer backendsMutex.RUnlock()
+
+	infos := []BackendInfo{}
+	for _, info := range backendInfos {
+		infos = append(infos, info)
+	}
+	sort.Sort(backendInfosByScheme(infos))
+	return infos
+}
+
+type backendInfosByScheme []BackendInfo
+
+func (b backendInfosByScheme) Len() int           { return len(b) }
+func (b backendInfosByScheme) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b backendInfosByScheme) Less(i, j int) bool { return b[i].Scheme < b[j].Scheme }
+
 // BackendFromURL returns the matching backend for path
 func BackendFromURL(path string) (Backend, error) {
 	u, err := url.Parse(path)
@@ -56,28 +198,12 @@ func BackendFromURL(path string) (Backend, error) {
 		return nil, err
 	}
 
-	switch u.Scheme {
-	case "http":
-		fallthrough
-	case "https":
-		return &StorageHTTP{
-			URL: path,
-		}, nil
-	case "dropbox":
-		return &StorageDropbox{
-			URL: path,
-		}, nil
-	case "s3":
-		fallthrough
-	case "s3s":
-		return NewStorageAmazonS3(*u)
-	case "ftp":
-		return NewStorageFTP(*u)
-	case "":
-		return &StorageLocal{
-			Path: path,
-		}, nil
-	default:
+	backendsMutex.RLock()
+	factory, ok := backends[u.Scheme]
+	backendsMutex.RUnlock()
+	if !ok {
 		return nil, ErrInvalidRepositoryURL
 	}
+
+	return factory(*u)
 }
@@ -0,0 +1,228 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestBackendRegistry(t *testing.T) {
+	var created url.URL
+	RegisterBackend("knoxite-test", func(u url.URL) (Backend, error) {
+		created = u
+		return &StorageLocal{Path: u.Path}, nil
+	})
+	RegisterBackendDescription("knoxite-test", "Test Storage")
+
+	backend, err := BackendFromURL("knoxite-test://host/some/path")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Host != "host" || backend.(*StorageLocal).Path != "/some/path" {
+		t.Errorf("Unexpected backend for URL %s", created.String())
+	}
+
+	found := false
+	for _, info := range RegisteredBackends() {
+		if info.Scheme == "knoxite-test" {
+			found = info.Description == "Test Storage"
+		}
+	}
+	if !found {
+		t.Error("Expected the registered backend to be listed with its description")
+	}
+
+	if _, err := BackendFromURL("unknown-scheme://host"); err != ErrInvalidRepositoryURL {
+		t.Errorf("Expected %v, got %v", ErrInvalidRepositoryURL, err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Expected registering a scheme twice to panic")
+			}
+		}()
+		RegisterBackend("knoxite-test", func(u url.URL) (Backend, error) {
+			return nil, nil
+		})
+	}()
+}
+
+func TestRegisteredBackends(t *testing.T) {
+	expected := map[string]string{
+		"":        "Local File Storage",
+		"ftp":     "FTP Storage",
+		"http":    "HTTP(S) Storage",
+		"https":   "HTTP(S) Storage",
+		"mem":     "In-Memory Storage",
+		"s3":      "Amazon S3 Storage",
+		"sftp":    "SSH/SFTP Storage",
+		"webdavs": "WebDAV Storage",
+	}
+
+	found := make(map[string]string)
+	last := ""
+	for i, info := range RegisteredBackends() {
+		if i > 0 && info.Scheme < last {
+			t.Errorf("Expected backends to be sorted, got %s after %s", info.Scheme, last)
+		}
+		last = info.Scheme
+		found[info.Scheme] = info.Description
+	}
+
+	for scheme, description := range expected {
+		if found[scheme] != description {
+			t.Errorf("Expected %q for scheme %q, got %q", description, scheme, found[scheme])
+		}
+	}
+}
+
+func TestLocalBackendFromURL(t *testing.T) {
+	for _, path := range []string{"/tmp/repo", "relative/repo", "/tmp/odd?name#1", "/tmp/a b", "/tmp/a%20b#c%20d", "/tmp/ünïcode"} {
+		backend, err := BackendFromURL(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if backend.Location() != path {
+			t.Errorf("Expected location %s, got %s", path, backend.Location())
+		}
+	}
+}
+
+func TestLocalBackendStatAndList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := &StorageLocal{Path: dir}
+	if err := backend.SaveRepository([]byte("repository")); err != nil {
+		t.Fatal(err)
+	}
+	caps := backend.Capabilities()
+	if !caps.List || !caps.Delete {
+		t.Errorf("Expected local backend to support listing and deleting, got %+v", caps)
+	}
+
+	data := []byte("chunk")
+	if _, err := backend.StoreChunk("abc", 0, 1, &data); err != nil {
+		t.Fatal(err)
+	}
+	size, err := backend.StatChunk("abc", 0, 1)
+	if err != nil || size != uint64(len(data)) {
+		t.Errorf("Expected size %d, got %d (%v)", len(data), size, err)
+	}
+	if _, err := backend.StatChunk("missing", 0, 1); err != ErrChunkNotFound {
+		t.Errorf("Expected %v, got %v", ErrChunkNotFound, err)
+	}
+
+	for _, id := range []string{"snap1", "snap2"} {
+		if err := backend.SaveSnapshot(id, []byte(id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids, err := backend.ListSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(ids)
+	if len(ids) != 2 || ids[0] != "snap1" || ids[1] != "snap2" {
+		t.Errorf("Unexpected snapshot list: %v", ids)
+	}
+}
+
+func TestStorageHTTPListNotSupported(t *testing.T) {
+	// servers predating the list endpoints answer with 404
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	backend, err := BackendFromURL(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.ListChunks(); err != ErrNotSupported {
+		t.Errorf("Expected %v, got %v", ErrNotSupported, err)
+	}
+	if _, err := backend.ListSnapshots(); err != ErrNotSupported {
+		t.Errorf("Expected %v, got %v", ErrNotSupported, err)
+	}
+	if _, err := backend.StatChunk("abc", 0, 1); err != ErrChunkNotFound {
+		t.Errorf("Expected %v, got %v", ErrChunkNotFound, err)
+	}
+}
+
+func TestStorageHTTPUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	backend, err := BackendFromURL(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Close()
+
+	if _, err := backend.LoadChunk("abc", 0, 1); err == nil {
+		t.Error("Expected loading a chunk to fail")
+	}
+	if _, err := backend.LoadSnapshot("abc"); err == nil {
+		t.Error("Expected loading a snapshot to fail")
+	}
+	if _, err := backend.LoadRepository(); err == nil {
+		t.Error("Expected loading the repository to fail")
+	}
+}
+
+func TestBackendSpace(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/space", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"free": 300, "total": 1000}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	backend, err := BackendFromURL(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	free, total, err := BackendSpace(backend)
+	if err != nil || free != 300 || total != 1000 {
+		t.Errorf("Expected 300 of 1000 bytes free, got %d of %d (%v)", free, total, err)
+	}
+
+	// without a quota the server doesn't know the endpoint
+	server = httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	backend, err = BackendFromURL(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := BackendSpace(backend); err != ErrNotSupported {
+		t.Errorf("Expected %v, got %v", ErrNotSupported, err)
+	}
+
+	// wrapped backends report the space of the backend they wrap
+	defer RemoveStorageMemory("space")
+	memory, err := BackendFromURL("mem://space?size=1K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 24)
+	if _, err := memory.StoreChunk("abc", 0, 1, &data); err != nil {
+		t.Fatal(err)
+	}
+	wrapped := NewRetryBackend(NewLimitedBackend(memory, nil, nil), RetryOptions{Attempts: 1})
+	free, total, err = BackendSpace(wrapped)
+	if err != nil || free != 1000 || total != 1024 {
+		t.Errorf("Expected 1000 of 1024 bytes free, got %d of %d (%v)", free, total, err)
+	}
+}
@@ -7,25 +7,166 @@
 
 package knoxite
 
-import "errors"
+import (
+	"errors"
+	"os"
+	"sync"
+)
+
+// DefaultBackendConcurrency limits how many chunk parts get transferred from
+// or to a single backend at the same time
+var DefaultBackendConcurrency = 4
 
 // BackendManager storfes data on multiple backends
 type BackendManager struct {
 	Backends []*Backend
 
+	// Placement decides which backends the parts of a chunk get stored on
+	Placement Placement
+	// Weights of the backends for the weighted placement policy, usually
+	// their capacity in bytes
+	Weights []uint64
+
+	// shared by all copies of the BackendManager, as Repository gets passed
+	// around by value
+	state *backendState
+}
+
+// backendState is the placement state of a BackendManager
+type backendState struct {
+	sync.Mutex
 	lastUsedBackend int
+	current         []int64
+
+	// limit the number of concurrent transfers for every backend
+	slots []chan struct{}
+}
+
+// ChunkPart is a part of a chunk loaded by LoadChunkParts
+type ChunkPart struct {
+	Part uint
+	Data []byte
+	Err  error
 }
 
+// Placement is a policy for distributing chunk parts across backends
+type Placement string
+
+// Placement policies
+const (
+	// PlacementStripe stores the parts of a chunk on the backends in turn
+	PlacementStripe Placement = "stripe"
+	// PlacementMirror stores every part on every backend
+	PlacementMirror Placement = "mirror"
+	// PlacementWeighted picks backends in proportion to their weights
+	PlacementWeighted Placement = "weighted"
+)
+
 // Error declarations
 var (
 	ErrLoadChunkFailed      = errors.New("Unable to load chunk from any storage backend")
 	ErrLoadSnapshotFailed   = errors.New("Unable to load repository from any storage backend")
 	ErrLoadRepositoryFailed = errors.New("Unable to load repository from any storage backend")
+	ErrInvalidPlacement     = errors.New("Invalid placement policy, must be one of stripe, mirror or weighted")
+	ErrLoadCanceled         = errors.New("Loading chunk part canceled")
 )
 
-// AddBackend adds a backend
+// ParsePlacement returns the Placement called s. An empty s selects the
+// default policy, PlacementStripe
+func ParsePlacement(s string) (Placement, error) {
+	switch Placement(s) {
+	case "", PlacementStripe:
+		return PlacementStripe, nil
+	case PlacementMirror, PlacementWeighted:
+		return Placement(s), nil
+	}
+	return PlacementStripe, ErrInvalidPlacement
+}
+
+// AddBackend adds a backend. Transfers get limited by UploadLimiter and
+// DownloadLimiter and, unless disabled in DefaultRetryOptions, failed
+// operations get retried. At most DefaultBackendConcurrency chunk parts get
+// transferred to or from the backend at the same time
 func (backend *BackendManager) AddBackend(be *Backend) {
+	if UploadLimiter != nil || DownloadLimiter != nil {
+		var lb Backend = NewLimitedBackend(*be, UploadLimiter, DownloadLimiter)
+		be = &lb
+	}
+	if DefaultRetryOptions.Attempts > 1 {
+		var rb Backend = NewRetryBackend(*be, DefaultRetryOptions)
+		be = &rb
+	}
+
+	concurrency := DefaultBackendConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	state := backend.shared()
+	state.Lock()
+	state.slots = append(state.slots, make(chan struct{}, concurrency))
+	state.Unlock()
+
 	backend.Backends = append(backend.Backends, be)
+	backend.Weights = append(backend.Weights, 1)
+}
+
+// without returns a copy of the BackendManager lacking the i-th backend
+func (backend *BackendManager) without(i int) BackendManager {
+	m := BackendManager{Placement: backend.Placement, state: &backendState{}}
+	state := backend.shared()
+	state.Lock()
+	defer state.Unlock()
+
+	for j, be := range backend.Backends {
+		if j == i {
+			continue
+		}
+		m.Backends = append(m.Backends, be)
+		m.Weights = append(m.Weights, backend.weight(j))
+		if j < len(state.slots) {
+			m.state.slots = append(m.state.slots, state.slots[j])
+		}
+	}
+
+	return m
+}
+
+// shared returns the state shared by all copies of the BackendManager
+func (backend *BackendManager) shared() *backendState {
+	if backend.state == nil {
+		backend.state = &backendState{}
+	}
+	return backend.state
+}
+
+// acquire waits for a free transfer slot of the i-th backend and returns a
+// func releasing it again. It returns false if done got closed first
+func (backend *BackendManager) acquire(i int, done <-chan struct{}) (func(), bool) {
+	state := backend.shared()
+	state.Lock()
+	var slot chan struct{}
+	if i < len(state.slots) {
+		slot = state.slots[i]
+	}
+	state.Unlock()
+	if slot == nil {
+		return func() {}, true
+	}
+
+	select {
+	case slot <- struct{}{}:
+	case <-done:
+		return func() {}, false
+	}
+
+	// done may have been closed while waiting, too
+	select {
+	case <-done:
+		<-slot
+		return func() {}, false
+	default:
+		return func() { <-slot }, true
+	}
 }
 
 // Locations returns the urls for all backends
@@ -38,10 +179,53 @@ func (backend *BackendManager) Locations() []string {
 	return paths
 }
 
-// LoadChunk loads a Chunk from backends
+// LoadChunk loads a Chunk from backends. The backend the part got stored on
+// is asked first, all others only if it doesn't have the part (anymore)
 func (backend *BackendManager) LoadChunk(chunk Chunk, part uint) ([]byte, error) {
-	for _, be := range backend.Backends {
-		b, err := (*be).LoadChunk(chunk.ShaSum, uint(part), chunk.DataParts)
+	return backend.loadChunkPart(chunk, part, nil)
+}
+
+// LoadChunkParts loads parts of a Chunk concurrently and sends each of them,
+// or the error loading it, on the returned channel. Once done gets closed,
+// parts which are still waiting for a free transfer slot are skipped and
+// reported with ErrLoadCanceled
+func (backend *BackendManager) LoadChunkParts(chunk Chunk, parts []uint, done <-chan struct{}) <-chan ChunkPart {
+	// buffered, so no goroutine gets stuck when the caller stops reading
+	results := make(chan ChunkPart, len(parts))
+	for _, part := range parts {
+		go func(part uint) {
+			b, err := backend.loadChunkPart(chunk, part, done)
+			results <- ChunkPart{Part: part, Data: b, Err: err}
+		}(part)
+	}
+
+	return results
+}
+
+// loadChunkPart loads a single part of a Chunk, giving up once done is closed
+func (backend *BackendManager) loadChunkPart(chunk Chunk, part uint, done <-chan struct{}) ([]byte, error) {
+	known := -1
+	if int(part) < len(chunk.Backends) && chunk.Backends[part] >= 0 && chunk.Backends[part] < len(backend.Backends) {
+		known = chunk.Backends[part]
+	}
+
+	order := []int{}
+	if known >= 0 {
+		order = append(order, known)
+	}
+	for i := range backend.Backends {
+		if i != known {
+			order = append(order, i)
+		}
+	}
+
+	for _, i := range order {
+		release, ok := backend.acquire(i, done)
+		if !ok {
+			return []byte{}, ErrLoadCanceled
+		}
+		b, err := (*backend.Backends[i]).LoadChunk(chunk.ShaSum, part, chunk.DataParts)
+		release()
 		if err == nil {
 			return *b, err
 		}
@@ -50,27 +234,182 @@ func (backend *BackendManager) LoadChunk(chunk Chunk, part uint) ([]byte, error)
 	return []byte{}, ErrLoadChunkFailed
 }
 
-// StoreChunk stores a single Chunk on backends
-func (backend *BackendManager) StoreChunk(chunk Chunk) (size uint64, err error) {
-	for i, data := range *chunk.Data {
-		// Use storage backends in a round robin fashion to store chunks
-		backend.lastUsedBackend++
-		if backend.lastUsedBackend+1 > len(backend.Backends) {
-			backend.lastUsedBackend = 0
-		}
+// StoreChunk stores a single Chunk on backends and records which backend
+// each part got stored on in chunk.Backends. The parts get uploaded
+// concurrently
+func (backend *BackendManager) StoreChunk(chunk *Chunk) (size uint64, err error) {
+	parts := len(*chunk.Data)
+	targets := make([][]int, parts)
 
-		be := backend.Backends[backend.lastUsedBackend]
-		//	for _, be := range backend.Backends {
-		_, err = (*be).StoreChunk(chunk.ShaSum, uint(i), chunk.DataParts, &data)
+	// parts of a chunk go to different backends where possible, so losing a
+	// backend only loses a single part
+	used := make(map[int]bool)
+	for i := range targets {
+		targets[i], err = backend.pick(used)
 		if err != nil {
 			return 0, err
 		}
-		//	}
+	}
+
+	// one error slot per part and target, as mirrored parts get stored by
+	// several goroutines at once
+	var wg sync.WaitGroup
+	errs := make([][]error, parts)
+	for i, data := range *chunk.Data {
+		errs[i] = make([]error, len(targets[i]))
+		for j, idx := range targets[i] {
+			wg.Add(1)
+			go func(i, j, idx int, data []byte) {
+				defer wg.Done()
+				errs[i][j] = backend.storeChunkPart(idx, *chunk, uint(i), data)
+			}(i, j, idx, data)
+		}
+	}
+	wg.Wait()
+
+	for _, perrs := range errs {
+		for _, err := range perrs {
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	chunk.Backends = nil
+	if backend.Placement != PlacementMirror {
+		chunk.Backends = make([]int, parts)
+		for i := range targets {
+			chunk.Backends[i] = targets[i][0]
+		}
 	}
 
 	return uint64(chunk.Size), nil
 }
 
+// StoreChunkPart stores a single part of a Chunk, according to the placement
+// policy, and returns the index of the backend it got stored on, or -1 if it
+// got stored on all of them. Backends in avoid are only used if no other
+// backend is available. The backends the part got stored on are added to
+// avoid
+func (backend *BackendManager) StoreChunkPart(chunk Chunk, part uint, data []byte, avoid map[int]bool) (int, error) {
+	targets, err := backend.pick(avoid)
+	if err != nil {
+		return -1, err
+	}
+
+	for _, idx := range targets {
+		if err := backend.storeChunkPart(idx, chunk, part, data); err != nil {
+			return -1, err
+		}
+	}
+
+	if backend.Placement == PlacementMirror {
+		return -1, nil
+	}
+	return targets[0], nil
+}
+
+// storeChunkPart stores a single part of a Chunk on the idx-th backend
+func (backend *BackendManager) storeChunkPart(idx int, chunk Chunk, part uint, data []byte) error {
+	release, _ := backend.acquire(idx, nil)
+	defer release()
+
+	_, err := (*backend.Backends[idx]).StoreChunk(chunk.ShaSum, part, chunk.DataParts, &data)
+	return err
+}
+
+// pick returns the backends the next part of a chunk gets stored on,
+// according to the placement policy, and adds them to avoid
+func (backend *BackendManager) pick(avoid map[int]bool) ([]int, error) {
+	state := backend.shared()
+	state.Lock()
+	defer state.Unlock()
+
+	targets := []int{}
+	switch backend.Placement {
+	case PlacementMirror:
+		for i := range backend.Backends {
+			targets = append(targets, i)
+		}
+	case PlacementWeighted:
+		if idx := backend.pickWeighted(avoid); idx >= 0 {
+			targets = append(targets, idx)
+		}
+	default:
+		if idx := backend.pickStripe(avoid); idx >= 0 {
+			targets = append(targets, idx)
+		}
+	}
+	if len(targets) == 0 {
+		return targets, ErrStoreChunkFailed
+	}
+
+	for _, idx := range targets {
+		avoid[idx] = true
+	}
+	return targets, nil
+}
+
+// pickStripe uses storage backends in a round robin fashion. The caller
+// must hold the state's lock
+func (backend *BackendManager) pickStripe(avoid map[int]bool) int {
+	state := backend.state
+	idx := -1
+	for i := 0; i < len(backend.Backends); i++ {
+		state.lastUsedBackend++
+		if state.lastUsedBackend+1 > len(backend.Backends) {
+			state.lastUsedBackend = 0
+		}
+		if idx < 0 {
+			idx = state.lastUsedBackend
+		}
+		if !avoid[state.lastUsedBackend] {
+			idx = state.lastUsedBackend
+			break
+		}
+	}
+
+	return idx
+}
+
+// pickWeighted uses storage backends in proportion to their weights, spread
+// as evenly as possible (smooth weighted round robin). The caller must hold
+// the state's lock
+func (backend *BackendManager) pickWeighted(avoid map[int]bool) int {
+	state := backend.state
+	for len(state.current) < len(backend.Backends) {
+		state.current = append(state.current, 0)
+	}
+	all := len(avoid) >= len(backend.Backends)
+
+	idx := -1
+	var total int64
+	for i := range backend.Backends {
+		if avoid[i] && !all {
+			continue
+		}
+		w := int64(backend.weight(i))
+		state.current[i] += w
+		total += w
+		if idx < 0 || state.current[i] > state.current[idx] {
+			idx = i
+		}
+	}
+	if idx >= 0 {
+		state.current[idx] -= total
+	}
+
+	return idx
+}
+
+// weight returns the weight of the i-th backend
+func (backend *BackendManager) weight(i int) uint64 {
+	if i < len(backend.Weights) {
+		return backend.Weights[i]
+	}
+	return 1
+}
+
 // LoadSnapshot loads a snapshot
 func (backend *BackendManager) LoadSnapshot(id string) ([]byte, error) {
 	for _, be := range backend.Backends {
@@ -95,6 +434,22 @@ func (backend *BackendManager) SaveSnapshot(id string, b []byte) error {
 	return nil
 }
 
+// DeleteSnapshot deletes a snapshot from all storage backends
+func (backend *BackendManager) DeleteSnapshot(id string) error {
+	for _, be := range backend.Backends {
+		if !(*be).Capabilities().Delete {
+			continue
+		}
+
+		err := (*be).DeleteSnapshot(id)
+		if err != nil && err != ErrNotSupported && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // InitRepository creates a new repository
 func (backend *BackendManager) InitRepository() error {
 	for _, be := range backend.Backends {
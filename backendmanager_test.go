@@ -0,0 +1,170 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowBackend takes a while for every transfer and keeps track of how many
+// run at the same time
+type slowBackend struct {
+	*StorageMemory
+
+	delay   time.Duration
+	block   chan struct{} // if set, loads wait for it to be closed
+	entered chan struct{} // receives a value whenever a load starts
+
+	m        sync.Mutex
+	inflight int
+	peak     int
+}
+
+func (backend *slowBackend) transfer() func() {
+	backend.m.Lock()
+	backend.inflight++
+	if backend.inflight > backend.peak {
+		backend.peak = backend.inflight
+	}
+	backend.m.Unlock()
+
+	time.Sleep(backend.delay)
+	return func() {
+		backend.m.Lock()
+		backend.inflight--
+		backend.m.Unlock()
+	}
+}
+
+func (backend *slowBackend) StoreChunk(shasum string, part, totalParts uint, data *[]byte) (uint64, error) {
+	defer backend.transfer()()
+	return backend.StorageMemory.StoreChunk(shasum, part, totalParts, data)
+}
+
+func (backend *slowBackend) LoadChunk(shasum string, part, totalParts uint) (*[]byte, error) {
+	defer backend.transfer()()
+	if backend.entered != nil {
+		backend.entered <- struct{}{}
+	}
+	if backend.block != nil {
+		<-backend.block
+	}
+	return backend.StorageMemory.LoadChunk(shasum, part, totalParts)
+}
+
+func TestBackendManagerConcurrency(t *testing.T) {
+	concurrency := DefaultBackendConcurrency
+	defer func() {
+		DefaultBackendConcurrency = concurrency
+	}()
+	DefaultBackendConcurrency = 2
+
+	defer RemoveStorageMemory("concurrency")
+	slow := &slowBackend{StorageMemory: newTestStorageMemory(t, "mem://concurrency"), delay: 20 * time.Millisecond}
+	var backend Backend = slow
+	manager := BackendManager{}
+	manager.AddBackend(&backend)
+
+	data := [][]byte{}
+	for i := 0; i < 6; i++ {
+		data = append(data, []byte(fmt.Sprintf("part %d", i)))
+	}
+	chunk := Chunk{ShaSum: fmt.Sprintf("%064x", 1), DataParts: 6, Data: &data}
+	if _, err := manager.StoreChunk(&chunk); err != nil {
+		t.Fatal(err)
+	}
+	if slow.peak != 2 {
+		t.Errorf("Expected 2 concurrent uploads, got %d", slow.peak)
+	}
+
+	slow.peak = 0
+	results := manager.LoadChunkParts(chunk, []uint{0, 1, 2, 3, 4, 5}, nil)
+	for range data {
+		p := <-results
+		if p.Err != nil || string(p.Data) != string(data[p.Part]) {
+			t.Errorf("Expected %s, got %s (%v)", data[p.Part], p.Data, p.Err)
+		}
+	}
+	if slow.peak != 2 {
+		t.Errorf("Expected 2 concurrent downloads, got %d", slow.peak)
+	}
+}
+
+func TestLoadChunkPartsCancel(t *testing.T) {
+	concurrency := DefaultBackendConcurrency
+	defer func() {
+		DefaultBackendConcurrency = concurrency
+	}()
+	DefaultBackendConcurrency = 1
+
+	defer RemoveStorageMemory("cancel")
+	slow := &slowBackend{StorageMemory: newTestStorageMemory(t, "mem://cancel")}
+	var backend Backend = slow
+	manager := BackendManager{}
+	manager.AddBackend(&backend)
+
+	data := [][]byte{[]byte("part 0"), []byte("part 1"), []byte("part 2")}
+	chunk := Chunk{ShaSum: fmt.Sprintf("%064x", 1), DataParts: 3, Data: &data}
+	if _, err := manager.StoreChunk(&chunk); err != nil {
+		t.Fatal(err)
+	}
+
+	slow.block = make(chan struct{})
+	slow.entered = make(chan struct{}, 3)
+	done := make(chan struct{})
+	results := manager.LoadChunkParts(chunk, []uint{0, 1, 2}, done)
+
+	// one part is being loaded, the others wait for the backend
+	<-slow.entered
+	close(done)
+	close(slow.block)
+
+	loaded, canceled := 0, 0
+	for range data {
+		p := <-results
+		switch p.Err {
+		case nil:
+			loaded++
+		case ErrLoadCanceled:
+			canceled++
+		default:
+			t.Errorf("Unexpected error %v", p.Err)
+		}
+	}
+	if loaded != 1 || canceled != 2 {
+		t.Errorf("Expected 1 loaded and 2 canceled parts, got %d and %d", loaded, canceled)
+	}
+}
+
+func TestBackendManagerMirrorFailures(t *testing.T) {
+	opts := DefaultRetryOptions
+	defer func() {
+		DefaultRetryOptions = opts
+	}()
+	DefaultRetryOptions.Attempts = 1
+
+	manager := BackendManager{Placement: PlacementMirror}
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("mirror-failures%d", i)
+		defer RemoveStorageMemory(name)
+		var backend Backend = newTestStorageMemory(t, "mem://"+name)
+		if i > 0 {
+			backend = NewStorageFaulty(backend, FaultOptions{FailureRate: 1})
+		}
+		manager.AddBackend(&backend)
+	}
+
+	data := [][]byte{[]byte("part 0"), []byte("part 1")}
+	chunk := Chunk{ShaSum: fmt.Sprintf("%064x", 1), DataParts: 2, Data: &data}
+	if _, err := manager.StoreChunk(&chunk); err != ErrInjectedFault {
+		t.Errorf("Expected %v, got %v", ErrInjectedFault, err)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import "io"
+
+// Size of the sliding window the rolling hash is calculated over
+const buzhashWindowSize = 64
+
+// buzhashTable maps every possible byte value to a pseudo-random value. It
+// must never change, otherwise chunk boundaries and with them de-duplication
+// break between knoxite versions.
+var buzhashTable [256]uint32
+
+func init() {
+	// xorshift32 with a fixed seed, so the table is identical on every run
+	x := uint32(0x6b6e6f78) // "knox"
+	for i := range buzhashTable {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		buzhashTable[i] = x
+	}
+}
+
+func rotl32(x uint32, n uint) uint32 {
+	n %= 32
+	return x<<n | x>>(32-n)
+}
+
+// chunker splits a stream into content-defined chunks. A cut-point is
+// placed whenever the rolling hash over the last buzhashWindowSize bytes
+// matches the boundary mask, so chunk boundaries move along with the data
+// when bytes get inserted or removed.
+type chunker struct {
+	rd   io.ByteReader
+	opts ChunkerOptions
+	mask uint32
+
+	window [buzhashWindowSize]byte
+	pos    int
+	sum    uint32
+
+	offset uint64
+}
+
+func newChunker(rd io.ByteReader, opts ChunkerOptions) *chunker {
+	if opts.AvgSize == 0 {
+		opts = DefaultChunkerOptions
+	}
+	if opts.MinSize > opts.AvgSize {
+		opts.MinSize = opts.AvgSize
+	}
+	if opts.MaxSize < opts.AvgSize {
+		opts.MaxSize = opts.AvgSize
+	}
+
+	// a boundary is expected every 2^bits bytes
+	bits := uint(0)
+	for uint64(1)<<(bits+1) <= opts.AvgSize {
+		bits++
+	}
+
+	return &chunker{
+		rd:   rd,
+		opts: opts,
+		mask: uint32(1)<<bits - 1,
+	}
+}
+
+func (c *chunker) roll(b byte) {
+	out := c.window[c.pos]
+	c.window[c.pos] = b
+	c.pos = (c.pos + 1) % buzhashWindowSize
+
+	c.sum = rotl32(c.sum, 1) ^ rotl32(buzhashTable[out], buzhashWindowSize) ^ buzhashTable[b]
+}
+
+// next returns the next chunk of data. It returns io.EOF once the
+// underlying reader is exhausted.
+func (c *chunker) next() ([]byte, error) {
+	buf := make([]byte, 0, c.opts.AvgSize)
+
+	for uint64(len(buf)) < c.opts.MaxSize {
+		b, err := c.rd.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return buf, err
+		}
+
+		buf = append(buf, b)
+		c.roll(b)
+
+		if uint64(len(buf)) >= c.opts.MinSize && c.sum&c.mask == 0 {
+			break
+		}
+	}
+
+	if len(buf) == 0 {
+		return buf, io.EOF
+	}
+
+	c.offset += uint64(len(buf))
+	return buf, nil
+}
@@ -0,0 +1,135 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+var testChunkerOptions = ChunkerOptions{
+	MinSize: 16 * (1 << 10),
+	AvgSize: 64 * (1 << 10),
+	MaxSize: 256 * (1 << 10),
+}
+
+func splitData(t *testing.T, data []byte, opts ChunkerOptions) [][]byte {
+	chunks := [][]byte{}
+	c := newChunker(bytes.NewReader(data), opts)
+	for {
+		b, err := c.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, b)
+	}
+
+	return chunks
+}
+
+func TestChunkerBoundaries(t *testing.T) {
+	data := make([]byte, 4*(1<<20))
+	rand.New(rand.NewSource(42)).Read(data)
+
+	chunks := splitData(t, data, testChunkerOptions)
+	joined := []byte{}
+	for i, c := range chunks {
+		if uint64(len(c)) > testChunkerOptions.MaxSize {
+			t.Errorf("Chunk %d exceeds maximum size: %d", i, len(c))
+		}
+		if uint64(len(c)) < testChunkerOptions.MinSize && i != len(chunks)-1 {
+			t.Errorf("Chunk %d is smaller than minimum size: %d", i, len(c))
+		}
+		joined = append(joined, c...)
+	}
+
+	if !bytes.Equal(data, joined) {
+		t.Error("Data mismatch after chunking")
+	}
+}
+
+func TestChunkerShiftResistance(t *testing.T) {
+	data := make([]byte, 4*(1<<20))
+	rand.New(rand.NewSource(23)).Read(data)
+
+	shasums := make(map[string]bool)
+	original := splitData(t, data, testChunkerOptions)
+	for _, c := range original {
+		sum := sha256.Sum256(c)
+		shasums[hex.EncodeToString(sum[:])] = true
+	}
+
+	// insert a single byte at the very beginning
+	shifted := splitData(t, append([]byte{0x42}, data...), testChunkerOptions)
+	changed := 0
+	for _, c := range shifted {
+		sum := sha256.Sum256(c)
+		if !shasums[hex.EncodeToString(sum[:])] {
+			changed++
+		}
+	}
+
+	if changed > 2 {
+		t.Errorf("Expected at most 2 changed chunks out of %d, got %d", len(shifted), changed)
+	}
+}
+
+func TestChunkerOptionsValidate(t *testing.T) {
+	valid := []ChunkerOptions{
+		DefaultChunkerOptions,
+		testChunkerOptions,
+		{MinSize: 64 << 10, AvgSize: 64 << 10, MaxSize: 64 << 10},
+	}
+	for _, opts := range valid {
+		if err := opts.Validate(); err != nil {
+			t.Errorf("Expected %+v to be valid, got %v", opts, err)
+		}
+	}
+
+	invalid := []ChunkerOptions{
+		{},
+		{MinSize: 128 << 10, AvgSize: 64 << 10, MaxSize: 256 << 10},
+		{MinSize: 16 << 10, AvgSize: 64 << 10, MaxSize: 32 << 10},
+		{MinSize: 16 << 10, AvgSize: 100 << 10, MaxSize: 256 << 10},
+	}
+	for _, opts := range invalid {
+		if err := opts.Validate(); err != ErrInvalidChunkerOptions {
+			t.Errorf("Expected %v for %+v, got %v", ErrInvalidChunkerOptions, opts, err)
+		}
+	}
+}
+
+func TestLegacyChunkRange(t *testing.T) {
+	arc := ItemData{Size: legacyChunkSize + 10}
+	for _, tt := range []struct {
+		num            uint64
+		offset, length uint64
+	}{
+		{0, 0, legacyChunkSize},
+		{1, legacyChunkSize, 10},
+		{2, 2 * legacyChunkSize, 0},
+	} {
+		offset, length := chunkRange(arc, Chunk{Num: tt.num})
+		if offset != tt.offset || length != tt.length {
+			t.Errorf("Expected chunk %d at %d with length %d, got %d with length %d", tt.num, tt.offset, tt.length, offset, length)
+		}
+	}
+
+	// chunks beyond the end of the file don't match any offset
+	arc.Chunks = []Chunk{{Num: 5}}
+	if _, ok := findChunk(arc, 0); ok {
+		t.Error("Expected no chunk to be found")
+	}
+}
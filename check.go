@@ -0,0 +1,203 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// CheckError describes a problem found while checking a repository
+type CheckError struct {
+	Volume   string
+	Snapshot string
+	Path     string
+	Err      error
+}
+
+// Error returns a human-readable description of the problem
+func (e CheckError) Error() string {
+	switch {
+	case e.Path != "":
+		return fmt.Sprintf("snapshot %s, %s: %v", e.Snapshot, e.Path, e.Err)
+	case e.Snapshot != "":
+		return fmt.Sprintf("snapshot %s: %v", e.Snapshot, e.Err)
+	}
+	return fmt.Sprintf("volume %s: %v", e.Volume, e.Err)
+}
+
+// CheckStats contains the results of checking a repository
+type CheckStats struct {
+	Snapshots  uint64
+	Chunks     uint64
+	ChunksRead uint64
+	Errors     []CheckError
+}
+
+type chunkIndex struct {
+	backends []*Backend
+	stored   []map[string]bool // nil for backends which can't list their chunks
+}
+
+func newChunkIndex(backend *BackendManager) (*chunkIndex, error) {
+	idx := &chunkIndex{backends: backend.Backends}
+	for _, be := range backend.Backends {
+		if !(*be).Capabilities().List {
+			idx.stored = append(idx.stored, nil)
+			continue
+		}
+
+		names, err := (*be).ListChunks()
+		if err == ErrNotSupported {
+			idx.stored = append(idx.stored, nil)
+			continue
+		}
+		if err != nil {
+			return idx, err
+		}
+
+		stored := make(map[string]bool)
+		for _, name := range names {
+			stored[name] = true
+		}
+		idx.stored = append(idx.stored, stored)
+	}
+
+	return idx, nil
+}
+
+// hasPart returns true if any storage backend contains the given part of chunk
+func (idx *chunkIndex) hasPart(chunk Chunk, part uint) bool {
+	name := chunkName(chunk.ShaSum, part, chunk.DataParts)
+	for i, be := range idx.backends {
+		if idx.stored[i] != nil {
+			if idx.stored[i][name] {
+				return true
+			}
+			continue
+		}
+
+		// backends which can't list need to be asked for the chunk itself
+		if _, err := (*be).StatChunk(chunk.ShaSum, part, chunk.DataParts); err == nil {
+			return true
+		}
+		if _, err := (*be).LoadChunk(chunk.ShaSum, part, chunk.DataParts); err == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// partHolders returns the indices of all backends storing the given part of
+// chunk
+func (idx *chunkIndex) partHolders(chunk Chunk, part uint) []int {
+	holders := []int{}
+	name := chunkName(chunk.ShaSum, part, chunk.DataParts)
+	for i, be := range idx.backends {
+		if idx.stored[i] != nil {
+			if idx.stored[i][name] {
+				holders = append(holders, i)
+			}
+			continue
+		}
+
+		if _, err := (*be).StatChunk(chunk.ShaSum, part, chunk.DataParts); err == nil {
+			holders = append(holders, i)
+		} else if _, err := (*be).LoadChunk(chunk.ShaSum, part, chunk.DataParts); err == nil {
+			holders = append(holders, i)
+		}
+	}
+
+	return holders
+}
+
+// holders returns the indices of all backends known to store a part of chunk
+func (idx *chunkIndex) holders(chunk Chunk) map[int]bool {
+	holders := make(map[int]bool)
+	for part := uint(0); part < chunk.DataParts+chunk.ParityParts; part++ {
+		name := chunkName(chunk.ShaSum, part, chunk.DataParts)
+		for i := range idx.backends {
+			if idx.stored[i] != nil && idx.stored[i][name] {
+				holders[i] = true
+			}
+		}
+	}
+
+	return holders
+}
+
+// checkChunk verifies that enough parts of chunk are stored to restore it
+func (idx *chunkIndex) checkChunk(chunk Chunk) error {
+	needed := chunk.DataParts
+	total := chunk.DataParts + chunk.ParityParts
+	if chunk.ParityParts == 0 {
+		needed = 1
+		total = 1
+	}
+
+	found := uint(0)
+	for part := uint(0); part < total; part++ {
+		if idx.hasPart(chunk, part) {
+			found++
+		}
+	}
+
+	if found < needed {
+		return fmt.Errorf("chunk %s is missing parts: %d out of %d found, %d needed", chunk.ShaSum, found, total, needed)
+	}
+	return nil
+}
+
+// Check verifies that all snapshots of the repository can be loaded and all
+// chunks they reference are stored on enough storage backends to be
+// restored. readData is the fraction of chunks (0.0 - 1.0) that will also be
+// downloaded, decrypted and compared to their shasum
+func (r *Repository) Check(readData float64) (CheckStats, error) {
+	stats := CheckStats{}
+	idx, err := newChunkIndex(&r.Backend)
+	if err != nil {
+		return stats, err
+	}
+
+	// every chunk and part layout only gets checked once, even if it's used
+	// multiple times
+	checked := make(map[string]error)
+
+	for _, volume := range r.Volumes {
+		for _, id := range volume.Snapshots {
+			snapshot, err := volume.LoadSnapshot(id, r)
+			if err != nil {
+				stats.Errors = append(stats.Errors, CheckError{Volume: volume.ID, Snapshot: id, Err: err})
+				continue
+			}
+			stats.Snapshots++
+
+			for _, item := range snapshot.Items {
+				for _, chunk := range item.Chunks {
+					cerr, ok := checked[chunkKey(chunk)]
+					if !ok {
+						stats.Chunks++
+						cerr = idx.checkChunk(chunk)
+						if cerr == nil && readData > 0 && rand.Float64() < readData {
+							stats.ChunksRead++
+							_, cerr = loadChunk(*r, chunk)
+						}
+						checked[chunkKey(chunk)] = cerr
+					}
+
+					if cerr != nil {
+						stats.Errors = append(stats.Errors, CheckError{Volume: volume.ID, Snapshot: id, Path: item.Path, Err: cerr})
+					}
+				}
+			}
+		}
+	}
+
+	return stats, nil
+}
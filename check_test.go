@@ -0,0 +1,99 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckRepository(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	vol, err := NewVolume("test_name", "test_description")
+	if err != nil {
+		t.Errorf("Failed creating volume: %s", err)
+		return
+	}
+	r.AddVolume(vol)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Failed getting working dir: %s", err)
+		return
+	}
+	snapshot, err := NewSnapshot("test_snapshot")
+	if err != nil {
+		t.Errorf("Failed creating snapshot: %s", err)
+		return
+	}
+	progress, err := snapshot.Add(wd, []string{"check_test.go"}, r, false, true, 1, 0, nil, nil)
+	if err != nil {
+		t.Errorf("Failed adding to snapshot: %s", err)
+		return
+	}
+	for range progress {
+	}
+	snapshot.Save(&r)
+	vol.AddSnapshot(snapshot.ID)
+	r.Save()
+
+	stats, err := r.Check(1.0)
+	if err != nil {
+		t.Errorf("Failed checking repository: %s", err)
+		return
+	}
+	if len(stats.Errors) != 0 {
+		t.Errorf("Expected no errors, got %v", stats.Errors)
+	}
+	if stats.Snapshots != 1 || stats.Chunks != 1 || stats.ChunksRead != 1 {
+		t.Errorf("Expected 1 snapshot and chunk checked, got %+v", stats)
+	}
+
+	// corrupt the stored chunk
+	chunk := snapshot.Items[0].Chunks[0]
+	fileName := filepath.Join(dir, "chunks", chunkName(chunk.ShaSum, 0, chunk.DataParts))
+	err = ioutil.WriteFile(fileName, []byte("garbage"), 0600)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	stats, err = r.Check(1.0)
+	if err != nil {
+		t.Errorf("Failed checking repository: %s", err)
+		return
+	}
+	if len(stats.Errors) != 1 || stats.Errors[0].Path != "check_test.go" {
+		t.Errorf("Expected corrupt chunk to be reported, got %v", stats.Errors)
+	}
+
+	// remove it entirely
+	os.Remove(fileName)
+	stats, err = r.Check(0)
+	if err != nil {
+		t.Errorf("Failed checking repository: %s", err)
+		return
+	}
+	if len(stats.Errors) != 1 {
+		t.Errorf("Expected missing chunk to be reported, got %v", stats.Errors)
+	}
+}
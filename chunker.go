@@ -8,14 +8,16 @@
 package knoxite
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
-	"math"
 	"os"
+	"strconv"
 	"sync"
 )
 
@@ -58,14 +60,56 @@ type Chunk struct {
 	Encrypted       int       `json:"encrypted"`
 	Compressed      int       `json:"compressed"`
 	Num             uint64    `json:"num"`
+	Offset          uint64    `json:"offset"`             // position of the chunk's original data in its file
+	Length          uint64    `json:"length"`             // length of the chunk's original data
+	Backends        []int     `json:"backends,omitempty"` // index of the backend each part got stored on, see Repository.Paths
 }
 
+// chunkKey identifies the stored parts of chunk. The same data can be stored
+// with different part layouts, which don't share any parts
+func chunkKey(chunk Chunk) string {
+	return chunk.ShaSum + "_" + strconv.FormatUint(uint64(chunk.DataParts), 10) + "_" + strconv.FormatUint(uint64(chunk.ParityParts), 10)
+}
+
+// ChunkerOptions controls the chunk sizes the content-defined chunker produces
+type ChunkerOptions struct {
+	MinSize uint64 `json:"min_size"`
+	AvgSize uint64 `json:"avg_size"`
+	MaxSize uint64 `json:"max_size"`
+}
+
+// DefaultChunkerOptions are used for new repositories and for repositories
+// which don't specify their own chunker settings
+var DefaultChunkerOptions = ChunkerOptions{
+	MinSize: 512 * (1 << 10), // 512 KiB
+	AvgSize: 1 * (1 << 20),   // 1 MiB
+	MaxSize: 8 * (1 << 20),   // 8 MiB
+}
+
+// ErrInvalidChunkerOptions is returned for chunk sizes the chunker can't use
+var ErrInvalidChunkerOptions = errors.New("Invalid chunk sizes: expected minimum <= average <= maximum size, with the average size a power of 2")
+
+// Validate returns an error if the chunker can't produce chunks of the sizes
+// described by opts
+func (opts ChunkerOptions) Validate() error {
+	if opts.AvgSize == 0 || opts.AvgSize&(opts.AvgSize-1) != 0 ||
+		opts.MinSize > opts.AvgSize || opts.AvgSize > opts.MaxSize {
+		return ErrInvalidChunkerOptions
+	}
+
+	return nil
+}
+
+// legacyChunkSize is the fixed chunk size used before content-defined chunking
+const legacyChunkSize = 1 * (1 << 20)
+
 type inputChunk struct {
-	Data []byte
-	Num  uint64
+	Data   []byte
+	Num    uint64
+	Offset uint64
 }
 
-func processChunk(id int, compress, encrypt bool, password string, dataParts, parityParts int, jobs <-chan inputChunk, results chan<- Chunk, wg *sync.WaitGroup) {
+func processChunk(id int, compress, encrypt bool, key []byte, dataParts, parityParts int, jobs <-chan inputChunk, results chan<- Chunk, wg *sync.WaitGroup) {
 	for j := range jobs {
 		//		fmt.Println("\tWorker", id, "processing job", j.Num, len(j.Data))
 
@@ -79,7 +123,7 @@ func processChunk(id int, compress, encrypt bool, password string, dataParts, pa
 		}
 
 		if encrypt {
-			encryptedData, err := Encrypt(finalData, password)
+			encryptedData, err := encryptWithKey(finalData, key)
 			if err != nil {
 				panic(err)
 			}
@@ -97,15 +141,21 @@ func processChunk(id int, compress, encrypt bool, password string, dataParts, pa
 			Size:            len(finalData),
 			DecryptedShaSum: decshasum,
 			ShaSum:          shasum,
-			Encrypted:       EncryptionAES,
+			Encrypted:       EncryptionAESGCM,
 			Compressed:      CompressionNone,
 			Num:             j.Num,
+			Offset:          j.Offset,
+			Length:          uint64(len(j.Data)),
 		}
 		if compress {
 			cd.Compressed = CompressionGZip
 		}
 		if !encrypt {
 			cd.Encrypted = EncryptionNone
+		} else {
+			// the random nonce makes every encryption of the same data
+			// unique, so the chunk needs a content-based id to be de-duplicated
+			cd.ShaSum = chunkID(j.Data, key, cd.Compressed)
 		}
 		if parityParts > 0 {
 			pars, err := redundantData(finalData, dataParts, parityParts)
@@ -123,8 +173,8 @@ func processChunk(id int, compress, encrypt bool, password string, dataParts, pa
 	}
 }
 
-// chunkFile divides filename into chunks of 1MiB each
-func chunkFile(filename string, compress, encrypt bool, password string, dataParts, parityParts int) (chan Chunk, error) {
+// chunkFile divides filename into content-defined chunks
+func chunkFile(filename string, compress, encrypt bool, key []byte, dataParts, parityParts int, opts ChunkerOptions) (chan Chunk, error) {
 	c := make(chan Chunk)
 
 	file, err := os.Open(filename)
@@ -133,41 +183,40 @@ func chunkFile(filename string, compress, encrypt bool, password string, dataPar
 		return c, err
 	}
 
-	fileInfo, _ := file.Stat()
-	fileSize := fileInfo.Size()
-	const fileChunk = 1 * (1 << 20) // 1 MB, change this to your requirement
-
-	// calculate total number of parts the file will be chunked into
-	totalParts := uint64(math.Ceil(float64(fileSize) / float64(fileChunk)))
-	// fmt.Printf("Splitting %s to %d pieces.\n", filename, totalParts)
-
 	wg := &sync.WaitGroup{}
 	jobs := make(chan inputChunk)
 	for w := 1; w <= 4; w++ {
-		go processChunk(w, compress, encrypt, password, dataParts, parityParts, jobs, c, wg)
+		go processChunk(w, compress, encrypt, key, dataParts, parityParts, jobs, c, wg)
 	}
 
-	wg.Add(int(totalParts))
+	done := make(chan struct{})
 	go func() {
-		for i := uint64(0); i < totalParts; i++ {
-			partSize := int(math.Min(fileChunk, float64(fileSize-int64(i*fileChunk))))
-			partBuffer := make([]byte, partSize)
-
-			_, err = io.ReadFull(file, partBuffer)
+		ch := newChunker(bufio.NewReader(file), opts)
+		for i := uint64(0); ; i++ {
+			offset := ch.offset
+			partBuffer, err := ch.next()
+			if err == io.EOF {
+				break
+			}
 			if err != nil {
 				panic(err)
 			}
+
 			j := inputChunk{
-				Data: partBuffer,
-				Num:  i,
+				Data:   partBuffer,
+				Num:    i,
+				Offset: offset,
 			}
 
+			wg.Add(1)
 			jobs <- j
 		}
 		file.Close()
+		close(done)
 	}()
 
 	go func() {
+		<-done
 		wg.Wait()
 		close(jobs)
 		close(c)
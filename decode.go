@@ -8,7 +8,6 @@
 package knoxite
 
 import (
-	"bufio"
 	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
@@ -41,8 +40,8 @@ func DecodeSnapshot(repository Repository, snapshot Snapshot, dst string) (prog
 }
 
 func decodeChunk(repository Repository, chunk Chunk, finalData []byte) ([]byte, error) {
-	if chunk.Encrypted == EncryptionAES {
-		data, err := Decrypt(finalData, repository.Password)
+	if chunk.Encrypted != EncryptionNone {
+		data, err := DecryptWith(chunk.Encrypted, finalData, repository.Key)
 		if err != nil {
 			return []byte{}, err
 		}
@@ -79,39 +78,54 @@ func loadChunk(repository Repository, chunk Chunk) ([]byte, error) {
 		if err != nil {
 			return []byte{}, err
 		}
+		shardSize := (chunk.Size + int(chunk.DataParts) - 1) / int(chunk.DataParts)
+
 		pars := make([][]byte, chunk.DataParts+chunk.ParityParts)
+		parts := []uint{}
+		for i := range pars {
+			parts = append(parts, uint(i))
+		}
+
+		// all parts get requested at once, the ones still pending are
+		// canceled as soon as the chunk could be decoded
+		done := make(chan struct{})
+		defer close(done)
+		results := repository.Backend.LoadChunkParts(chunk, parts, done)
+
 		parsFound := 0
-		parsMissing := 0
-		for i := 0; i < int(chunk.DataParts+chunk.ParityParts); i++ {
-			var cerr error
-			pars[i], cerr = repository.Backend.LoadChunk(chunk, uint(i))
-			if cerr != nil {
-				pars[i] = nil
-				parsMissing++
+		var lastErr error
+		for range parts {
+			p := <-results
+			if p.Err != nil || len(p.Data) != shardSize {
+				// missing and truncated parts get reconstructed
 				continue
 			}
+			pars[p.Part] = p.Data
 			parsFound++
 
 			if parsFound >= int(chunk.DataParts) {
-				var b bytes.Buffer
-				bufWriter := bufio.NewWriter(&b)
-
-				if parsMissing > 0 {
-					err = enc.Reconstruct(pars)
-					if err != nil {
-						continue
-					}
+				data, err := decodeParts(repository, enc, chunk, pars)
+				if err == nil {
+					return data, nil
 				}
-				err = enc.Join(bufWriter, pars, chunk.Size)
-				if err != nil {
-					continue
+				lastErr = err
+			}
+		}
+
+		// corrupted parts can only be found by leaving out parts, as long as
+		// there are enough parts left to reconstruct the chunk
+		if lastErr != nil {
+			for drop := 1; drop <= parsFound-int(chunk.DataParts); drop++ {
+				if _, data, ok := decodePartsWithout(repository, enc, chunk, pars, drop, 0); ok {
+					return data, nil
 				}
-				bufWriter.Flush()
-				return decodeChunk(repository, chunk, b.Bytes())
 			}
 		}
 
-		return []byte{}, fmt.Errorf("Could not reconstruct data, got %d out of %d chunks (%d backends missing data)", parsFound, chunk.DataParts, chunk.DataParts-uint(parsFound))
+		if parsFound < int(chunk.DataParts) {
+			return []byte{}, fmt.Errorf("Could not reconstruct data, got %d out of %d chunks (%d backends missing data)", parsFound, chunk.DataParts, chunk.DataParts-uint(parsFound))
+		}
+		return []byte{}, lastErr
 	}
 
 	data, err := repository.Backend.LoadChunk(chunk, 0)
@@ -121,6 +135,56 @@ func loadChunk(repository Repository, chunk Chunk) ([]byte, error) {
 	return decodeChunk(repository, chunk, data)
 }
 
+// decodePartsWithout tries to decode a chunk after leaving out every
+// combination of drop parts, starting at index start. It returns all parts of
+// the chunk and its decoded data
+func decodePartsWithout(repository Repository, enc reedsolomon.Encoder, chunk Chunk, pars [][]byte, drop, start int) ([][]byte, []byte, bool) {
+	if drop == 0 {
+		shards, data, err := rebuildParts(repository, enc, chunk, pars)
+		return shards, data, err == nil
+	}
+
+	for i := start; i < len(pars); i++ {
+		if pars[i] == nil {
+			continue
+		}
+		shards := make([][]byte, len(pars))
+		copy(shards, pars)
+		shards[i] = nil
+
+		if rebuilt, data, ok := decodePartsWithout(repository, enc, chunk, shards, drop-1, i+1); ok {
+			return rebuilt, data, true
+		}
+	}
+	return nil, []byte{}, false
+}
+
+// decodeParts rebuilds the missing parts of a chunk and decodes its data
+func decodeParts(repository Repository, enc reedsolomon.Encoder, chunk Chunk, pars [][]byte) ([]byte, error) {
+	_, data, err := rebuildParts(repository, enc, chunk, pars)
+	return data, err
+}
+
+// rebuildParts rebuilds the missing parts of a chunk and verifies them by
+// decoding its data. It returns all parts of the chunk and its decoded data
+func rebuildParts(repository Repository, enc reedsolomon.Encoder, chunk Chunk, pars [][]byte) ([][]byte, []byte, error) {
+	// Reconstruct fills in missing parts, which must not leak into pars
+	shards := make([][]byte, len(pars))
+	copy(shards, pars)
+	err := enc.Reconstruct(shards)
+	if err != nil {
+		return nil, []byte{}, err
+	}
+
+	var b bytes.Buffer
+	err = enc.Join(&b, shards, chunk.Size)
+	if err != nil {
+		return nil, []byte{}, err
+	}
+	data, err := decodeChunk(repository, chunk, b.Bytes())
+	return shards, data, err
+}
+
 // DecodeArchive restores a single archive to path
 func DecodeArchive(progress chan Progress, repository Repository, arc ItemData, path string) error {
 	prog := Progress{}
@@ -137,8 +201,7 @@ func DecodeArchive(progress chan Progress, repository Repository, arc ItemData,
 	} else if arc.Type == File {
 		prog.Statistics.StorageSize = arc.StorageSize
 		prog.StorageSize = arc.StorageSize
-		parts := len(arc.Chunks)
-		//fmt.Printf("Creating file %s (%d chunks).\n", path, parts)
+		//fmt.Printf("Creating file %s (%d chunks).\n", path, len(arc.Chunks))
 
 		// write to disk
 		os.MkdirAll(filepath.Dir(path), 0755)
@@ -147,26 +210,23 @@ func DecodeArchive(progress chan Progress, repository Repository, arc ItemData,
 			return ferr
 		}
 
-		for i := int(0); i < parts; i++ {
-			for _, chunk := range arc.Chunks {
-				if int(chunk.Num) == i {
-					finalData, cerr := loadChunk(repository, chunk)
-					if cerr != nil {
-						return cerr
-					}
-
-					// write/save buffer to disk
-					_, ferr := f.Write(finalData)
-					if ferr != nil {
-						return ferr
-					}
+		for _, chunk := range arc.Chunks {
+			finalData, cerr := loadChunk(repository, chunk)
+			if cerr != nil {
+				return cerr
+			}
 
-					prog.Statistics.Size += uint64(len(finalData))
-					prog.Size += uint64(len(finalData))
-					progress <- prog
-					// fmt.Printf("Chunk OK: %d bytes, sha256: %s\n", size, chunk.DecryptedShaSum)
-				}
+			// write/save buffer to disk
+			offset, _ := chunkRange(arc, chunk)
+			_, ferr := f.WriteAt(finalData, int64(offset))
+			if ferr != nil {
+				return ferr
 			}
+
+			prog.Statistics.Size += uint64(len(finalData))
+			prog.Size += uint64(len(finalData))
+			progress <- prog
+			// fmt.Printf("Chunk OK: %d bytes, sha256: %s\n", size, chunk.DecryptedShaSum)
 		}
 
 		f.Sync()
@@ -214,6 +274,7 @@ func DecodeArchiveData(repository Repository, arc ItemData) (dat []byte, stats S
 
 					finalData, cerr := loadChunk(repository, chunk)
 					if cerr != nil {
+						mutex.Unlock()
 						return dat, stats, cerr
 					}
 
@@ -249,6 +310,7 @@ func readArchiveChunk(repository Repository, arc ItemData, chunkNum uint64) (dat
 
 			finalData, err := loadChunk(repository, chunk)
 			if err != nil {
+				mutex.Unlock()
 				return dat, err
 			}
 
@@ -261,44 +323,77 @@ func readArchiveChunk(repository Repository, arc ItemData, chunkNum uint64) (dat
 	return dat, nil
 }
 
+// chunkRange returns the position and length of chunk's data within arc
+func chunkRange(arc ItemData, chunk Chunk) (offset, length uint64) {
+	if chunk.Length > 0 {
+		return chunk.Offset, chunk.Length
+	}
+
+	// chunks stored before content-defined chunking don't carry their
+	// position, but they all had the same fixed size
+	offset = chunk.Num * legacyChunkSize
+	length = legacyChunkSize
+	if offset >= arc.Size {
+		// inconsistent metadata, the chunk doesn't cover any of the file
+		length = 0
+	} else if offset+length > arc.Size {
+		length = arc.Size - offset
+	}
+	return offset, length
+}
+
+// findChunk returns the chunk containing the data at offset
+func findChunk(arc ItemData, offset uint64) (Chunk, bool) {
+	for _, chunk := range arc.Chunks {
+		start, length := chunkRange(arc, chunk)
+		if offset >= start && offset < start+length {
+			return chunk, true
+		}
+	}
+
+	return Chunk{}, false
+}
+
 // ReadArchive reads from an archive
 func ReadArchive(repository Repository, arc ItemData, offset int64, size int) (dat *[]byte, err error) {
 	dat = &[]byte{}
 	//	fmt.Println("Read req:", offset, size)
 	if arc.Type == File {
-		const fileChunk = 1 * (1 << 20) // 1 MB, change this to your requirement
-
-		// calculate needed part for offset
-		neededPart := uint64(float64(offset) / float64(fileChunk))
-		internalOffset := offset % fileChunk
+		pos := uint64(offset)
+		var chunk Chunk
+
+		for len(*dat) < size && pos < arc.Size {
+			var ok bool
+			chunk, ok = findChunk(arc, pos)
+			if !ok {
+				return dat, fmt.Errorf("no chunk found for offset %d in %s", pos, arc.Path)
+			}
 
-		for len(*dat) < size {
-			b, err := readArchiveChunk(repository, arc, neededPart)
-			if err != nil || len(*b) == 0 {
-				//return dat, err
-				panic(err)
+			b, err := readArchiveChunk(repository, arc, chunk.Num)
+			if err != nil {
+				return dat, err
 			}
 
+			start, _ := chunkRange(arc, chunk)
 			d := *b
-			d = d[internalOffset:]
-			if err != nil || len(d) == 0 {
-				//return dat, err
-				panic(err)
+			if pos-start >= uint64(len(d)) {
+				return dat, fmt.Errorf("chunk %d of %s is shorter than expected", chunk.Num, arc.Path)
 			}
-			if len(d) >= size {
-				*dat = append(*dat, d[:size]...)
-			} else {
-				*dat = append(*dat, d...)
+			d = d[pos-start:]
+			if len(d) > size-len(*dat) {
+				d = d[:size-len(*dat)]
 			}
 
-			internalOffset = 0
-			neededPart++
+			*dat = append(*dat, d...)
+			pos += uint64(len(d))
 		}
 
 		// cache the next block NOW
-		go func() {
-			readArchiveChunk(repository, arc, neededPart)
-		}()
+		if len(arc.Chunks) > 0 {
+			go func() {
+				readArchiveChunk(repository, arc, chunk.Num+1)
+			}()
+		}
 	}
 
 	return dat, nil
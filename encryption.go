@@ -8,22 +8,39 @@
 package knoxite
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"io"
 	// "reflect"
 )
 
 // Which encryption algo
 const (
-	EncryptionNone = iota
-	EncryptionAES
+	EncryptionNone   = iota
+	EncryptionAES    // AES-CFB, only used by old repositories
+	EncryptionAESGCM // AES-GCM with a random nonce per object
+)
+
+// Encrypted data starts with encryptionMagic, followed by a single version byte
+var encryptionMagic = []byte("KNOX")
+
+// Versions of the encrypted data format
+const (
+	encryptionVersionAESGCM = 1
 )
 
 // Error declarations
 var (
-	ErrInvalidPassword = errors.New("Empty password not permitted")
+	ErrInvalidPassword       = errors.New("Empty password not permitted")
+	ErrDecryptionFailed      = errors.New("Decryption failed: wrong password or data has been tampered with")
+	ErrUnknownEncryption     = errors.New("Unknown encryption format")
+	ErrEncryptedDataTooShort = errors.New("Encrypted data is too short")
 )
 
 // EncryptionText returns a user-friendly string indicating the encryption algo that was used
@@ -33,6 +50,8 @@ func EncryptionText(enum int) string {
 		return "none"
 	case EncryptionAES:
 		return "AES"
+	case EncryptionAESGCM:
+		return "AES-GCM"
 	}
 
 	return "unknown"
@@ -60,43 +79,142 @@ func decryptAESCFB(dst, src, key, iv []byte) error {
 	return nil
 }
 
+// encryptAESGCM seals src with key, prepending the format header and a random nonce
+func encryptAESGCM(src, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return []byte{}, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return []byte{}, err
+	}
+
+	header := append(append([]byte{}, encryptionMagic...), encryptionVersionAESGCM)
+	dst := make([]byte, 0, len(header)+len(nonce)+len(src)+gcm.Overhead())
+	dst = append(dst, header...)
+	dst = append(dst, nonce...)
+
+	// the header is authenticated as well, so it can't be swapped out
+	return gcm.Seal(dst, nonce, src, header), nil
+}
+
+// decryptAESGCM verifies and opens src, which must have been created by encryptAESGCM
+func decryptAESGCM(src, key []byte) ([]byte, error) {
+	headerLen := len(encryptionMagic) + 1
+	if len(src) < headerLen || !bytes.Equal(src[:len(encryptionMagic)], encryptionMagic) {
+		return []byte{}, ErrUnknownEncryption
+	}
+	if src[len(encryptionMagic)] != encryptionVersionAESGCM {
+		return []byte{}, ErrUnknownEncryption
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return []byte{}, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return []byte{}, err
+	}
+	if len(src) < headerLen+gcm.NonceSize()+gcm.Overhead() {
+		return []byte{}, ErrEncryptedDataTooShort
+	}
+
+	header := src[:headerLen]
+	nonce := src[headerLen : headerLen+gcm.NonceSize()]
+	decrypted, err := gcm.Open(nil, nonce, src[headerLen+gcm.NonceSize():], header)
+	if err != nil {
+		return []byte{}, ErrDecryptionFailed
+	}
+
+	return decrypted, nil
+}
+
+// isAESGCM returns true if data carries the header written by encryptAESGCM
+func isAESGCM(data []byte) bool {
+	return len(data) > len(encryptionMagic) &&
+		bytes.Equal(data[:len(encryptionMagic)], encryptionMagic) &&
+		data[len(encryptionMagic)] == encryptionVersionAESGCM
+}
+
 // Encrypt data
 func Encrypt(data []byte, password string) ([]byte, error) {
-	var err error
 	if len(password) == 0 {
 		return []byte{}, ErrInvalidPassword
 	}
 
-	var key = sha256.Sum256([]byte(password))
-	var iv = key[:aes.BlockSize]
-
-	// Encrypt
-	encrypted := make([]byte, len(data))
-	err = encryptAESCFB(encrypted, data, key[:], iv)
-
-	// Decryption check
-	/*	decrypted := make([]byte, len(data))
-		err = DecryptAESCFB(decrypted, encrypted, key[:], iv)
-		if err != nil || !reflect.DeepEqual(data, decrypted) {
-			panic(err)
-		} */
-
-	return encrypted, err
+	return encryptWithKey(data, passwordKey(password))
 }
 
-// Decrypt data
+// Decrypt data. Data encrypted by older versions of knoxite is detected
+// and still decrypted
 func Decrypt(data []byte, password string) ([]byte, error) {
-	var err error
 	if len(password) == 0 {
 		return []byte{}, ErrInvalidPassword
 	}
 
-	var key = sha256.Sum256([]byte(password))
+	return decryptWithKey(data, passwordKey(password), true)
+}
+
+// DecryptWith decrypts data that was encrypted with the given encryption algo
+func DecryptWith(enum int, data []byte, key []byte) ([]byte, error) {
+	switch enum {
+	case EncryptionNone:
+		return data, nil
+	case EncryptionAES:
+		return decryptLegacy(data, key)
+	case EncryptionAESGCM:
+		return decryptAESGCM(data, key)
+	}
+
+	return []byte{}, ErrUnknownEncryption
+}
+
+// passwordKey returns the unsalted key older repositories are encrypted with
+func passwordKey(password string) []byte {
+	key := sha256.Sum256([]byte(password))
+	return key[:]
+}
+
+func encryptWithKey(data, key []byte) ([]byte, error) {
+	return encryptAESGCM(data, key)
+}
+
+// decryptWithKey decrypts data encrypted with AES-GCM. Unauthenticated
+// AES-CFB data is only accepted if legacy is set
+func decryptWithKey(data, key []byte, legacy bool) ([]byte, error) {
+	if isAESGCM(data) {
+		return decryptAESGCM(data, key)
+	}
+	if !legacy {
+		return []byte{}, ErrUnknownEncryption
+	}
+
+	return decryptLegacy(data, key)
+}
+
+// decryptLegacy decrypts data encrypted with AES-CFB and a static IV
+func decryptLegacy(data, key []byte) ([]byte, error) {
 	var iv = key[:aes.BlockSize]
 
 	// Decrypt
 	decrypted := make([]byte, len(data))
-	err = decryptAESCFB(decrypted, data, key[:], iv)
+	err := decryptAESCFB(decrypted, data, key, iv)
 
 	return decrypted, err
 }
+
+// chunkID returns an id for an encrypted chunk, which only depends on its
+// content and the way it's stored, without revealing the content's shasum
+func chunkID(data, key []byte, compression int) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte{byte(compression)})
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -8,6 +8,8 @@
 package knoxite
 
 import (
+	"crypto/aes"
+	"crypto/sha256"
 	"testing"
 )
 
@@ -42,3 +44,72 @@ func TestEmptyPassword(t *testing.T) {
 		t.Errorf("Expected %v, got %v", ErrInvalidPassword, err)
 	}
 }
+
+func TestEncryptionNonce(t *testing.T) {
+	testPassword := "this_is_a_password"
+	b := []byte("1234567890")
+
+	be1, err := Encrypt(b, testPassword)
+	if err != nil {
+		t.Error(err)
+	}
+	be2, err := Encrypt(b, testPassword)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(be1) == string(be2) {
+		t.Error("Encrypting the same data twice should not produce the same output")
+	}
+}
+
+func TestEncryptionTampering(t *testing.T) {
+	testPassword := "this_is_a_password"
+	b := []byte("1234567890")
+
+	be, err := Encrypt(b, testPassword)
+	if err != nil {
+		t.Error(err)
+	}
+
+	be[len(be)-1] ^= 0x01
+	_, err = Decrypt(be, testPassword)
+	if err != ErrDecryptionFailed {
+		t.Errorf("Expected %v, got %v", ErrDecryptionFailed, err)
+	}
+
+	be[len(be)-1] ^= 0x01
+	_, err = Decrypt(be, "wrong_password")
+	if err != ErrDecryptionFailed {
+		t.Errorf("Expected %v, got %v", ErrDecryptionFailed, err)
+	}
+}
+
+func TestDecryptLegacy(t *testing.T) {
+	testPassword := "this_is_a_password"
+	b := []byte("1234567890")
+
+	// encrypt the way old repositories did
+	key := sha256.Sum256([]byte(testPassword))
+	be := make([]byte, len(b))
+	err := encryptAESCFB(be, b, key[:], key[:aes.BlockSize])
+	if err != nil {
+		t.Error(err)
+	}
+
+	bd, err := Decrypt(be, testPassword)
+	if err != nil {
+		t.Error(err)
+	}
+	if string(b) != string(bd) {
+		t.Error("Data mismatch after decrypting legacy data.")
+	}
+
+	bd, err = DecryptWith(EncryptionAES, be, key[:])
+	if err != nil {
+		t.Error(err)
+	}
+	if string(b) != string(bd) {
+		t.Error("Data mismatch after decrypting legacy chunk.")
+	}
+}
@@ -0,0 +1,259 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// DefaultIgnoreFile is the name of the per-directory ignore files
+const DefaultIgnoreFile = ".knoxiteignore"
+
+// cacheDirTagSignature marks a directory as cache, see http://www.brynosaurus.com/cachedir/
+var cacheDirTagSignature = []byte("Signature: 8a477f597d28d172789f06886806bc55")
+
+// Filter decides which files get stored in a snapshot. Patterns follow the
+// gitignore syntax and are relative to the path being stored. Like with
+// gitignore, files below an excluded directory can't be included again
+type Filter struct {
+	Excludes          []string // files matching these patterns are skipped
+	Includes          []string // files matching these patterns are never skipped, unless a parent directory is
+	IgnoreFile        string   // name of per-directory files containing exclude patterns
+	ExcludeCaches     bool     // skip directories containing a CACHEDIR.TAG
+	ExcludeLargerThan uint64   // skip files larger than this, 0 for no limit
+	OneFileSystem     bool     // don't cross filesystem boundaries
+
+	excludes []*pattern
+	includes []*pattern
+	ignores  map[string][]*pattern
+	m        sync.Mutex
+}
+
+type pattern struct {
+	negate  bool
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+// compile parses the filter's patterns. It must be called before the filter
+// gets used
+func (f *Filter) compile() error {
+	f.excludes = []*pattern{}
+	f.includes = []*pattern{}
+	f.ignores = make(map[string][]*pattern)
+
+	for _, s := range f.Excludes {
+		p, err := parsePattern(s)
+		if err != nil {
+			return err
+		}
+		if p != nil {
+			f.excludes = append(f.excludes, p)
+		}
+	}
+	for _, s := range f.Includes {
+		p, err := parsePattern(s)
+		if err != nil {
+			return err
+		}
+		if p != nil {
+			f.includes = append(f.includes, p)
+		}
+	}
+
+	return nil
+}
+
+// parsePattern converts a single line of gitignore syntax into a pattern. It
+// returns nil for empty lines and comments
+func parsePattern(line string) (*pattern, error) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	p := &pattern{}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	}
+	if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return nil, nil
+	}
+
+	// patterns containing a slash are anchored, all others match at any depth
+	anchored := strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+
+	expr := globToRegexp(line)
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "^(.*/)?" + expr + "$"
+	}
+
+	var err error
+	p.re, err = regexp.Compile(expr)
+	return p, err
+}
+
+// globToRegexp converts a glob with gitignore's ** extension into a regular expression
+func globToRegexp(glob string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case strings.HasPrefix(glob[i:], "**/"):
+			buf.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "/**") && i+3 == len(glob):
+			buf.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			buf.WriteString(".*")
+			i++
+		case c == '*':
+			buf.WriteString("[^/]*")
+		case c == '?':
+			buf.WriteString("[^/]")
+		case c == '[':
+			end := strings.Index(glob[i:], "]")
+			if end < 0 {
+				buf.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end
+		case c == '\\' && i+1 < len(glob):
+			i++
+			buf.WriteString(regexp.QuoteMeta(string(glob[i])))
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return buf.String()
+}
+
+// match returns whether rel, a slash-separated path, matches the pattern
+func (p *pattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	return p.re.MatchString(rel)
+}
+
+// loadIgnoreFile reads the ignore file in dir, if there is one
+func (f *Filter) loadIgnoreFile(dir string) error {
+	name := f.IgnoreFile
+	if name == "" {
+		name = DefaultIgnoreFile
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	patterns := []*pattern{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		p, err := parsePattern(scanner.Text())
+		if err != nil {
+			return err
+		}
+		if p != nil {
+			patterns = append(patterns, p)
+		}
+	}
+
+	f.m.Lock()
+	f.ignores[dir] = patterns
+	f.m.Unlock()
+	return scanner.Err()
+}
+
+// excluded returns true if path, which was found below root, should be skipped
+func (f *Filter) excluded(root, path string, fi os.FileInfo) bool {
+	isDir := fi.IsDir()
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+
+	for _, p := range f.includes {
+		if p.match(rel, isDir) {
+			return false
+		}
+	}
+
+	if f.ExcludeLargerThan > 0 && isRegularFile(fi) && uint64(fi.Size()) > f.ExcludeLargerThan {
+		return true
+	}
+	if f.ExcludeCaches && isDir && isCacheDir(path) {
+		return true
+	}
+
+	// the last matching pattern wins, with ignore files in deeper
+	// directories taking precedence
+	excluded := false
+	for _, p := range f.excludes {
+		if p.match(rel, isDir) {
+			excluded = !p.negate
+		}
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+	dirs := strings.Split(rel, "/")
+	for i := 0; i < len(dirs); i++ {
+		dir := filepath.Join(root, filepath.FromSlash(strings.Join(dirs[:i], "/")))
+		sub := strings.Join(dirs[i:], "/")
+		for _, p := range f.ignores[dir] {
+			if p.match(sub, isDir) {
+				excluded = !p.negate
+			}
+		}
+	}
+
+	return excluded
+}
+
+func isCacheDir(path string) bool {
+	f, err := os.Open(filepath.Join(path, "CACHEDIR.TAG"))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	buf := make([]byte, len(cacheDirTagSignature))
+	n, _ := f.Read(buf)
+	return bytes.Equal(buf[:n], cacheDirTagSignature)
+}
@@ -0,0 +1,157 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestPatterns(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		isDir   bool
+		match   bool
+	}{
+		{"*.o", "foo.o", false, true},
+		{"*.o", "src/foo.o", false, true},
+		{"*.o", "foo.c", false, false},
+		{"build/", "build", true, true},
+		{"build/", "build", false, false},
+		{"build/", "src/build", true, true},
+		{"/build", "build", true, true},
+		{"/build", "src/build", true, false},
+		{"doc/*.txt", "doc/notes.txt", false, true},
+		{"doc/*.txt", "doc/sub/notes.txt", false, false},
+		{"**/tmp", "a/b/tmp", true, true},
+		{"**/tmp", "tmp", true, true},
+		{"logs/**", "logs/a/b.log", false, true},
+		{"a/**/z", "a/z", false, true},
+		{"a/**/z", "a/b/c/z", false, true},
+		{"file?.[ch]", "file1.c", false, true},
+		{"file?.[!ch]", "file1.c", false, false},
+		{`\#hash`, "#hash", false, true},
+	}
+
+	for _, tt := range tests {
+		p, err := parsePattern(tt.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.match(tt.path, tt.isDir) != tt.match {
+			t.Errorf("Pattern %s matching %s: expected %v, got %v", tt.pattern, tt.path, tt.match, !tt.match)
+		}
+	}
+
+	for _, line := range []string{"", "   ", "# comment"} {
+		p, err := parsePattern(line)
+		if p != nil || err != nil {
+			t.Errorf("Expected %q to be ignored", line)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"keep.txt":               "keep",
+		"drop.log":               "drop",
+		"important.log":          "keep",
+		"big.bin":                "0123456789abcdef0123456789abcdef0123456789abcdef",
+		"src/main.go":            "keep",
+		"src/main.o":             "drop",
+		"src/.knoxiteignore":     "*.go\n!main.go\nvendor/\n",
+		"src/extra.go":           "drop",
+		"src/vendor/lib.go":      "drop",
+		"cache/CACHEDIR.TAG":     "Signature: 8a477f597d28d172789f06886806bc55\n",
+		"cache/data":             "drop",
+		"cache/important.log":    "drop",
+		"notacache/CACHEDIR.TAG": "something else",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filter := &Filter{
+		Excludes:          []string{"*.log", "*.o"},
+		Includes:          []string{"important.log"},
+		ExcludeCaches:     true,
+		ExcludeLargerThan: 32,
+		OneFileSystem:     true,
+	}
+	if err := filter.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	found := []string{}
+	for item := range findFiles(dir, filter) {
+		rel, _ := filepath.Rel(dir, item.Path)
+		if item.Type == File {
+			found = append(found, filepath.ToSlash(rel))
+		}
+	}
+	sort.Strings(found)
+
+	expected := []string{"important.log", "keep.txt", "notacache/CACHEDIR.TAG", "src/.knoxiteignore", "src/main.go"}
+	if len(found) != len(expected) {
+		t.Fatalf("Expected files %v, got %v", expected, found)
+	}
+	for i := range expected {
+		if found[i] != expected[i] {
+			t.Errorf("Expected files %v, got %v", expected, found)
+			break
+		}
+	}
+
+	// paths which can't be read get skipped
+	for item := range findFiles(filepath.Join(dir, "missing"), filter) {
+		t.Errorf("Unexpected item %s", item.Path)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]uint64{
+		"512":    512,
+		"512B":   512,
+		"4k":     4 << 10,
+		"64KiB":  64 << 10,
+		"1.5M":   3 << 19,
+		"2G":     2 << 30,
+		" 1 TB ": 1 << 40,
+	}
+	for s, size := range tests {
+		n, err := ParseSize(s)
+		if err != nil {
+			t.Errorf("Parsing %q failed: %v", s, err)
+		}
+		if n != size {
+			t.Errorf("Parsing %q: expected %d, got %d", s, size, n)
+		}
+	}
+
+	for _, s := range []string{"", "abc", "-1M", "K"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("Expected error parsing %q", s)
+		}
+	}
+}
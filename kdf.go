@@ -0,0 +1,87 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Which key derivation function
+const (
+	KDFScrypt = "scrypt"
+)
+
+const (
+	kdfSaltSize = 32
+	kdfKeySize  = 32
+)
+
+// Error declarations
+var (
+	ErrUnknownKDF       = errors.New("Unknown key derivation function")
+	ErrInvalidKDFParams = errors.New("Invalid key derivation parameters")
+)
+
+// KDFParams describes how the encryption key gets derived from a password
+type KDFParams struct {
+	Algorithm string `json:"algorithm"`
+	Salt      []byte `json:"salt"`
+	N         int    `json:"n"`
+	R         int    `json:"r"`
+	P         int    `json:"p"`
+}
+
+// DefaultKDFParams are the work factors used for new repositories
+var DefaultKDFParams = KDFParams{
+	Algorithm: KDFScrypt,
+	N:         1 << 15,
+	R:         8,
+	P:         1,
+}
+
+// NewKDFParams returns a copy of params with a fresh random salt
+func NewKDFParams(params KDFParams) (KDFParams, error) {
+	if params.Algorithm == "" {
+		params.Algorithm = KDFScrypt
+	}
+	if params.N == 0 {
+		params.N = DefaultKDFParams.N
+	}
+	if params.R == 0 {
+		params.R = DefaultKDFParams.R
+	}
+	if params.P == 0 {
+		params.P = DefaultKDFParams.P
+	}
+
+	params.Salt = make([]byte, kdfSaltSize)
+	_, err := io.ReadFull(rand.Reader, params.Salt)
+	return params, err
+}
+
+// deriveKey derives an encryption key from password
+func deriveKey(password string, params KDFParams) ([]byte, error) {
+	if len(password) == 0 {
+		return []byte{}, ErrInvalidPassword
+	}
+
+	switch params.Algorithm {
+	case KDFScrypt:
+		// N must be a power of two greater than 1
+		if params.N <= 1 || params.N&(params.N-1) != 0 || params.R <= 0 || params.P <= 0 || len(params.Salt) == 0 {
+			return []byte{}, ErrInvalidKDFParams
+		}
+		return scrypt.Key([]byte(password), params.Salt, params.N, params.R, params.P, kdfKeySize)
+	}
+
+	return []byte{}, ErrUnknownKDF
+}
@@ -0,0 +1,201 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"crypto/rand"
+	"errors"
+	"io"
+	"time"
+
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+const masterKeySize = 32
+
+// Error declarations
+var (
+	ErrKeyNotFound  = errors.New("Key not found")
+	ErrLastKey      = errors.New("Can't remove the last key of a repository")
+	ErrCurrentKey   = errors.New("Can't remove the key the repository was unlocked with")
+	ErrNoKeySupport = errors.New("Repository doesn't support key slots")
+)
+
+// A KeySlot contains the repository's master key, encrypted with a key
+// derived from one of the repository's passwords
+type KeySlot struct {
+	ID          string    `json:"id"`
+	Description string    `json:"description"`
+	Created     time.Time `json:"created"`
+	KDF         KDFParams `json:"kdf"`
+	Key         []byte    `json:"key"`
+}
+
+func newMasterKey() ([]byte, error) {
+	key := make([]byte, masterKeySize)
+	_, err := io.ReadFull(rand.Reader, key)
+	return key, err
+}
+
+// unlock sets the repository's master key by trying password on all key slots
+func (r *Repository) unlock(password string) error {
+	if r.Header == nil {
+		r.Key = passwordKey(password)
+		return nil
+	}
+	if r.Header.KDF != nil {
+		var err error
+		r.Key, err = deriveKey(password, *r.Header.KDF)
+		return err
+	}
+
+	for _, slot := range r.Header.Keys {
+		pwkey, err := deriveKey(password, slot.KDF)
+		if err != nil {
+			return err
+		}
+		key, err := decryptAESGCM(slot.Key, pwkey)
+		if err == nil {
+			r.Key = key
+			r.keyID = slot.ID
+			return nil
+		}
+	}
+
+	return ErrDecryptionFailed
+}
+
+// upgradeHeader converts repositories without key slots, so their current
+// key becomes the master key, unlocked by the current password
+func (r *Repository) upgradeHeader() error {
+	if r.Header != nil && r.Header.KDF == nil {
+		return nil
+	}
+
+	kdf := DefaultKDFParams
+	if r.Header != nil {
+		kdf = *r.Header.KDF
+	} else {
+		// snapshots stored so far may still be encrypted with AES-CFB
+		r.LegacyEncryption = true
+	}
+	r.Header = &RepositoryHeader{
+		Version: repoHeaderVersion,
+	}
+
+	slot, err := r.AddKey(r.Password, "", kdf)
+	if err != nil {
+		return err
+	}
+	r.keyID = slot.ID
+	return nil
+}
+
+// AddKey adds a key slot, which unlocks the repository with password
+func (r *Repository) AddKey(password, description string, kdf KDFParams) (KeySlot, error) {
+	slot := KeySlot{
+		Description: description,
+		Created:     time.Now(),
+	}
+	if err := r.upgradeHeader(); err != nil {
+		return slot, err
+	}
+
+	u, err := uuid.NewV4()
+	if err != nil {
+		return slot, err
+	}
+	slot.ID = u.String()[:8]
+
+	slot.KDF, err = NewKDFParams(kdf)
+	if err != nil {
+		return slot, err
+	}
+	pwkey, err := deriveKey(password, slot.KDF)
+	if err != nil {
+		return slot, err
+	}
+	slot.Key, err = encryptAESGCM(r.Key, pwkey)
+	if err != nil {
+		return slot, err
+	}
+
+	r.Header.Keys = append(r.Header.Keys, slot)
+	return slot, nil
+}
+
+// RemoveKey removes a key slot. Neither the last key slot nor the one the
+// repository was unlocked with can be removed, use ChangePassword to replace
+// the latter
+func (r *Repository) RemoveKey(id string) error {
+	if r.Header == nil || r.Header.KDF != nil {
+		return ErrNoKeySupport
+	}
+	if len(r.Header.Keys) <= 1 {
+		return ErrLastKey
+	}
+	if id == r.keyID {
+		return ErrCurrentKey
+	}
+
+	return r.removeKey(id)
+}
+
+// removeKey removes a key slot without any checks
+func (r *Repository) removeKey(id string) error {
+	keys := []KeySlot{}
+	for _, slot := range r.Header.Keys {
+		if slot.ID != id {
+			keys = append(keys, slot)
+		}
+	}
+	if len(keys) == len(r.Header.Keys) {
+		return ErrKeyNotFound
+	}
+
+	r.Header.Keys = keys
+	return nil
+}
+
+// ChangePassword replaces the key slot the repository was unlocked with by
+// one for the new password
+func (r *Repository) ChangePassword(password string) error {
+	if err := r.upgradeHeader(); err != nil {
+		return err
+	}
+
+	current, err := r.CurrentKey()
+	if err != nil {
+		return err
+	}
+	slot, err := r.AddKey(password, current.Description, current.KDF)
+	if err != nil {
+		return err
+	}
+
+	err = r.removeKey(current.ID)
+	if err != nil {
+		return err
+	}
+	r.Password = password
+	r.keyID = slot.ID
+	return nil
+}
+
+// CurrentKey returns the key slot the repository was unlocked with
+func (r *Repository) CurrentKey() (KeySlot, error) {
+	if r.Header != nil {
+		for _, slot := range r.Header.Keys {
+			if slot.ID == r.keyID {
+				return slot, nil
+			}
+		}
+	}
+
+	return KeySlot{}, ErrKeyNotFound
+}
@@ -0,0 +1,134 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var testKDFParams = KDFParams{Algorithm: KDFScrypt, N: 1 << 10, R: 8, P: 1}
+
+func TestRepositoryKeys(t *testing.T) {
+	testPassword := "this_is_a_password"
+	otherPassword := "this_is_another_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepositoryWithKDF(dir, testPassword, testKDFParams)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	first, err := r.CurrentKey()
+	if err != nil {
+		t.Errorf("Failed finding current key: %s", err)
+		return
+	}
+
+	slot, err := r.AddKey(otherPassword, "other", testKDFParams)
+	if err != nil {
+		t.Errorf("Failed adding key: %s", err)
+		return
+	}
+	err = r.Save()
+	if err != nil {
+		t.Errorf("Failed saving repository: %s", err)
+		return
+	}
+
+	for _, pw := range []string{testPassword, otherPassword} {
+		r2, err := OpenRepository(dir, pw)
+		if err != nil {
+			t.Errorf("Failed opening repository with %s: %s", pw, err)
+			return
+		}
+		if string(r2.Key) != string(r.Key) {
+			t.Errorf("Master key mismatch when opening with %s", pw)
+		}
+	}
+
+	err = r.RemoveKey(first.ID)
+	if err != ErrCurrentKey {
+		t.Errorf("Expected %v, got %v", ErrCurrentKey, err)
+	}
+	r, err = OpenRepository(dir, otherPassword)
+	if err != nil {
+		t.Errorf("Failed opening repository: %s", err)
+		return
+	}
+	err = r.RemoveKey(first.ID)
+	if err != nil {
+		t.Errorf("Failed removing key: %s", err)
+		return
+	}
+	err = r.RemoveKey(slot.ID)
+	if err != ErrLastKey {
+		t.Errorf("Expected %v, got %v", ErrLastKey, err)
+	}
+	err = r.Save()
+	if err != nil {
+		t.Errorf("Failed saving repository: %s", err)
+		return
+	}
+
+	_, err = OpenRepository(dir, testPassword)
+	if err != ErrDecryptionFailed {
+		t.Errorf("Expected %v, got %v", ErrDecryptionFailed, err)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	testPassword := "this_is_a_password"
+	newPassword := "this_is_a_new_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepositoryWithKDF(dir, testPassword, testKDFParams)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	err = r.ChangePassword(newPassword)
+	if err != nil {
+		t.Errorf("Failed changing password: %s", err)
+		return
+	}
+	err = r.Save()
+	if err != nil {
+		t.Errorf("Failed saving repository: %s", err)
+		return
+	}
+	if len(r.Header.Keys) != 1 {
+		t.Errorf("Expected a single key slot, got %d", len(r.Header.Keys))
+	}
+
+	_, err = OpenRepository(dir, testPassword)
+	if err != ErrDecryptionFailed {
+		t.Errorf("Expected %v, got %v", ErrDecryptionFailed, err)
+	}
+	r2, err := OpenRepository(dir, newPassword)
+	if err != nil {
+		t.Errorf("Failed opening repository: %s", err)
+		return
+	}
+	if string(r2.Key) != string(r.Key) {
+		t.Error("Master key changed along with the password")
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// CmdCheck describes the command
+type CmdCheck struct {
+	ReadData       bool   `long:"read-data"        description:"download and verify all data"`
+	ReadDataSubset string `long:"read-data-subset" description:"download and verify a random subset of data, e.g. 10%"`
+
+	global *GlobalOptions
+}
+
+func init() {
+	_, err := parser.AddCommand("check",
+		"check repository",
+		"The check command verifies that all snapshots of a repository are intact and restorable",
+		&CmdCheck{global: &globalOpts})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Usage describes this command's usage help-text
+func (cmd CmdCheck) Usage() string {
+	return "[--read-data|--read-data-subset n%]"
+}
+
+func (cmd CmdCheck) readData() (float64, error) {
+	if cmd.ReadData {
+		return 1.0, nil
+	}
+	if cmd.ReadDataSubset == "" {
+		return 0, nil
+	}
+
+	pct, err := strconv.ParseFloat(strings.TrimSuffix(cmd.ReadDataSubset, "%"), 64)
+	if err != nil || pct < 0 || pct > 100 {
+		return 0, fmt.Errorf("invalid data subset: %s", cmd.ReadDataSubset)
+	}
+	return pct / 100.0, nil
+}
+
+// Execute this command
+func (cmd CmdCheck) Execute(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf(TWrongNumArgs, cmd.Usage())
+	}
+	if cmd.global.Repo == "" {
+		return errors.New(TSpecifyRepoLocation)
+	}
+	readData, err := cmd.readData()
+	if err != nil {
+		return err
+	}
+
+	repository, err := openRepository(cmd.global.Repo, cmd.global.Password)
+	if err != nil {
+		return err
+	}
+
+	stats, err := repository.Check(readData)
+	if err != nil {
+		return err
+	}
+
+	for _, cerr := range stats.Errors {
+		fmt.Println("ERROR:", cerr.Error())
+	}
+	fmt.Printf("Checked %d snapshots and %d chunks, verified data of %d chunks\n", stats.Snapshots, stats.Chunks, stats.ChunksRead)
+
+	if len(stats.Errors) > 0 {
+		return fmt.Errorf("check found %d errors", len(stats.Errors))
+	}
+	fmt.Println("No errors found")
+	return nil
+}
@@ -8,6 +8,8 @@ import (
 
 // CmdClone describes the command
 type CmdClone struct {
+	FilterOptions
+
 	store *CmdStore
 
 	global *GlobalOptions
@@ -45,7 +47,10 @@ func (cmd CmdClone) Execute(args []string) error {
 		targets = append(targets, target)
 	}
 
-	// filter here? exclude/include?
+	filter, err := cmd.filter()
+	if err != nil {
+		return err
+	}
 
 	repository, err := openRepository(cmd.global.Repo, cmd.global.Password)
 	if err != nil {
@@ -59,7 +64,7 @@ func (cmd CmdClone) Execute(args []string) error {
 	if err != nil {
 		return err
 	}
-	err = cmd.store.store(&repository, snapshot, targets)
+	err = cmd.store.store(&repository, snapshot, s, targets, filter)
 	if err != nil {
 		return err
 	}
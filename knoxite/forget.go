@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/knoxite/knoxite"
+)
+
+// CmdForget describes the command
+type CmdForget struct {
+	KeepLast    int    `long:"keep-last"    description:"keep the last n snapshots"`
+	KeepHourly  int    `long:"keep-hourly"  description:"keep the last n hourly snapshots"`
+	KeepDaily   int    `long:"keep-daily"   description:"keep the last n daily snapshots"`
+	KeepWeekly  int    `long:"keep-weekly"  description:"keep the last n weekly snapshots"`
+	KeepMonthly int    `long:"keep-monthly" description:"keep the last n monthly snapshots"`
+	KeepYearly  int    `long:"keep-yearly"  description:"keep the last n yearly snapshots"`
+	Volume      string `long:"volume"       description:"volume to apply the --keep-* rules to"`
+	SavePolicy  bool   `long:"save-policy"  description:"store the --keep-* rules as the volume's policy"`
+	ApplyPolicy string `long:"apply-policy" description:"apply the stored policy of this volume"`
+	DryRun      bool   `long:"dry-run"      description:"only show which snapshots would be removed"`
+
+	global *GlobalOptions
+}
+
+func init() {
+	_, err := parser.AddCommand("forget",
+		"forget snapshots",
+		"The forget command removes snapshots from a repository, either by ID or by a retention policy. Run prune afterwards to free the storage used by them",
+		&CmdForget{global: &globalOpts})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Usage describes this command's usage help-text
+func (cmd CmdForget) Usage() string {
+	return "SNAPSHOT-ID [SNAPSHOT-ID] [...] | --volume VOLUME-ID --keep-* n | --apply-policy VOLUME-ID"
+}
+
+func (cmd CmdForget) policy() knoxite.RetentionPolicy {
+	return knoxite.RetentionPolicy{
+		KeepLast:    cmd.KeepLast,
+		KeepHourly:  cmd.KeepHourly,
+		KeepDaily:   cmd.KeepDaily,
+		KeepWeekly:  cmd.KeepWeekly,
+		KeepMonthly: cmd.KeepMonthly,
+		KeepYearly:  cmd.KeepYearly,
+	}
+}
+
+// Execute this command
+func (cmd CmdForget) Execute(args []string) error {
+	if cmd.global.Repo == "" {
+		return errors.New(TSpecifyRepoLocation)
+	}
+	if cmd.Volume != "" && cmd.ApplyPolicy != "" {
+		return errors.New("--volume and --apply-policy can't be used together")
+	}
+	if len(args) < 1 && cmd.Volume == "" && cmd.ApplyPolicy == "" {
+		return fmt.Errorf(TWrongNumArgs, cmd.Usage())
+	}
+	if len(args) > 0 && (cmd.Volume != "" || cmd.ApplyPolicy != "") {
+		return fmt.Errorf(TWrongNumArgs, cmd.Usage())
+	}
+
+	repository, err := openRepository(cmd.global.Repo, cmd.global.Password)
+	if err != nil {
+		return err
+	}
+
+	if cmd.Volume != "" || cmd.ApplyPolicy != "" {
+		return cmd.forgetByPolicy(&repository)
+	}
+
+	for _, id := range args {
+		if _, _, err := repository.FindSnapshot(id); err != nil {
+			return fmt.Errorf("Forgetting snapshot %s failed: %v", id, err)
+		}
+	}
+	if cmd.DryRun {
+		for _, id := range args {
+			fmt.Printf("Would forget snapshot %s\n", id)
+		}
+		return nil
+	}
+
+	err = repository.ForgetSnapshots(args)
+	if err != nil {
+		return fmt.Errorf("Forgetting snapshots failed: %v", err)
+	}
+	for _, id := range args {
+		fmt.Printf("Snapshot %s forgotten\n", id)
+	}
+	return nil
+}
+
+func (cmd CmdForget) forgetByPolicy(repository *knoxite.Repository) error {
+	volID := cmd.Volume
+	if cmd.ApplyPolicy != "" {
+		volID = cmd.ApplyPolicy
+	}
+	volume, err := repository.FindVolume(volID)
+	if err != nil {
+		return err
+	}
+
+	policy := cmd.policy()
+	if cmd.ApplyPolicy != "" {
+		if volume.Policy == nil || volume.Policy.Empty() {
+			return fmt.Errorf("volume %s has no retention policy", volume.ID)
+		}
+		policy = *volume.Policy
+	} else if policy.Empty() {
+		return errors.New("please specify at least one --keep-* rule")
+	}
+
+	if cmd.SavePolicy && cmd.DryRun {
+		fmt.Printf("Dry run, not storing policy for volume %s: %s\n", volume.ID, policy.String())
+	} else if cmd.SavePolicy {
+		volume.Policy = &policy
+		err = repository.Save()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Stored policy for volume %s: %s\n", volume.ID, policy.String())
+	}
+
+	snapshots := []knoxite.Snapshot{}
+	for _, id := range volume.Snapshots {
+		snapshot, err := volume.LoadSnapshot(id, repository)
+		if err != nil {
+			return err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	decisions := policy.Apply(snapshots)
+	tab := NewTable([]string{"ID", "Date", "Action", "Reason", "Description"},
+		[]int64{-8, -19, -6, -24, -32}, "No snapshots found. This volume is empty.")
+	for _, d := range decisions {
+		action := "remove"
+		if d.Keep {
+			action = "keep"
+		}
+		tab.Rows = append(tab.Rows, []interface{}{
+			d.Snapshot.ID,
+			d.Snapshot.Date.Format(timeFormat),
+			action,
+			strings.Join(d.Reasons, ", "),
+			d.Snapshot.Description})
+	}
+	fmt.Printf("Applying policy to volume %s: %s\n\n", volume.ID, policy.String())
+	tab.Print()
+
+	if cmd.DryRun {
+		return nil
+	}
+
+	ids := []string{}
+	for _, d := range decisions {
+		if !d.Keep {
+			ids = append(ids, d.Snapshot.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	err = repository.ForgetSnapshots(ids)
+	if err != nil {
+		return fmt.Errorf("Forgetting snapshots failed: %v", err)
+	}
+	fmt.Println()
+	for _, id := range ids {
+		fmt.Printf("Snapshot %s forgotten\n", id)
+	}
+	return nil
+}
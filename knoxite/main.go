@@ -5,8 +5,11 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/jessevdk/go-flags"
+
+	"github.com/knoxite/knoxite"
 )
 
 // Translations
@@ -17,8 +20,46 @@ const (
 
 // GlobalOptions holds all those options that can be set for every command
 type GlobalOptions struct {
-	Repo     string `short:"r" long:"repo"     description:"Repository directory to backup to/restore from"`
-	Password string `short:"p" long:"password" description:"Password to use for data encryption"`
+	Repo          string        `short:"r" long:"repo"     description:"Repository directory to backup to/restore from"`
+	Password      string        `short:"p" long:"password" description:"Password to use for data encryption"`
+	RetryAttempts int           `long:"retry-attempts"     description:"How often to try failing storage operations, 1 disables retrying (default: 5)"`
+	RetryBackoff  time.Duration `long:"retry-backoff"      description:"Delay before retrying a failed storage operation, doubled for every retry (default: 500ms)"`
+	RetryJitter   float64       `long:"retry-jitter"       description:"Randomize retry delays by up to this fraction (default: 0.2)"`
+	LimitUpload   uint64        `long:"limit-upload"       description:"Limit the upload rate to n KiB/s"`
+	LimitDownload uint64        `long:"limit-download"     description:"Limit the download rate to n KiB/s"`
+	Concurrency   int           `long:"concurrency"        description:"Transfer up to n chunk parts per storage backend at the same time (default: 4)"`
+}
+
+// configureBackends applies the retry, bandwidth and concurrency settings to
+// all storage backends added to a repository from now on
+func (opts GlobalOptions) configureBackends() {
+	knoxite.DefaultRetryOptions = opts.retryOptions()
+	if opts.Concurrency > 0 {
+		knoxite.DefaultBackendConcurrency = opts.Concurrency
+	}
+
+	// the limiters are shared by all backends, even of different repositories
+	if opts.LimitUpload > 0 && knoxite.UploadLimiter == nil {
+		knoxite.UploadLimiter = knoxite.NewRateLimiter(opts.LimitUpload * 1024)
+	}
+	if opts.LimitDownload > 0 && knoxite.DownloadLimiter == nil {
+		knoxite.DownloadLimiter = knoxite.NewRateLimiter(opts.LimitDownload * 1024)
+	}
+}
+
+// retryOptions returns the retry settings for storage backends
+func (opts GlobalOptions) retryOptions() knoxite.RetryOptions {
+	retry := knoxite.DefaultRetryOptions
+	if opts.RetryAttempts > 0 {
+		retry.Attempts = opts.RetryAttempts
+	}
+	if opts.RetryBackoff > 0 {
+		retry.Backoff = opts.RetryBackoff
+	}
+	if opts.RetryJitter > 0 {
+		retry.Jitter = opts.RetryJitter
+	}
+	return retry
 }
 
 var (
@@ -60,7 +101,7 @@ func main() {
 
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "\n%v\n", err)
-		os.Exit(0)
+		os.Exit(1)
 	}
 
 	//	fmt.Println("Exiting.")
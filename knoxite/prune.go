@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CmdPrune describes the command
+type CmdPrune struct {
+	global *GlobalOptions
+}
+
+func init() {
+	_, err := parser.AddCommand("prune",
+		"remove unused data",
+		"The prune command removes all chunks from the storage backends which aren't used by any snapshot",
+		&CmdPrune{global: &globalOpts})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Usage describes this command's usage help-text
+func (cmd CmdPrune) Usage() string {
+	return ""
+}
+
+// Execute this command
+func (cmd CmdPrune) Execute(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf(TWrongNumArgs, cmd.Usage())
+	}
+	if cmd.global.Repo == "" {
+		return errors.New(TSpecifyRepoLocation)
+	}
+
+	repository, err := openRepository(cmd.global.Repo, cmd.global.Password)
+	if err != nil {
+		return err
+	}
+
+	stats, err := repository.Prune()
+	if err != nil {
+		return err
+	}
+	if stats.Skipped > 0 {
+		fmt.Printf("Skipped %d storage backends which don't support deleting data\n", stats.Skipped)
+	}
+	fmt.Printf("Pruning done: %d chunk parts removed, %d chunks still in use\n", stats.Removed, stats.Referenced)
+	return nil
+}
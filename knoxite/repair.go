@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CmdRepair describes the command
+type CmdRepair struct {
+	global *GlobalOptions
+}
+
+func init() {
+	_, err := parser.AddCommand("repair",
+		"repair repository",
+		"The repair command rebuilds missing chunk parts from parity data and stores them again",
+		&CmdRepair{global: &globalOpts})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Usage describes this command's usage help-text
+func (cmd CmdRepair) Usage() string {
+	return ""
+}
+
+// Execute this command
+func (cmd CmdRepair) Execute(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf(TWrongNumArgs, cmd.Usage())
+	}
+	if cmd.global.Repo == "" {
+		return errors.New(TSpecifyRepoLocation)
+	}
+
+	repository, err := openRepository(cmd.global.Repo, cmd.global.Password)
+	if err != nil {
+		return err
+	}
+
+	stats, err := repository.Repair()
+	if err != nil {
+		return err
+	}
+
+	for _, rerr := range stats.Errors {
+		fmt.Println("ERROR:", rerr.Error())
+	}
+	fmt.Printf("Repair done: %d chunks checked, %d chunks healed (%d parts restored), %d chunks unrecoverable\n",
+		stats.Chunks, stats.Healed, stats.Parts, stats.Unrecoverable)
+
+	if len(stats.Errors) > 0 {
+		return fmt.Errorf("repair found %d errors", len(stats.Errors))
+	}
+	return nil
+}
@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 	"syscall"
+	"time"
 
 	"golang.org/x/crypto/ssh/terminal"
 
@@ -14,6 +16,16 @@ import (
 
 // CmdRepository describes the command
 type CmdRepository struct {
+	Description string `short:"d" long:"desc"    description:"a description for the new key (key add only)"`
+	ScryptN     int    `long:"scrypt-n"          description:"scrypt CPU/memory cost for deriving the key, a power of 2 (init, key add)"`
+	ScryptR     int    `long:"scrypt-r"          description:"scrypt block size for deriving the key (init, key add)"`
+	ScryptP     int    `long:"scrypt-p"          description:"scrypt parallelization for deriving the key (init, key add)"`
+	Placement   string `long:"placement"         description:"how chunks get distributed across storage backends: stripe (default), mirror, weighted (init, add)"`
+	Weight      string `long:"weight"            description:"weight of the storage backend for weighted placement, e.g. its capacity like 100G (init, add)"`
+	ChunkMin    string `long:"chunk-min"         description:"minimum size of the chunks files get split into, e.g. 512K (init only)"`
+	ChunkAvg    string `long:"chunk-avg"         description:"average size of the chunks files get split into, a power of 2 like 1M (init only)"`
+	ChunkMax    string `long:"chunk-max"         description:"maximum size of the chunks files get split into, e.g. 8M (init only)"`
+
 	global *GlobalOptions
 }
 
@@ -29,7 +41,7 @@ func init() {
 
 // Usage describes this command's usage help-text
 func (cmd CmdRepository) Usage() string {
-	return "[init|add|cat]"
+	return "[init|add URL|remove URL|rebalance|cat|status|passwd|backends|key [add|list|remove KEY-ID]]"
 }
 
 // Execute this command
@@ -37,6 +49,10 @@ func (cmd CmdRepository) Execute(args []string) error {
 	if len(args) < 1 {
 		return fmt.Errorf(TWrongNumArgs, cmd.Usage())
 	}
+	if args[0] == "backends" {
+		// doesn't need a repository
+		return cmd.backends()
+	}
 	if cmd.global.Repo == "" {
 		return errors.New(TSpecifyRepoLocation)
 	}
@@ -49,11 +65,46 @@ func (cmd CmdRepository) Execute(args []string) error {
 			return fmt.Errorf(TWrongNumArgs, cmd.Usage())
 		}
 		return cmd.add(args[1])
+	case "remove":
+		if len(args) < 2 {
+			return fmt.Errorf(TWrongNumArgs, cmd.Usage())
+		}
+		return cmd.remove(args[1])
+	case "rebalance":
+		return cmd.rebalance()
 	case "cat":
 		return cmd.cat()
+	case "status":
+		return cmd.status()
+	case "passwd":
+		return cmd.passwd()
+	case "key":
+		if len(args) < 2 {
+			return fmt.Errorf(TWrongNumArgs, cmd.Usage())
+		}
+		switch args[1] {
+		case "add":
+			return cmd.addKey()
+		case "list":
+			return cmd.listKeys()
+		case "remove":
+			if len(args) < 3 {
+				return fmt.Errorf(TWrongNumArgs, cmd.Usage())
+			}
+			return cmd.removeKey(args[2])
+		}
 	}
 
-	return nil
+	return fmt.Errorf(TWrongNumArgs, cmd.Usage())
+}
+
+func (cmd CmdRepository) kdf() knoxite.KDFParams {
+	return knoxite.KDFParams{
+		Algorithm: knoxite.KDFScrypt,
+		N:         cmd.ScryptN,
+		R:         cmd.ScryptR,
+		P:         cmd.ScryptP,
+	}
 }
 
 func (cmd CmdRepository) init() error {
@@ -67,10 +118,25 @@ func (cmd CmdRepository) init() error {
 			hostname = "unknown"
 		}*/
 
-	_, err := newRepository(cmd.global.Repo, cmd.global.Password)
+	chunker, err := cmd.chunker()
+	if err != nil {
+		return err
+	}
+
+	r, err := newRepository(cmd.global.Repo, cmd.global.Password, cmd.kdf())
 	if err != nil {
 		return fmt.Errorf("Creating repository at %s failed: %v", cmd.global.Repo, err)
 	}
+	if cmd.Placement != "" || cmd.Weight != "" || chunker != r.Chunker {
+		r.Chunker = chunker
+		err = cmd.configurePlacement(&r, 0)
+		if err == nil {
+			err = r.Save()
+		}
+		if err != nil {
+			return err
+		}
+	}
 
 	fmt.Printf("Created new repository at %s\n", cmd.global.Repo)
 	return nil
@@ -87,6 +153,10 @@ func (cmd CmdRepository) add(url string) error {
 		return err
 	}
 	r.Backend.AddBackend(&backend)
+	err = cmd.configurePlacement(&r, len(r.Backend.Backends)-1)
+	if err != nil {
+		return err
+	}
 
 	err = r.Save()
 	if err != nil {
@@ -97,6 +167,101 @@ func (cmd CmdRepository) add(url string) error {
 	return nil
 }
 
+func (cmd CmdRepository) remove(url string) error {
+	r, err := openRepository(cmd.global.Repo, cmd.global.Password)
+	if err != nil {
+		return err
+	}
+
+	// compare locations the way the backend reports them
+	backend, err := knoxite.BackendFromURL(url)
+	if err != nil {
+		return err
+	}
+	stats, err := r.RemoveBackend(backend.Location())
+	for _, merr := range stats.Errors {
+		fmt.Println("ERROR:", merr)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Moved %d and rebuilt %d chunk parts of %d chunks\n", stats.Moved, stats.Reconstructed, stats.Chunks)
+	fmt.Printf("Removed %s from repository, its data has not been deleted\n", backend.Location())
+	if url == cmd.global.Repo {
+		fmt.Printf("Use %s to access the repository from now on\n", r.Paths[0])
+	}
+	return nil
+}
+
+func (cmd CmdRepository) rebalance() error {
+	r, err := openRepository(cmd.global.Repo, cmd.global.Password)
+	if err != nil {
+		return err
+	}
+
+	stats, err := r.Rebalance()
+	if err != nil {
+		return err
+	}
+	for _, merr := range stats.Errors {
+		fmt.Println("ERROR:", merr)
+	}
+	fmt.Printf("Moved %d chunk parts of %d chunks\n", stats.Moved, stats.Chunks)
+
+	if len(stats.Errors) > 0 {
+		return fmt.Errorf("rebalance failed to move %d chunk parts", len(stats.Errors))
+	}
+	return nil
+}
+
+// configurePlacement applies the placement policy and the weight of the
+// backend with index be, if they were set on the command line
+func (cmd CmdRepository) configurePlacement(r *knoxite.Repository, be int) error {
+	if cmd.Placement != "" {
+		placement, err := knoxite.ParsePlacement(cmd.Placement)
+		if err != nil {
+			return err
+		}
+		r.Backend.Placement = placement
+	}
+	if cmd.Weight != "" {
+		weight, err := knoxite.ParseSize(cmd.Weight)
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, cmd.Weight)
+		}
+		r.Backend.Weights[be] = weight
+	}
+
+	return nil
+}
+
+// chunker returns the default chunker options, with the chunk sizes set on
+// the command line applied
+func (cmd CmdRepository) chunker() (knoxite.ChunkerOptions, error) {
+	opts := knoxite.DefaultChunkerOptions
+	sizes := []struct {
+		flag string
+		size *uint64
+	}{
+		{cmd.ChunkMin, &opts.MinSize},
+		{cmd.ChunkAvg, &opts.AvgSize},
+		{cmd.ChunkMax, &opts.MaxSize},
+	}
+	for _, s := range sizes {
+		if s.flag == "" {
+			continue
+		}
+		size, err := knoxite.ParseSize(s.flag)
+		if err != nil {
+			return opts, fmt.Errorf("%v: %s", err, s.flag)
+		}
+		*s.size = size
+	}
+
+	return opts, opts.Validate()
+}
+
 func (cmd CmdRepository) cat() error {
 	r, err := openRepository(cmd.global.Repo, cmd.global.Password)
 	if err != nil {
@@ -112,6 +277,174 @@ func (cmd CmdRepository) cat() error {
 	return nil
 }
 
+func (cmd CmdRepository) status() error {
+	r, err := openRepository(cmd.global.Repo, cmd.global.Password)
+	if err != nil {
+		return err
+	}
+
+	status, err := r.Status()
+	if err != nil {
+		return err
+	}
+
+	tab := NewTable([]string{"Location", "Status", "Latency", "Chunks", "Snapshots", "Used", "Free", "Total"},
+		[]int64{-40, -7, 8, 8, 9, 10, 10, 10}, "No storage backends configured.")
+	for _, b := range status.Backends {
+		state, latency, chunks, snapshots, used, free, total := "offline", "-", "-", "-", "-", "-", "-"
+		if b.Online() {
+			state = "online"
+			latency = b.Latency.Round(time.Microsecond).String()
+			used = knoxite.SizeToString(b.Used)
+		}
+		if b.Listed {
+			chunks = strconv.FormatUint(b.Chunks, 10)
+			snapshots = strconv.FormatUint(b.Snapshots, 10)
+		}
+		if b.SpaceKnown {
+			free = knoxite.SizeToString(b.Free)
+			total = knoxite.SizeToString(b.Total)
+		}
+		tab.Rows = append(tab.Rows, []interface{}{b.Location, state, latency, chunks, snapshots, used, free, total})
+	}
+	tab.Print()
+
+	fmt.Println()
+	for _, b := range status.Backends {
+		if !b.Online() {
+			fmt.Printf("ERROR: %s is unreachable: %v\n", b.Location, b.Err)
+		}
+	}
+	if status.Online() < status.Required {
+		fmt.Printf("WARNING: only %d of the %d storage backends needed to keep the parts of every chunk on different backends are reachable\n",
+			status.Online(), status.Required)
+	}
+	if status.Unrecoverable > 0 {
+		fmt.Printf("ERROR: %d chunks can't be restored from the reachable storage backends\n", status.Unrecoverable)
+	}
+	if status.Degraded > 0 {
+		fmt.Printf("WARNING: %d chunks are missing parts and tolerate fewer storage backend failures than configured\n",
+			status.Degraded)
+	}
+	fmt.Printf("%d of %d storage backends online, %d chunks stored to survive the failure of %d storage backends\n",
+		status.Online(), len(status.Backends), status.Chunks, status.Tolerance)
+
+	if status.Unrecoverable > 0 || status.Degraded > 0 {
+		return errors.New("repository is degraded, run repair once all storage backends are back online")
+	}
+	return nil
+}
+
+func (cmd CmdRepository) backends() error {
+	tab := NewTable([]string{"Scheme", "Description"}, []int64{-10, -40}, "No storage backends available.")
+	for _, info := range knoxite.RegisteredBackends() {
+		scheme := info.Scheme + "://"
+		if info.Scheme == "" {
+			scheme = "(path)"
+		}
+		tab.Rows = append(tab.Rows, []interface{}{scheme, info.Description})
+	}
+
+	tab.Print()
+	return nil
+}
+
+func (cmd CmdRepository) passwd() error {
+	r, err := openRepository(cmd.global.Repo, cmd.global.Password)
+	if err != nil {
+		return err
+	}
+
+	password, err := readPasswordTwice("Enter new password:", "Confirm new password:")
+	if err != nil {
+		return err
+	}
+	err = r.ChangePassword(password)
+	if err != nil {
+		return err
+	}
+
+	err = r.Save()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Changed password successfully")
+	return nil
+}
+
+func (cmd CmdRepository) addKey() error {
+	r, err := openRepository(cmd.global.Repo, cmd.global.Password)
+	if err != nil {
+		return err
+	}
+
+	password, err := readPasswordTwice("Enter password for new key:", "Confirm password:")
+	if err != nil {
+		return err
+	}
+	slot, err := r.AddKey(password, cmd.Description, cmd.kdf())
+	if err != nil {
+		return err
+	}
+
+	err = r.Save()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Key %s added to repository\n", slot.ID)
+	return nil
+}
+
+func (cmd CmdRepository) listKeys() error {
+	r, err := openRepository(cmd.global.Repo, cmd.global.Password)
+	if err != nil {
+		return err
+	}
+
+	current, _ := r.CurrentKey()
+	tab := NewTable([]string{"", "ID", "Created", "KDF", "Description"},
+		[]int64{-1, -8, -19, -24, -40}, "No keys found. This repository uses a single password.")
+	if r.Header != nil {
+		for _, slot := range r.Header.Keys {
+			marker := ""
+			if slot.ID == current.ID {
+				marker = "*"
+			}
+			tab.Rows = append(tab.Rows, []interface{}{
+				marker,
+				slot.ID,
+				slot.Created.Format(timeFormat),
+				fmt.Sprintf("%s N=%d r=%d p=%d", slot.KDF.Algorithm, slot.KDF.N, slot.KDF.R, slot.KDF.P),
+				slot.Description})
+		}
+	}
+
+	tab.Print()
+	return nil
+}
+
+func (cmd CmdRepository) removeKey(id string) error {
+	r, err := openRepository(cmd.global.Repo, cmd.global.Password)
+	if err != nil {
+		return err
+	}
+
+	err = r.RemoveKey(id)
+	if err == knoxite.ErrCurrentKey {
+		return fmt.Errorf("%v, use 'repo passwd' to change its password instead", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = r.Save()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Key %s removed from repository\n", id)
+	return nil
+}
+
 func openRepository(path, password string) (knoxite.Repository, error) {
 	if password == "" {
 		var err error
@@ -121,10 +454,11 @@ func openRepository(path, password string) (knoxite.Repository, error) {
 		}
 	}
 
+	globalOpts.configureBackends()
 	return knoxite.OpenRepository(path, password)
 }
 
-func newRepository(path, password string) (knoxite.Repository, error) {
+func newRepository(path, password string, kdf knoxite.KDFParams) (knoxite.Repository, error) {
 	if password == "" {
 		var err error
 		password, err = readPasswordTwice("Enter password:", "Confirm password:")
@@ -133,7 +467,8 @@ func newRepository(path, password string) (knoxite.Repository, error) {
 		}
 	}
 
-	return knoxite.NewRepository(path, password)
+	globalOpts.configureBackends()
+	return knoxite.NewRepositoryWithKDF(path, password, kdf)
 }
 
 func readPassword(prompt string) (string, error) {
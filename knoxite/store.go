@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"os"
@@ -16,10 +17,22 @@ type CmdStore struct {
 	Compression      string `short:"c" long:"compression" description:"compression algo to use: none (default), gzip"`
 	Encryption       string `short:"e" long:"encryption"  description:"encryption algo to use: aes (default), none"`
 	FailureTolerance uint   `short:"t" long:"tolerance"   description:"failure tolerance against n backend failures"`
+	Parent           string `long:"parent"                description:"snapshot to compare against for unchanged files (default: latest snapshot in volume)"`
+	FilterOptions
 
 	global *GlobalOptions
 }
 
+// FilterOptions describes which files get stored
+type FilterOptions struct {
+	Excludes          []string `long:"exclude"                description:"exclude files matching a pattern (gitignore syntax)"`
+	Includes          []string `long:"include"                description:"include files matching a pattern, even if they're excluded (not below excluded directories)"`
+	ExcludeFiles      []string `long:"exclude-file"           description:"read exclude patterns from a file"`
+	ExcludeCaches     bool     `long:"exclude-caches"         description:"exclude directories containing a CACHEDIR.TAG file"`
+	ExcludeLargerThan string   `long:"exclude-larger-than"    description:"exclude files larger than this size, e.g. 100M"`
+	OneFileSystem     bool     `short:"x" long:"one-file-system" description:"don't cross filesystem boundaries"`
+}
+
 func init() {
 	_, err := parser.AddCommand("store",
 		"store file/directory",
@@ -30,7 +43,41 @@ func init() {
 	}
 }
 
-func (cmd CmdStore) store(repository *knoxite.Repository, snapshot *knoxite.Snapshot, targets []string) error {
+func (opts FilterOptions) filter() (*knoxite.Filter, error) {
+	filter := &knoxite.Filter{
+		Excludes:      opts.Excludes,
+		Includes:      opts.Includes,
+		ExcludeCaches: opts.ExcludeCaches,
+		OneFileSystem: opts.OneFileSystem,
+	}
+
+	for _, name := range opts.ExcludeFiles {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			filter.Excludes = append(filter.Excludes, scanner.Text())
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.ExcludeLargerThan != "" {
+		size, err := knoxite.ParseSize(opts.ExcludeLargerThan)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %s", err, opts.ExcludeLargerThan)
+		}
+		filter.ExcludeLargerThan = size
+	}
+
+	return filter, nil
+}
+
+func (cmd CmdStore) store(repository *knoxite.Repository, snapshot *knoxite.Snapshot, parent *knoxite.Snapshot, targets []string, filter *knoxite.Filter) error {
 	fmt.Println()
 	overallProgressBar := NewProgressBar("Overall Progress", 0, 0, 60)
 	wd, gerr := os.Getwd()
@@ -38,12 +85,12 @@ func (cmd CmdStore) store(repository *knoxite.Repository, snapshot *knoxite.Snap
 		return gerr
 	}
 
-	if uint(len(repository.Backend.Backends))-cmd.FailureTolerance <= 0 {
+	if cmd.FailureTolerance >= uint(len(repository.Backend.Backends)) {
 		return errors.New("failure tolerance can't be equal or higher as the number of storage backends")
 	}
 
 	progress, serr := snapshot.Add(wd, targets, *repository, strings.ToLower(cmd.Compression) == "gzip", strings.ToLower(cmd.Encryption) != "none",
-		uint(len(repository.Backend.Backends))-cmd.FailureTolerance, cmd.FailureTolerance)
+		uint(len(repository.Backend.Backends))-cmd.FailureTolerance, cmd.FailureTolerance, parent, filter)
 	if serr != nil {
 		return serr
 	}
@@ -51,6 +98,10 @@ func (cmd CmdStore) store(repository *knoxite.Repository, snapshot *knoxite.Snap
 	fileProgressBar := NewProgressBar("", 0, 0, 60)
 	lastPath := ""
 	for p := range progress {
+		if p.Error != nil {
+			fmt.Println()
+			return p.Error
+		}
 		if p.Path != lastPath && lastPath != "" {
 			fmt.Println()
 		}
@@ -99,7 +150,10 @@ func (cmd CmdStore) Execute(args []string) error {
 		targets = append(targets, target)
 	}
 
-	// filter here? exclude/include?
+	filter, err := cmd.filter()
+	if err != nil {
+		return err
+	}
 
 	repository, err := openRepository(cmd.global.Repo, cmd.global.Password)
 	if err != nil {
@@ -109,11 +163,15 @@ func (cmd CmdStore) Execute(args []string) error {
 	if err != nil {
 		return err
 	}
+	parent, err := cmd.findParent(&repository, volume)
+	if err != nil {
+		return err
+	}
 	snapshot, err := knoxite.NewSnapshot(cmd.Description)
 	if err != nil {
 		return err
 	}
-	err = cmd.store(&repository, &snapshot, targets)
+	err = cmd.store(&repository, &snapshot, parent, targets, filter)
 	if err != nil {
 		return err
 	}
@@ -127,3 +185,21 @@ func (cmd CmdStore) Execute(args []string) error {
 	}
 	return repository.Save()
 }
+
+// findParent returns the snapshot to compare new files against, or nil if
+// there is none
+func (cmd CmdStore) findParent(repository *knoxite.Repository, volume *knoxite.Volume) (*knoxite.Snapshot, error) {
+	if cmd.Parent != "" {
+		_, parent, err := repository.FindSnapshot(cmd.Parent)
+		return parent, err
+	}
+	if len(volume.Snapshots) == 0 {
+		return nil, nil
+	}
+
+	parent, err := volume.LoadSnapshot(volume.Snapshots[len(volume.Snapshots)-1], repository)
+	if err != nil {
+		return nil, err
+	}
+	return &parent, nil
+}
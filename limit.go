@@ -0,0 +1,139 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"sync"
+	"time"
+)
+
+// Bandwidth limits shared by all backends added to a BackendManager. nil
+// means unlimited
+var (
+	UploadLimiter   *RateLimiter
+	DownloadLimiter *RateLimiter
+)
+
+// RateLimiter is a token bucket limiting the throughput of all goroutines
+// sharing it
+type RateLimiter struct {
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	m     sync.Mutex
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// NewRateLimiter returns a RateLimiter allowing bytesPerSecond on average,
+// with bursts of up to one second worth of data
+func NewRateLimiter(bytesPerSecond uint64) *RateLimiter {
+	return &RateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+// Wait blocks until n bytes may be transferred. Transfers larger than the
+// bucket go into debt, which later callers have to wait for as well
+func (l *RateLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.m.Lock()
+	now := l.now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	tokens := l.tokens
+	l.m.Unlock()
+
+	if tokens < 0 {
+		l.sleep(time.Duration(-tokens * float64(time.Second) / l.rate))
+	}
+}
+
+// LimitedBackend wraps a Backend and limits how fast data gets transferred
+// to and from it
+type LimitedBackend struct {
+	Backend
+	Upload   *RateLimiter
+	Download *RateLimiter
+}
+
+// NewLimitedBackend returns a LimitedBackend wrapping backend. Either
+// limiter may be nil
+func NewLimitedBackend(backend Backend, upload, download *RateLimiter) *LimitedBackend {
+	return &LimitedBackend{
+		Backend:  backend,
+		Upload:   upload,
+		Download: download,
+	}
+}
+
+// AvailableSpace returns the free and the total space of the wrapped backend
+func (backend *LimitedBackend) AvailableSpace() (free, total uint64, err error) {
+	return BackendSpace(backend.Backend)
+}
+
+// LoadChunk loads a Chunk
+func (backend *LimitedBackend) LoadChunk(shasum string, part, totalParts uint) (*[]byte, error) {
+	b, err := backend.Backend.LoadChunk(shasum, part, totalParts)
+	if err == nil {
+		backend.Download.Wait(len(*b))
+	}
+	return b, err
+}
+
+// StoreChunk stores a single Chunk
+func (backend *LimitedBackend) StoreChunk(shasum string, part, totalParts uint, data *[]byte) (size uint64, err error) {
+	// chunks which are already stored don't get transferred again
+	size, err = backend.Backend.StoreChunk(shasum, part, totalParts, data)
+	backend.Upload.Wait(int(size))
+	return size, err
+}
+
+// LoadSnapshot loads a snapshot
+func (backend *LimitedBackend) LoadSnapshot(id string) ([]byte, error) {
+	b, err := backend.Backend.LoadSnapshot(id)
+	if err == nil {
+		backend.Download.Wait(len(b))
+	}
+	return b, err
+}
+
+// SaveSnapshot stores a snapshot
+func (backend *LimitedBackend) SaveSnapshot(id string, data []byte) error {
+	backend.Upload.Wait(len(data))
+	return backend.Backend.SaveSnapshot(id, data)
+}
+
+// LoadRepository reads the metadata for a repository
+func (backend *LimitedBackend) LoadRepository() ([]byte, error) {
+	b, err := backend.Backend.LoadRepository()
+	if err == nil {
+		backend.Download.Wait(len(b))
+	}
+	return b, err
+}
+
+// SaveRepository stores the metadata for a repository
+func (backend *LimitedBackend) SaveRepository(data []byte) error {
+	backend.Upload.Wait(len(data))
+	return backend.Backend.SaveRepository(data)
+}
@@ -0,0 +1,128 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock lets a RateLimiter run without actually sleeping
+type fakeClock struct {
+	m     sync.Mutex
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.slept += d
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestRateLimiter(rate uint64) (*RateLimiter, *fakeClock) {
+	clock := &fakeClock{now: time.Now()}
+	l := NewRateLimiter(rate)
+	l.last = clock.now
+	l.now = clock.Now
+	l.sleep = clock.Sleep
+	return l, clock
+}
+
+func TestRateLimiter(t *testing.T) {
+	l, clock := newTestRateLimiter(1000)
+
+	// the initial burst doesn't have to wait
+	l.Wait(1000)
+	if clock.slept != 0 {
+		t.Errorf("Expected no delay for a burst, got %v", clock.slept)
+	}
+
+	// going into debt
+	l.Wait(500)
+	if clock.slept != 500*time.Millisecond {
+		t.Errorf("Expected a delay of 500ms, got %v", clock.slept)
+	}
+
+	// refilling the bucket
+	clock.Advance(2 * time.Second)
+	clock.slept = 0
+	l.Wait(1000)
+	if clock.slept != 0 {
+		t.Errorf("Expected no delay after refilling, got %v", clock.slept)
+	}
+
+	var nilLimiter *RateLimiter
+	nilLimiter.Wait(1000)
+}
+
+func TestRateLimiterConcurrent(t *testing.T) {
+	l, clock := newTestRateLimiter(1000)
+	l.tokens = 0
+
+	// the limit applies to all goroutines together, not to each of them
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.Wait(100)
+		}()
+	}
+	wg.Wait()
+
+	// goroutines wait for 0.1s, 0.2s, ..., 1s of debt
+	if clock.slept != 5500*time.Millisecond {
+		t.Errorf("Expected a total delay of 5.5s, got %v", clock.slept)
+	}
+}
+
+func TestLimitedBackend(t *testing.T) {
+	flaky, cleanup := newFlakyBackend(t, 0, nil)
+	defer cleanup()
+
+	upload, uclock := newTestRateLimiter(1000)
+	download, dclock := newTestRateLimiter(1000)
+	backend := NewLimitedBackend(flaky, upload, download)
+
+	data := make([]byte, 3000)
+	if _, err := backend.StoreChunk("abc", 0, 1, &data); err != nil {
+		t.Fatal(err)
+	}
+	if uclock.slept != 2*time.Second {
+		t.Errorf("Expected an upload delay of 2s, got %v", uclock.slept)
+	}
+
+	// already stored chunks don't count
+	if _, err := backend.StoreChunk("abc", 0, 1, &data); err != nil {
+		t.Fatal(err)
+	}
+	if uclock.slept != 2*time.Second {
+		t.Errorf("Expected an upload delay of 2s, got %v", uclock.slept)
+	}
+
+	if _, err := backend.LoadChunk("abc", 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if dclock.slept != 2*time.Second {
+		t.Errorf("Expected a download delay of 2s, got %v", dclock.slept)
+	}
+}
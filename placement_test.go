@@ -0,0 +1,196 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestParsePlacement(t *testing.T) {
+	for s, expected := range map[string]Placement{
+		"":         PlacementStripe,
+		"stripe":   PlacementStripe,
+		"mirror":   PlacementMirror,
+		"weighted": PlacementWeighted,
+	} {
+		p, err := ParsePlacement(s)
+		if err != nil || p != expected {
+			t.Errorf("Expected %s for %q, got %s (%v)", expected, s, p, err)
+		}
+	}
+	if _, err := ParsePlacement("random"); err != ErrInvalidPlacement {
+		t.Errorf("Expected %v, got %v", ErrInvalidPlacement, err)
+	}
+}
+
+// storeWithPlacement stores chunks with parts parts each and returns how many
+// parts ended up on each of the backends
+func storeWithPlacement(t *testing.T, name string, placement Placement, weights []uint64, chunks int, parts int) []int {
+	manager := BackendManager{Placement: placement}
+	memories := []*StorageMemory{}
+	for i := range weights {
+		memory := newTestStorageMemory(t, fmt.Sprintf("mem://%s%d", name, i))
+		memories = append(memories, memory)
+		var backend Backend = memory
+		manager.AddBackend(&backend)
+	}
+	copy(manager.Weights, weights)
+
+	for c := 0; c < chunks; c++ {
+		data := [][]byte{}
+		for p := 0; p < parts; p++ {
+			data = append(data, []byte(fmt.Sprintf("chunk %d part %d", c, p)))
+		}
+		chunk := Chunk{ShaSum: fmt.Sprintf("%064x", c), DataParts: uint(parts), Data: &data}
+		if _, err := manager.StoreChunk(&chunk); err != nil {
+			t.Fatal(err)
+		}
+
+		// the parts of a chunk must not end up on the same backend
+		if placement != PlacementMirror && parts <= len(weights) {
+			for _, memory := range memories {
+				n := 0
+				for p := 0; p < parts; p++ {
+					if _, err := memory.StatChunk(chunk.ShaSum, uint(p), uint(parts)); err == nil {
+						n++
+					}
+				}
+				if n > 1 {
+					t.Errorf("Expected parts of chunk %d on different backends, got %d on %s", c, n, memory.Location())
+				}
+			}
+		}
+	}
+
+	counts := []int{}
+	for i, memory := range memories {
+		names, _ := memory.ListChunks()
+		counts = append(counts, len(names))
+		RemoveStorageMemory(fmt.Sprintf("%s%d", name, i))
+	}
+	return counts
+}
+
+func TestPlacementStripe(t *testing.T) {
+	counts := storeWithPlacement(t, "stripe", PlacementStripe, []uint64{1, 1, 1}, 30, 1)
+	for i, n := range counts {
+		if n != 10 {
+			t.Errorf("Expected 10 parts on backend %d, got %d", i, n)
+		}
+	}
+}
+
+func TestPlacementMirror(t *testing.T) {
+	counts := storeWithPlacement(t, "mirror", PlacementMirror, []uint64{1, 1, 1}, 10, 2)
+	for i, n := range counts {
+		if n != 20 {
+			t.Errorf("Expected 20 parts on backend %d, got %d", i, n)
+		}
+	}
+}
+
+func TestPlacementWeighted(t *testing.T) {
+	// e.g. a 100 GB NAS next to 300 GB of cloud storage
+	counts := storeWithPlacement(t, "weighted", PlacementWeighted, []uint64{100 << 30, 300 << 30}, 40, 1)
+	if counts[0] != 10 || counts[1] != 30 {
+		t.Errorf("Expected parts to be distributed 10/30, got %v", counts)
+	}
+
+	// parts of a chunk still get spread across backends
+	counts = storeWithPlacement(t, "weighted-parts", PlacementWeighted, []uint64{1, 1, 4}, 12, 2)
+	if counts[0]+counts[1] != 12 || counts[2] != 12 {
+		t.Errorf("Expected one part of every chunk on the heaviest backend, got %v", counts)
+	}
+}
+
+func TestPlacementStoredInRepository(t *testing.T) {
+	defer RemoveStorageMemory("placement1")
+	defer RemoveStorageMemory("placement2")
+
+	r, err := NewRepository("mem://placement1", "this_is_a_password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := BackendFromURL("mem://placement2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Backend.AddBackend(&backend)
+	r.Backend.Placement = PlacementWeighted
+	r.Backend.Weights[1] = 5
+	if err := r.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = OpenRepository("mem://placement1", "this_is_a_password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Backend.Placement != PlacementWeighted {
+		t.Errorf("Expected placement %s, got %s", PlacementWeighted, r.Backend.Placement)
+	}
+	if len(r.Backend.Weights) != 2 || r.Backend.Weights[0] != 1 || r.Backend.Weights[1] != 5 {
+		t.Errorf("Unexpected weights %v", r.Backend.Weights)
+	}
+}
+
+func TestPlacementMap(t *testing.T) {
+	manager := BackendManager{}
+	faulty := []*StorageFaulty{}
+	for i := 0; i < 3; i++ {
+		name := fmt.Sprintf("placement-map%d", i)
+		defer RemoveStorageMemory(name)
+		f := NewStorageFaulty(newTestStorageMemory(t, "mem://"+name), FaultOptions{})
+		faulty = append(faulty, f)
+		var backend Backend = f
+		manager.AddBackend(&backend)
+	}
+	operations := func() int {
+		n := 0
+		for _, f := range faulty {
+			n += f.Operations()
+		}
+		return n
+	}
+
+	data := [][]byte{[]byte("part 0"), []byte("part 1"), []byte("part 2")}
+	chunk := Chunk{ShaSum: fmt.Sprintf("%064x", 1), DataParts: 3, Data: &data}
+	if _, err := manager.StoreChunk(&chunk); err != nil {
+		t.Fatal(err)
+	}
+	if len(chunk.Backends) != 3 {
+		t.Fatalf("Expected backends of 3 parts to be recorded, got %v", chunk.Backends)
+	}
+
+	// every part is loaded straight from the backend holding it
+	ops := operations()
+	for part := range data {
+		b, err := manager.LoadChunk(chunk, uint(part))
+		if err != nil || string(b) != string(data[part]) {
+			t.Errorf("Expected %s, got %s (%v)", data[part], b, err)
+		}
+	}
+	if n := operations() - ops; n != len(data) {
+		t.Errorf("Expected %d backend operations, got %d", len(data), n)
+	}
+
+	// a stale record falls back to probing the other backends
+	chunk.Backends[0] = chunk.Backends[1]
+	b, err := manager.LoadChunk(chunk, 0)
+	if err != nil || string(b) != string(data[0]) {
+		t.Errorf("Expected %s, got %s (%v)", data[0], b, err)
+	}
+
+	// chunks stored without a record get probed as well
+	chunk.Backends = nil
+	b, err = manager.LoadChunk(chunk, 2)
+	if err != nil || string(b) != string(data[2]) {
+		t.Errorf("Expected %s, got %s (%v)", data[2], b, err)
+	}
+}
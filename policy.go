@@ -0,0 +1,123 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// RetentionPolicy decides which snapshots of a volume to keep. Each rule
+// keeps the newest snapshot of the n most recent hours, days, weeks, etc.
+// that contain a snapshot
+type RetentionPolicy struct {
+	KeepLast    int `json:"keep_last,omitempty"`
+	KeepHourly  int `json:"keep_hourly,omitempty"`
+	KeepDaily   int `json:"keep_daily,omitempty"`
+	KeepWeekly  int `json:"keep_weekly,omitempty"`
+	KeepMonthly int `json:"keep_monthly,omitempty"`
+	KeepYearly  int `json:"keep_yearly,omitempty"`
+}
+
+// PolicyDecision describes whether a snapshot is kept and why
+type PolicyDecision struct {
+	Snapshot Snapshot
+	Keep     bool
+	Reasons  []string
+}
+
+type retentionRule struct {
+	name   string
+	count  int
+	bucket func(t time.Time) string
+}
+
+// Empty returns true if the policy doesn't contain any rules
+func (p RetentionPolicy) Empty() bool {
+	return p == RetentionPolicy{}
+}
+
+// String returns a human-readable description of the policy
+func (p RetentionPolicy) String() string {
+	if p.Empty() {
+		return "keep everything"
+	}
+
+	str := ""
+	for _, rule := range p.rules() {
+		if rule.count > 0 {
+			if str != "" {
+				str += ", "
+			}
+			str += fmt.Sprintf("%d %s", rule.count, rule.name)
+		}
+	}
+	return "keep " + str
+}
+
+func (p RetentionPolicy) rules() []retentionRule {
+	return []retentionRule{
+		{"last", p.KeepLast, nil},
+		{"hourly", p.KeepHourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{"daily", p.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{"monthly", p.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", p.KeepYearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+}
+
+type snapshotsByDate []Snapshot
+
+func (s snapshotsByDate) Len() int           { return len(s) }
+func (s snapshotsByDate) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s snapshotsByDate) Less(i, j int) bool { return s[i].Date.After(s[j].Date) }
+
+// Apply decides which of snapshots to keep. The returned decisions are
+// sorted by date, newest first. An empty policy keeps all snapshots
+func (p RetentionPolicy) Apply(snapshots []Snapshot) []PolicyDecision {
+	sorted := make([]Snapshot, len(snapshots))
+	copy(sorted, snapshots)
+	sort.Stable(snapshotsByDate(sorted))
+
+	decisions := make([]PolicyDecision, len(sorted))
+	for i, snapshot := range sorted {
+		decisions[i].Snapshot = snapshot
+		if p.Empty() {
+			decisions[i].Keep = true
+			decisions[i].Reasons = []string{"no policy"}
+		}
+	}
+
+	for _, rule := range p.rules() {
+		kept := 0
+		lastBucket := ""
+		for i := range decisions {
+			if kept >= rule.count {
+				break
+			}
+
+			if rule.bucket != nil {
+				bucket := rule.bucket(decisions[i].Snapshot.Date.Local())
+				if bucket == lastBucket {
+					continue
+				}
+				lastBucket = bucket
+			}
+
+			decisions[i].Keep = true
+			decisions[i].Reasons = append(decisions[i].Reasons, rule.name)
+			kept++
+		}
+	}
+
+	return decisions
+}
@@ -0,0 +1,58 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRetentionPolicy(t *testing.T) {
+	// one snapshot every 12 hours for 60 days
+	now := time.Date(2016, 8, 31, 20, 0, 0, 0, time.Local)
+	snapshots := []Snapshot{}
+	for i := 0; i < 120; i++ {
+		snapshots = append(snapshots, Snapshot{
+			ID:   strconv.Itoa(i),
+			Date: now.Add(-time.Duration(i) * 12 * time.Hour),
+		})
+	}
+
+	policy := RetentionPolicy{KeepLast: 3, KeepDaily: 7, KeepMonthly: 2}
+	kept := map[string][]string{}
+	for _, d := range policy.Apply(snapshots) {
+		if d.Keep {
+			kept[d.Snapshot.ID] = d.Reasons
+		}
+	}
+
+	// last: 0, 1, 2. daily: 0, 2, 4, .., 12. monthly: 0 (August), 62 (July)
+	expected := []string{"0", "1", "2", "4", "6", "8", "10", "12", "62"}
+	if len(kept) != len(expected) {
+		t.Errorf("Expected %d snapshots to be kept, got %d: %v", len(expected), len(kept), kept)
+	}
+	for _, id := range expected {
+		if _, ok := kept[id]; !ok {
+			t.Errorf("Expected snapshot %s to be kept", id)
+		}
+	}
+	if len(kept["0"]) != 3 {
+		t.Errorf("Expected newest snapshot to be kept for 3 reasons, got %v", kept["0"])
+	}
+}
+
+func TestEmptyRetentionPolicy(t *testing.T) {
+	snapshots := []Snapshot{{ID: "a", Date: time.Now()}, {ID: "b", Date: time.Now().Add(-time.Hour)}}
+
+	for _, d := range (RetentionPolicy{}).Apply(snapshots) {
+		if !d.Keep {
+			t.Errorf("Expected empty policy to keep snapshot %s", d.Snapshot.ID)
+		}
+	}
+}
@@ -6,6 +6,7 @@ type Progress struct {
 	Size        uint64
 	StorageSize uint64
 	Statistics  Stats
+	Error       error // why storing failed, set on the last progress of a failed run
 }
 
 func newProgress(item *ItemData) Progress {
@@ -0,0 +1,144 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+// PruneStats contains the results of pruning a repository
+type PruneStats struct {
+	Referenced uint64 // chunks still referenced by a snapshot
+	Removed    uint64 // chunk parts removed from storage backends
+	Skipped    uint64 // storage backends which don't support deleting
+}
+
+// ForgetSnapshot removes a snapshot from its volume and all storage backends.
+// The chunks belonging to it remain stored until the repository gets pruned
+func (r *Repository) ForgetSnapshot(id string) error {
+	return r.ForgetSnapshots([]string{id})
+}
+
+// ForgetSnapshots removes snapshots from their volumes and all storage
+// backends, saving the repository once. If any of them can't be found, none
+// get removed
+func (r *Repository) ForgetSnapshots(ids []string) error {
+	forget := make(map[string]bool)
+	for _, id := range ids {
+		if !r.hasSnapshot(id) {
+			return ErrSnapshotNotFound
+		}
+		forget[id] = true
+	}
+	for id := range forget {
+		for _, volume := range r.Volumes {
+			volume.RemoveSnapshot(id)
+		}
+	}
+
+	// save the repository first, a failure afterwards only leaves
+	// unreferenced snapshots behind
+	err := r.Save()
+	if err != nil {
+		return err
+	}
+
+	for id := range forget {
+		if derr := r.Backend.DeleteSnapshot(id); derr != nil && err == nil {
+			err = derr
+		}
+	}
+	return err
+}
+
+// hasSnapshot returns true if a volume of the repository contains the
+// snapshot with the given id
+func (r *Repository) hasSnapshot(id string) bool {
+	for _, volume := range r.Volumes {
+		for _, s := range volume.Snapshots {
+			if s == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// referencedChunks returns the names of all chunk parts used by any snapshot
+// and how many chunks they belong to
+func (r *Repository) referencedChunks() (map[string]bool, uint64, error) {
+	parts := make(map[string]bool)
+	chunks := make(map[string]bool)
+	for _, volume := range r.Volumes {
+		for _, id := range volume.Snapshots {
+			snapshot, err := volume.LoadSnapshot(id, r)
+			if err != nil {
+				return parts, 0, err
+			}
+
+			for _, item := range snapshot.Items {
+				for _, chunk := range item.Chunks {
+					if chunks[chunkKey(chunk)] {
+						continue
+					}
+					chunks[chunkKey(chunk)] = true
+
+					total := chunk.DataParts + chunk.ParityParts
+					if chunk.ParityParts == 0 {
+						total = 1
+					}
+					for part := uint(0); part < total; part++ {
+						parts[chunkName(chunk.ShaSum, part, chunk.DataParts)] = true
+					}
+				}
+			}
+		}
+	}
+
+	return parts, uint64(len(chunks)), nil
+}
+
+// Prune deletes all chunks from the storage backends which aren't referenced
+// by any snapshot anymore. It must not run while snapshots are being stored
+// in the same repository, as it would remove their freshly stored chunks
+func (r *Repository) Prune() (PruneStats, error) {
+	stats := PruneStats{}
+	referenced, chunks, err := r.referencedChunks()
+	if err != nil {
+		return stats, err
+	}
+	stats.Referenced = chunks
+
+	for _, be := range r.Backend.Backends {
+		caps := (*be).Capabilities()
+		if !caps.List || !caps.Delete {
+			stats.Skipped++
+			continue
+		}
+
+		names, err := (*be).ListChunks()
+		if err == ErrNotSupported {
+			stats.Skipped++
+			continue
+		}
+		if err != nil {
+			return stats, err
+		}
+
+		for _, name := range names {
+			shasum, part, totalParts, err := ParseChunkName(name)
+			if err != nil || referenced[chunkName(shasum, part, totalParts)] {
+				continue
+			}
+
+			err = (*be).DeleteChunk(shasum, part, totalParts)
+			if err != nil {
+				return stats, err
+			}
+			stats.Removed++
+		}
+	}
+
+	return stats, nil
+}
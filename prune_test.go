@@ -0,0 +1,143 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestForgetAndPrune(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	vol, err := NewVolume("test_name", "test_description")
+	if err != nil {
+		t.Errorf("Failed creating volume: %s", err)
+		return
+	}
+	r.AddVolume(vol)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Failed getting working dir: %s", err)
+		return
+	}
+
+	snapshots := []Snapshot{}
+	for _, file := range []string{"snapshot_test.go", "prune_test.go"} {
+		snapshot, err := NewSnapshot(file)
+		if err != nil {
+			t.Errorf("Failed creating snapshot: %s", err)
+			return
+		}
+		progress, err := snapshot.Add(wd, []string{file}, r, false, true, 1, 0, nil, nil)
+		if err != nil {
+			t.Errorf("Failed adding to snapshot: %s", err)
+			return
+		}
+		for range progress {
+		}
+		err = snapshot.Save(&r)
+		if err != nil {
+			t.Errorf("Failed saving snapshot: %s", err)
+			return
+		}
+		vol.AddSnapshot(snapshot.ID)
+		snapshots = append(snapshots, snapshot)
+	}
+	err = r.Save()
+	if err != nil {
+		t.Errorf("Failed saving repository: %s", err)
+		return
+	}
+
+	err = r.ForgetSnapshot(snapshots[0].ID)
+	if err != nil {
+		t.Errorf("Failed forgetting snapshot: %s", err)
+		return
+	}
+	if _, _, err = r.FindSnapshot(snapshots[0].ID); err != ErrSnapshotNotFound {
+		t.Errorf("Expected %v, got %v", ErrSnapshotNotFound, err)
+	}
+	if err = r.ForgetSnapshot(snapshots[0].ID); err != ErrSnapshotNotFound {
+		t.Errorf("Expected %v, got %v", ErrSnapshotNotFound, err)
+	}
+
+	// an unknown ID keeps the other snapshots from being forgotten
+	if err = r.ForgetSnapshots([]string{snapshots[1].ID, snapshots[0].ID}); err != ErrSnapshotNotFound {
+		t.Errorf("Expected %v, got %v", ErrSnapshotNotFound, err)
+	}
+	if _, _, err = r.FindSnapshot(snapshots[1].ID); err != nil {
+		t.Errorf("Expected snapshot %s to be kept, got %v", snapshots[1].ID, err)
+	}
+
+	stats, err := r.Prune()
+	if err != nil {
+		t.Errorf("Failed pruning repository: %s", err)
+		return
+	}
+	if stats.Removed != uint64(len(snapshots[0].Items[0].Chunks)) {
+		t.Errorf("Expected %d removed chunk parts, got %d", len(snapshots[0].Items[0].Chunks), stats.Removed)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "chunks"))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(files) != len(snapshots[1].Items[0].Chunks) {
+		t.Errorf("Expected %d remaining chunk parts, got %d", len(snapshots[1].Items[0].Chunks), len(files))
+	}
+}
+
+func TestPruneLayouts(t *testing.T) {
+	r, cleanup := storeSmallChunks(t, "prune-layouts", 3, 1, 0)
+	defer cleanup()
+
+	// the same chunks stored again with a different part layout
+	addMemorySnapshot(t, &r, "rebalance.go", 2, 1)
+	if err := r.ForgetSnapshot(r.Volumes[0].Snapshots[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := snapshotChunkList(t, r)
+	stats, err := r.Prune()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Removed != uint64(len(chunks)) {
+		t.Errorf("Expected %d removed chunk parts, got %d", len(chunks), stats.Removed)
+	}
+
+	remaining := 0
+	for _, be := range r.Backend.Backends {
+		for _, name := range mustList(t, *be) {
+			if _, _, totalParts, _ := ParseChunkName(name); totalParts != 2 {
+				t.Errorf("Expected chunk part %s to be pruned", name)
+			}
+			remaining++
+		}
+	}
+	if remaining != 3*len(chunks) {
+		t.Errorf("Expected %d remaining chunk parts, got %d", 3*len(chunks), remaining)
+	}
+}
@@ -0,0 +1,385 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MigrateStats contains the results of moving chunk parts between storage
+// backends
+type MigrateStats struct {
+	Chunks        uint64 // chunks checked
+	Moved         uint64 // parts moved or copied to another backend
+	Reconstructed uint64 // parts rebuilt from the other parts of their chunk
+	Errors        []error
+}
+
+// Error declarations
+var (
+	ErrBackendNotFound = errors.New("Storage backend is not part of this repository")
+	ErrLastBackend     = errors.New("Can't remove the last storage backend of a repository")
+)
+
+// RemoveBackend removes the backend at location from the repository. Chunk
+// parts which are stored on no other backend get copied to the remaining
+// ones first, or rebuilt from the other parts of their chunk if the backend
+// is unreachable. The backend is kept if any chunk would get lost. The data
+// stored on it doesn't get deleted
+func (r *Repository) RemoveBackend(location string) (MigrateStats, error) {
+	stats := MigrateStats{}
+	k := -1
+	for i, l := range r.Backend.Locations() {
+		if l == location {
+			k = i
+			break
+		}
+	}
+	if k < 0 {
+		return stats, ErrBackendNotFound
+	}
+	if len(r.Backend.Backends) == 1 {
+		return stats, ErrLastBackend
+	}
+
+	remaining := r.Backend.without(k)
+	idx, err := newChunkIndex(&remaining)
+	if err != nil {
+		return stats, err
+	}
+	snapshots, chunks, err := r.snapshotChunks()
+	if err != nil {
+		return stats, err
+	}
+
+	// backends behind the departing one move up by one
+	remap := func(i int) int {
+		if i == k {
+			return -1
+		}
+		if i > k {
+			return i - 1
+		}
+		return i
+	}
+
+	records := make(map[string][]int)
+	for _, chunk := range chunks {
+		stats.Chunks++
+		record, err := r.evacuateChunk(idx, &remaining, k, chunk, remap, &stats)
+		if err != nil {
+			stats.Errors = append(stats.Errors, fmt.Errorf("chunk %s: %v", chunk.ShaSum, err))
+			continue
+		}
+		records[chunkKey(chunk)] = record
+	}
+	if len(stats.Errors) > 0 {
+		return stats, fmt.Errorf("%d chunks could not be moved off %s", len(stats.Errors), location)
+	}
+
+	r.Backend = remaining
+	err = r.saveRecords(snapshots, records)
+	if err != nil {
+		return stats, err
+	}
+	return stats, r.Save()
+}
+
+// evacuateChunk stores the parts of chunk which only the departing k-th
+// backend holds on the remaining backends. It returns which backend holds
+// each part, indexed like the remaining backends
+func (r *Repository) evacuateChunk(idx *chunkIndex, remaining *BackendManager, k int, chunk Chunk, remap func(int) int, stats *MigrateStats) ([]int, error) {
+	total := chunk.DataParts + chunk.ParityParts
+	if chunk.ParityParts == 0 {
+		total = 1
+	}
+	shardSize := (chunk.Size + int(chunk.DataParts) - 1) / int(chunk.DataParts)
+
+	record := make([]int, total)
+	avoid := idx.holders(chunk)
+	var pars [][]byte
+	for part := uint(0); part < total; part++ {
+		holders := idx.partHolders(chunk, part)
+		if len(holders) > 0 {
+			record[part] = preferredHolder(chunk, part, holders, remap)
+			continue
+		}
+
+		reconstructed := false
+		b, err := (*r.Backend.Backends[k]).LoadChunk(chunk.ShaSum, part, chunk.DataParts)
+		if err != nil || (chunk.ParityParts > 0 && len(*b) != shardSize) {
+			if chunk.ParityParts == 0 {
+				return nil, fmt.Errorf("part %d can't be loaded and there is no parity data to rebuild it: %v", part, err)
+			}
+			if pars == nil {
+				pars, err = reconstructChunk(*r, chunk)
+				if err != nil {
+					return nil, err
+				}
+			}
+			b = &pars[part]
+			reconstructed = true
+		}
+
+		record[part], err = remaining.StoreChunkPart(chunk, part, *b, avoid)
+		if err != nil {
+			return nil, err
+		}
+		if reconstructed {
+			stats.Reconstructed++
+		} else {
+			stats.Moved++
+		}
+	}
+
+	if remaining.Placement == PlacementMirror {
+		return nil, nil
+	}
+	return record, nil
+}
+
+// Rebalance evens out how many chunk parts each storage backend holds,
+// according to the placement policy and the backends' weights, e.g. after a
+// backend was added. With mirror placement, parts missing on a backend get
+// copied to it. Missing parts are left to Repair
+func (r *Repository) Rebalance() (MigrateStats, error) {
+	stats := MigrateStats{}
+	idx, err := newChunkIndex(&r.Backend)
+	if err != nil {
+		return stats, err
+	}
+	snapshots, chunks, err := r.snapshotChunks()
+	if err != nil {
+		return stats, err
+	}
+
+	// find out where all parts are stored
+	n := len(r.Backend.Backends)
+	holders := make([][][]int, len(chunks))
+	counts := make([]float64, n)
+	var total float64
+	for c, chunk := range chunks {
+		parts := chunk.DataParts + chunk.ParityParts
+		if chunk.ParityParts == 0 {
+			parts = 1
+		}
+		for part := uint(0); part < parts; part++ {
+			h := idx.partHolders(chunk, part)
+			holders[c] = append(holders[c], h)
+			for _, i := range h {
+				counts[i]++
+				total++
+			}
+		}
+	}
+
+	var weights float64
+	for i := 0; i < n; i++ {
+		weights += float64(r.Backend.weight(i))
+	}
+	target := make([]float64, n)
+	for i := range target {
+		target[i] = total * float64(r.Backend.weight(i)) / weights
+	}
+
+	identity := func(i int) int { return i }
+	records := make(map[string][]int)
+	for c, chunk := range chunks {
+		stats.Chunks++
+		if r.Backend.Placement == PlacementMirror {
+			r.mirrorChunk(chunk, holders[c], &stats)
+			records[chunkKey(chunk)] = nil
+			continue
+		}
+
+		// parts of a chunk stay on different backends
+		used := make(map[int]bool)
+		for _, h := range holders[c] {
+			for _, i := range h {
+				used[i] = true
+			}
+		}
+
+		record := make([]int, len(holders[c]))
+		for p, h := range holders[c] {
+			part := uint(p)
+			record[part] = preferredHolder(chunk, part, h, identity)
+			if len(h) != 1 {
+				// missing parts are Repair's job, extra copies are harmless
+				continue
+			}
+
+			src := h[0]
+			if counts[src]-1 < target[src] || !(*r.Backend.Backends[src]).Capabilities().Delete {
+				continue
+			}
+			dst := -1
+			for i := 0; i < n; i++ {
+				if used[i] || counts[i]+1 > target[i] {
+					continue
+				}
+				if dst < 0 || target[i]-counts[i] > target[dst]-counts[dst] {
+					dst = i
+				}
+			}
+			if dst < 0 {
+				continue
+			}
+
+			if err := r.movePart(chunk, part, src, dst); err != nil {
+				stats.Errors = append(stats.Errors, fmt.Errorf("chunk %s: %v", chunk.ShaSum, err))
+				continue
+			}
+			counts[src]--
+			counts[dst]++
+			used[dst] = true
+			record[part] = dst
+			stats.Moved++
+		}
+		records[chunkKey(chunk)] = record
+	}
+
+	return stats, r.saveRecords(snapshots, records)
+}
+
+// mirrorChunk copies the parts of chunk to all backends lacking them
+func (r *Repository) mirrorChunk(chunk Chunk, holders [][]int, stats *MigrateStats) {
+	for p, h := range holders {
+		if len(h) == 0 || len(h) == len(r.Backend.Backends) {
+			continue
+		}
+		part := uint(p)
+
+		b, err := (*r.Backend.Backends[h[0]]).LoadChunk(chunk.ShaSum, part, chunk.DataParts)
+		if err != nil {
+			stats.Errors = append(stats.Errors, fmt.Errorf("chunk %s: %v", chunk.ShaSum, err))
+			continue
+		}
+		held := make(map[int]bool)
+		for _, i := range h {
+			held[i] = true
+		}
+		for i, be := range r.Backend.Backends {
+			if held[i] {
+				continue
+			}
+			if _, err := (*be).StoreChunk(chunk.ShaSum, part, chunk.DataParts, b); err != nil {
+				stats.Errors = append(stats.Errors, fmt.Errorf("chunk %s: %v", chunk.ShaSum, err))
+				continue
+			}
+			stats.Moved++
+		}
+	}
+}
+
+// movePart copies a part of chunk from the src-th to the dst-th backend and
+// deletes it from src afterwards
+func (r *Repository) movePart(chunk Chunk, part uint, src, dst int) error {
+	b, err := (*r.Backend.Backends[src]).LoadChunk(chunk.ShaSum, part, chunk.DataParts)
+	if err != nil {
+		return err
+	}
+	if chunk.ParityParts > 0 && len(*b) != (chunk.Size+int(chunk.DataParts)-1)/int(chunk.DataParts) {
+		return fmt.Errorf("part %d is damaged, repair the repository first", part)
+	}
+
+	_, err = (*r.Backend.Backends[dst]).StoreChunk(chunk.ShaSum, part, chunk.DataParts, b)
+	if err != nil {
+		return err
+	}
+	return (*r.Backend.Backends[src]).DeleteChunk(chunk.ShaSum, part, chunk.DataParts)
+}
+
+// preferredHolder picks the backend to record for a part of chunk among the
+// backends holding it, preferring the one recorded so far. remap translates
+// the recorded backend index into the index space of holders
+func preferredHolder(chunk Chunk, part uint, holders []int, remap func(int) int) int {
+	if len(holders) == 0 {
+		return -1
+	}
+	if int(part) < len(chunk.Backends) {
+		recorded := remap(chunk.Backends[part])
+		for _, i := range holders {
+			if i == recorded {
+				return i
+			}
+		}
+	}
+
+	return holders[0]
+}
+
+// snapshotChunks returns all snapshots of the repository and the chunks they
+// reference, each chunk and part layout once
+func (r *Repository) snapshotChunks() ([]Snapshot, []Chunk, error) {
+	snapshots := []Snapshot{}
+	chunks := []Chunk{}
+	seen := make(map[string]bool)
+	for _, volume := range r.Volumes {
+		for _, id := range volume.Snapshots {
+			snapshot, err := volume.LoadSnapshot(id, r)
+			if err != nil {
+				return snapshots, chunks, err
+			}
+			snapshots = append(snapshots, snapshot)
+
+			for _, item := range snapshot.Items {
+				for _, chunk := range item.Chunks {
+					if !seen[chunkKey(chunk)] {
+						seen[chunkKey(chunk)] = true
+						chunks = append(chunks, chunk)
+					}
+				}
+			}
+		}
+	}
+
+	return snapshots, chunks, nil
+}
+
+// saveRecords updates which backend holds each part of the chunks in
+// snapshots and saves the snapshots which changed. records are keyed by
+// chunkKey
+func (r *Repository) saveRecords(snapshots []Snapshot, records map[string][]int) error {
+	for _, snapshot := range snapshots {
+		changed := false
+		for i := range snapshot.Items {
+			for j := range snapshot.Items[i].Chunks {
+				chunk := &snapshot.Items[i].Chunks[j]
+				record, ok := records[chunkKey(*chunk)]
+				if !ok || equalRecords(chunk.Backends, record) {
+					continue
+				}
+				chunk.Backends = record
+				changed = true
+			}
+		}
+
+		if changed {
+			if err := snapshot.Save(r); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// equalRecords returns true if a and b record the same backends
+func equalRecords(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
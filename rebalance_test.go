@@ -0,0 +1,246 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"fmt"
+	"testing"
+)
+
+// storeSmallChunks stores a snapshot split into many small chunks on the
+// in-memory backends name0 to name<n-1>
+func storeSmallChunks(t *testing.T, name string, n, dataParts, parityParts uint) (Repository, func()) {
+	opts := DefaultChunkerOptions
+	DefaultChunkerOptions = ChunkerOptions{MinSize: 256, AvgSize: 1024, MaxSize: 4096}
+	defer func() {
+		DefaultChunkerOptions = opts
+	}()
+
+	urls := []string{}
+	for i := uint(0); i < n; i++ {
+		urls = append(urls, fmt.Sprintf("mem://%s%d", name, i))
+	}
+	r := storeMemorySnapshot(t, urls, "rebalance.go", dataParts, parityParts)
+	return r, func() {
+		for i := uint(0); i < n; i++ {
+			RemoveStorageMemory(fmt.Sprintf("%s%d", name, i))
+		}
+	}
+}
+
+// snapshotChunkList returns the chunks of all snapshots, as often as they're
+// referenced
+func snapshotChunkList(t *testing.T, r Repository) []Chunk {
+	chunks := []Chunk{}
+	for _, volume := range r.Volumes {
+		for _, id := range volume.Snapshots {
+			snapshot, err := volume.LoadSnapshot(id, &r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, item := range snapshot.Items {
+				chunks = append(chunks, item.Chunks...)
+			}
+		}
+	}
+
+	return chunks
+}
+
+// verifyChunks loads all chunks of the repository and checks that their
+// recorded backends hold their parts
+func verifyChunks(t *testing.T, r Repository) {
+	chunks := snapshotChunkList(t, r)
+	idx, err := newChunkIndex(&r.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) < 2 {
+		t.Fatalf("Expected several chunks, got %d", len(chunks))
+	}
+
+	for _, chunk := range chunks {
+		if _, err := loadChunk(r, chunk); err != nil {
+			t.Errorf("Failed loading chunk %s: %v", chunk.ShaSum, err)
+		}
+		for part := uint(0); part < chunk.DataParts+chunk.ParityParts; part++ {
+			if len(idx.partHolders(chunk, part)) == 0 {
+				t.Errorf("Expected part %d of chunk %s (%d data parts) to be stored", part, chunk.ShaSum, chunk.DataParts)
+			}
+		}
+		for part, i := range chunk.Backends {
+			if i < 0 || i >= len(r.Backend.Backends) {
+				t.Errorf("Invalid backend %d recorded for chunk %s", i, chunk.ShaSum)
+				continue
+			}
+			if _, err := (*r.Backend.Backends[i]).StatChunk(chunk.ShaSum, uint(part), chunk.DataParts); err != nil {
+				t.Errorf("Expected part %d of chunk %s on backend %d: %v", part, chunk.ShaSum, i, err)
+			}
+		}
+	}
+}
+
+func TestRemoveBackend(t *testing.T) {
+	r, cleanup := storeSmallChunks(t, "remove", 3, 2, 1)
+	defer cleanup()
+
+	if _, err := r.RemoveBackend("mem://unknown"); err != ErrBackendNotFound {
+		t.Errorf("Expected %v, got %v", ErrBackendNotFound, err)
+	}
+
+	stats, err := r.RemoveBackend("mem://remove1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Chunks < 2 || stats.Moved != stats.Chunks || stats.Reconstructed != 0 {
+		t.Errorf("Expected a part of every chunk to be moved, got %+v", stats)
+	}
+	RemoveStorageMemory("remove1")
+
+	r, err = OpenRepository("mem://remove0", "this_is_a_password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Paths) != 2 || r.Paths[0] != "mem://remove0" || r.Paths[1] != "mem://remove2" {
+		t.Errorf("Unexpected backends %v", r.Paths)
+	}
+	verifyChunks(t, r)
+
+	if _, err := r.RemoveBackend("mem://remove2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.RemoveBackend("mem://remove0"); err != ErrLastBackend {
+		t.Errorf("Expected %v, got %v", ErrLastBackend, err)
+	}
+	verifyChunks(t, r)
+}
+
+func TestRemoveBackendLayouts(t *testing.T) {
+	r, cleanup := storeSmallChunks(t, "remove-layouts", 3, 2, 1)
+	defer cleanup()
+
+	// the same chunks stored with a second part layout
+	addMemorySnapshot(t, &r, "rebalance.go", 1, 1)
+
+	if _, err := r.RemoveBackend("mem://remove-layouts1"); err != nil {
+		t.Fatal(err)
+	}
+	RemoveStorageMemory("remove-layouts1")
+	verifyChunks(t, r)
+}
+
+func TestRemoveOfflineBackend(t *testing.T) {
+	opts := DefaultRetryOptions
+	defer func() {
+		DefaultRetryOptions = opts
+	}()
+	DefaultRetryOptions.Attempts = 1
+
+	r, cleanup := storeSmallChunks(t, "remove-offline", 3, 2, 1)
+	defer cleanup()
+
+	offline := func(r *Repository, k int) {
+		backends := r.Backend.Backends
+		r.Backend = BackendManager{}
+		for i := range backends {
+			backend := *backends[i]
+			if i == k {
+				backend = NewStorageFaulty(backend, FaultOptions{FailureRate: 1})
+			}
+			r.Backend.AddBackend(&backend)
+		}
+	}
+
+	// the parts stored on an unreachable backend get reconstructed
+	offline(&r, 2)
+	stats, err := r.RemoveBackend("mem://remove-offline2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Chunks < 2 || stats.Reconstructed != stats.Chunks || stats.Moved != 0 {
+		t.Errorf("Expected a part of every chunk to be reconstructed, got %+v", stats)
+	}
+	verifyChunks(t, r)
+
+	// without the parity to rebuild them, the parts would get lost
+	offline(&r, 1)
+	if _, err := r.RemoveBackend("mem://remove-offline1"); err == nil {
+		t.Error("Expected removing a backend holding unrecoverable data to fail")
+	}
+	if len(r.Backend.Backends) != 2 {
+		t.Errorf("Expected the backend to be kept, got %v", r.Backend.Locations())
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	r, cleanup := storeSmallChunks(t, "rebalance", 2, 1, 1)
+	defer cleanup()
+	defer RemoveStorageMemory("rebalance2")
+
+	backend, err := BackendFromURL("mem://rebalance2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Backend.AddBackend(&backend)
+	if err := r.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := r.Rebalance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Errors) > 0 {
+		t.Fatalf("Unexpected errors %v", stats.Errors)
+	}
+
+	counts := []int{}
+	total := 0
+	for i := 0; i < 3; i++ {
+		be, _ := BackendFromURL(fmt.Sprintf("mem://rebalance%d", i))
+		n := len(mustList(t, be))
+		counts = append(counts, n)
+		total += n
+	}
+	if total != int(stats.Chunks)*2 || stats.Moved == 0 {
+		t.Errorf("Unexpected stats %+v for %v parts", stats, counts)
+	}
+	for i, n := range counts {
+		if n < total/3-1 || n > total/3+1 {
+			t.Errorf("Expected about %d parts on backend %d, got %v", total/3, i, counts)
+		}
+	}
+	verifyChunks(t, r)
+
+	// a balanced repository stays as it is
+	stats, err = r.Rebalance()
+	if err != nil || stats.Moved != 0 {
+		t.Errorf("Expected nothing to be moved, got %+v (%v)", stats, err)
+	}
+}
+
+func TestRebalanceMirror(t *testing.T) {
+	r, cleanup := storeSmallChunks(t, "rebalance-mirror", 1, 1, 0)
+	defer cleanup()
+	defer RemoveStorageMemory("rebalance-mirror1")
+
+	backend, err := BackendFromURL("mem://rebalance-mirror1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Backend.AddBackend(&backend)
+	r.Backend.Placement = PlacementMirror
+
+	stats, err := r.Rebalance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Moved != stats.Chunks || len(mustList(t, backend)) != int(stats.Chunks) {
+		t.Errorf("Expected every chunk to be copied to the new backend, got %+v", stats)
+	}
+}
@@ -1,6 +1,11 @@
 package knoxite
 
-import "github.com/klauspost/reedsolomon"
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/klauspost/reedsolomon"
+)
 
 func redundantData(finalData []byte, chunks, redundancyChunks int) ([][]byte, error) {
 	enc, err := reedsolomon.New(chunks, redundancyChunks)
@@ -20,3 +25,74 @@ func redundantData(finalData []byte, chunks, redundancyChunks int) ([][]byte, er
 
 	return pardata, nil
 }
+
+// reconstructChunk loads all available parts of chunk and rebuilds the
+// missing and damaged ones. The result is verified against the chunk's shasum
+func reconstructChunk(repository Repository, chunk Chunk) ([][]byte, error) {
+	pars, _, err := rebuildChunk(repository, chunk)
+	return pars, err
+}
+
+// rebuildChunk loads all available parts of chunk and rebuilds the missing
+// ones. Damaged parts are found like loadChunk does, by leaving out parts
+// until the chunk can be decoded. It returns all parts of the chunk and the
+// parts which could be loaded, but are damaged
+func rebuildChunk(repository Repository, chunk Chunk) ([][]byte, []uint, error) {
+	enc, err := reedsolomon.New(int(chunk.DataParts), int(chunk.ParityParts))
+	if err != nil {
+		return [][]byte{}, nil, err
+	}
+	shardSize := (chunk.Size + int(chunk.DataParts) - 1) / int(chunk.DataParts)
+
+	loaded := make([][]byte, chunk.DataParts+chunk.ParityParts)
+	pars := make([][]byte, len(loaded))
+	parts := []uint{}
+	for i := range pars {
+		parts = append(parts, uint(i))
+	}
+
+	found := 0
+	results := repository.Backend.LoadChunkParts(chunk, parts, nil)
+	for range parts {
+		p := <-results
+		if p.Err != nil {
+			continue
+		}
+		loaded[p.Part] = p.Data
+		if len(p.Data) == shardSize {
+			pars[p.Part] = p.Data
+			found++
+		}
+	}
+	if found < int(chunk.DataParts) {
+		return pars, nil, fmt.Errorf("Could not reconstruct data, got %d out of %d chunks", found, chunk.DataParts)
+	}
+
+	shards, _, err := rebuildParts(repository, enc, chunk, pars)
+	for drop := 1; err != nil && drop <= found-int(chunk.DataParts); drop++ {
+		if rebuilt, _, ok := decodePartsWithout(repository, enc, chunk, pars, drop, 0); ok {
+			shards, err = rebuilt, nil
+		}
+	}
+	if err != nil {
+		return pars, nil, err
+	}
+
+	// parity parts which weren't needed to decode the chunk are unverified,
+	// so they get computed from the data parts again
+	for i := chunk.DataParts; i < uint(len(shards)); i++ {
+		shards[i] = make([]byte, shardSize)
+	}
+	err = enc.Encode(shards)
+	if err != nil {
+		return pars, nil, err
+	}
+
+	damaged := []uint{}
+	for i, b := range loaded {
+		if b != nil && !bytes.Equal(b, shards[i]) {
+			damaged = append(damaged, uint(i))
+		}
+	}
+	return shards, damaged, nil
+}
@@ -0,0 +1,133 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+// RepairStats contains the results of repairing a repository
+type RepairStats struct {
+	Chunks        uint64 // chunks checked
+	Healed        uint64 // chunks whose missing or damaged parts were restored
+	Parts         uint64 // parts restored
+	Unrecoverable uint64 // chunks with too many missing parts
+	Errors        []CheckError
+}
+
+// Repair looks for chunks with missing or damaged parts, rebuilds them from
+// the remaining parts and stores them on the storage backends again. Backends
+// which already hold a part of a chunk are avoided if possible, so the
+// repaired chunk survives the same number of backend failures as before
+func (r *Repository) Repair() (RepairStats, error) {
+	stats := RepairStats{}
+	idx, err := newChunkIndex(&r.Backend)
+	if err != nil {
+		return stats, err
+	}
+
+	snapshots := []Snapshot{}
+	records := make(map[string][]int)
+	checked := make(map[string]bool)
+	for _, volume := range r.Volumes {
+		for _, id := range volume.Snapshots {
+			snapshot, err := volume.LoadSnapshot(id, r)
+			if err != nil {
+				stats.Errors = append(stats.Errors, CheckError{Volume: volume.ID, Snapshot: id, Err: err})
+				continue
+			}
+			snapshots = append(snapshots, snapshot)
+
+			for _, item := range snapshot.Items {
+				for _, chunk := range item.Chunks {
+					if checked[chunkKey(chunk)] {
+						continue
+					}
+					checked[chunkKey(chunk)] = true
+					stats.Chunks++
+
+					parts, record, err := r.repairChunk(idx, chunk)
+					if err != nil {
+						stats.Unrecoverable++
+						stats.Errors = append(stats.Errors, CheckError{Volume: volume.ID, Snapshot: id, Path: item.Path, Err: err})
+						continue
+					}
+					if parts > 0 {
+						stats.Healed++
+						stats.Parts += uint64(parts)
+					}
+					if record != nil {
+						records[chunkKey(chunk)] = record
+					}
+				}
+			}
+		}
+	}
+
+	return stats, r.saveRecords(snapshots, records)
+}
+
+// repairChunk restores the missing and damaged parts of chunk. It returns
+// how many parts it stored and which backend holds each part of chunk, or nil
+// if that didn't change
+func (r *Repository) repairChunk(idx *chunkIndex, chunk Chunk) (int, []int, error) {
+	total := chunk.DataParts + chunk.ParityParts
+	if chunk.ParityParts == 0 {
+		total = 1
+	}
+	holders := make([][]int, total)
+	missing := []uint{}
+	for part := uint(0); part < total; part++ {
+		holders[part] = idx.partHolders(chunk, part)
+		if len(holders[part]) == 0 {
+			missing = append(missing, part)
+		}
+	}
+	if chunk.ParityParts == 0 {
+		if len(missing) > 0 {
+			// without parity data there's nothing to rebuild it from
+			return 0, nil, idx.checkChunk(chunk)
+		}
+		return 0, nil, nil
+	}
+
+	pars, damaged, err := rebuildChunk(*r, chunk)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(missing) == 0 && len(damaged) == 0 {
+		return 0, nil, nil
+	}
+
+	// backends don't overwrite parts they already store
+	for _, part := range damaged {
+		for _, i := range holders[part] {
+			be := *r.Backend.Backends[i]
+			if !be.Capabilities().Delete {
+				continue
+			}
+			if err := be.DeleteChunk(chunk.ShaSum, part, chunk.DataParts); err != nil {
+				return 0, nil, err
+			}
+		}
+	}
+
+	identity := func(i int) int { return i }
+	record := make([]int, total)
+	for part := range record {
+		record[part] = preferredHolder(chunk, uint(part), holders[part], identity)
+	}
+	avoid := idx.holders(chunk)
+	for _, part := range append(missing, damaged...) {
+		record[part], err = r.Backend.StoreChunkPart(chunk, part, pars[part], avoid)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	if r.Backend.Placement == PlacementMirror {
+		return len(missing) + len(damaged), nil, nil
+	}
+	return len(missing) + len(damaged), record, nil
+}
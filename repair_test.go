@@ -0,0 +1,205 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRepairRepository(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dirs := []string{}
+	for i := 0; i < 3; i++ {
+		dir, err := ioutil.TempDir("", "knoxite")
+		if err != nil {
+			t.Errorf("Failed creating temporary dir for repository: %s", err)
+			return
+		}
+		defer os.RemoveAll(dir)
+		dirs = append(dirs, dir)
+	}
+
+	r, err := NewRepository(dirs[0], testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	for _, dir := range dirs[1:] {
+		backend, err := BackendFromURL(dir)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		r.Backend.AddBackend(&backend)
+	}
+	vol, err := NewVolume("test_name", "test_description")
+	if err != nil {
+		t.Errorf("Failed creating volume: %s", err)
+		return
+	}
+	r.AddVolume(vol)
+	err = r.Save()
+	if err != nil {
+		t.Errorf("Failed saving repository: %s", err)
+		return
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Errorf("Failed getting working dir: %s", err)
+		return
+	}
+	snapshot, err := NewSnapshot("test_snapshot")
+	if err != nil {
+		t.Errorf("Failed creating snapshot: %s", err)
+		return
+	}
+	progress, err := snapshot.Add(wd, []string{"repair_test.go"}, r, false, true, 2, 1, nil, nil)
+	if err != nil {
+		t.Errorf("Failed adding to snapshot: %s", err)
+		return
+	}
+	for range progress {
+	}
+	snapshot.Save(&r)
+	vol.AddSnapshot(snapshot.ID)
+	r.Save()
+
+	// lose all data stored on one of the backends
+	err = os.RemoveAll(filepath.Join(dirs[1], "chunks"))
+	if err == nil {
+		err = os.Mkdir(filepath.Join(dirs[1], "chunks"), 0700)
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	stats, err := r.Repair()
+	if err != nil {
+		t.Errorf("Failed repairing repository: %s", err)
+		return
+	}
+	if stats.Healed != 1 || stats.Parts != 1 || stats.Unrecoverable != 0 {
+		t.Errorf("Expected 1 healed chunk, got %+v", stats)
+	}
+
+	// the repaired repository must survive losing another backend
+	err = os.RemoveAll(filepath.Join(dirs[2], "chunks"))
+	if err == nil {
+		err = os.Mkdir(filepath.Join(dirs[2], "chunks"), 0700)
+	}
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	cstats, err := r.Check(1.0)
+	if err != nil {
+		t.Errorf("Failed checking repository: %s", err)
+		return
+	}
+	if len(cstats.Errors) != 0 {
+		t.Errorf("Expected no errors after repair, got %v", cstats.Errors)
+	}
+}
+
+func TestRepairDamagedParts(t *testing.T) {
+	r, cleanup := storeSmallChunks(t, "repair-damaged", 4, 2, 1)
+	defer cleanup()
+
+	// parts which still have the right size can only be found by decoding
+	damaged := newTestStorageMemory(t, "mem://repair-damaged1")
+	names := mustList(t, damaged)
+	if len(names) == 0 {
+		t.Fatal("Expected parts to be stored on the damaged backend")
+	}
+	for _, name := range names {
+		shasum, part, total, _ := ParseChunkName(name)
+		b, err := damaged.LoadChunk(shasum, part, total)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := append([]byte{}, *b...)
+		data[0] ^= 0xff
+		damaged.SetRawChunk(name, data)
+	}
+
+	stats, err := r.Repair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Parts != uint64(len(names)) || stats.Healed != uint64(len(names)) || stats.Unrecoverable != 0 {
+		t.Errorf("Expected %d healed parts, got %+v", len(names), stats)
+	}
+
+	r, err = OpenRepository("mem://repair-damaged0", "this_is_a_password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifyChunks(t, r)
+	_, chunks, err := r.snapshotChunks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range chunks {
+		if _, parts, err := rebuildChunk(r, chunk); err != nil || len(parts) > 0 {
+			t.Errorf("Expected chunk %s to be intact, got damaged parts %v (%v)", chunk.ShaSum, parts, err)
+		}
+	}
+}
+
+func TestRepairLayouts(t *testing.T) {
+	r, cleanup := storeSmallChunks(t, "repair-layouts", 3, 2, 1)
+	defer cleanup()
+
+	// the same chunks stored with a second part layout
+	addMemorySnapshot(t, &r, "rebalance.go", 1, 1)
+
+	// lose a part of the second layout, and all parts of another chunk
+	chunks := []Chunk{}
+	for _, chunk := range snapshotChunkList(t, r) {
+		if chunk.DataParts == 1 {
+			chunks = append(chunks, chunk)
+		}
+	}
+	if len(chunks) < 2 {
+		t.Fatalf("Expected several chunks, got %d", len(chunks))
+	}
+	for _, be := range r.Backend.Backends {
+		(*be).DeleteChunk(chunks[0].ShaSum, 0, 1)
+		(*be).DeleteChunk(chunks[1].ShaSum, 0, 1)
+		(*be).DeleteChunk(chunks[1].ShaSum, 1, 1)
+	}
+
+	cstats, err := r.Check(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cstats.Errors) != 1 {
+		t.Errorf("Expected the lost chunk to be reported, got %v", cstats.Errors)
+	}
+
+	stats, err := r.Repair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Healed != 1 || stats.Unrecoverable != 1 {
+		t.Errorf("Expected one healed and one unrecoverable chunk, got %+v", stats)
+	}
+	idx, err := newChunkIndex(&r.Backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.partHolders(chunks[0], 0)) == 0 {
+		t.Error("Expected the missing part to be restored")
+	}
+}
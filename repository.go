@@ -8,6 +8,8 @@
 package knoxite
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 )
@@ -16,25 +18,60 @@ import (
 // MUST BE encrypted
 type Repository struct {
 	//	Owner   string    `json:"owner"`
-	Volumes []*Volume `json:"volumes"`
-	Paths   []string  `json:"storage"`
+	Volumes   []*Volume      `json:"volumes"`
+	Paths     []string       `json:"storage"`
+	Chunker   ChunkerOptions `json:"chunker"`
+	Placement Placement      `json:"placement,omitempty"`
+	Weights   []uint64       `json:"weights,omitempty"`
+	// set on repositories converted from older versions of knoxite, which
+	// may still contain snapshots encrypted with AES-CFB
+	LegacyEncryption bool `json:"legacy_encryption,omitempty"`
 
-	Backend  BackendManager `json:"-"`
-	Password string         `json:"-"`
+	Backend  BackendManager    `json:"-"`
+	Password string            `json:"-"`
+	Key      []byte            `json:"-"`
+	Header   *RepositoryHeader `json:"-"`
 
 	RawJSON []byte `json:"-"`
+
+	keyID string
+}
+
+// RepositoryHeader is stored unencrypted in front of a repository's metadata.
+// It contains the key slots, which allow to unlock the repository's master
+// key with a password. Repositories created by older versions of knoxite
+// either have no header at all or only a single KDF for the password
+type RepositoryHeader struct {
+	Version int        `json:"version"`
+	KDF     *KDFParams `json:"kdf,omitempty"`
+	Keys    []KeySlot  `json:"keys,omitempty"`
 }
 
+// A repository header starts with repoHeaderMagic, followed by the length of
+// its JSON encoding as a big-endian uint32 and the JSON encoding itself
+var repoHeaderMagic = []byte("KNOXREPO")
+
+const repoHeaderVersion = 2
+
 // Error declarations
 var (
-	ErrVolumeNotFound   = errors.New("Volume not found")
-	ErrSnapshotNotFound = errors.New("Snapshot not found")
+	ErrVolumeNotFound     = errors.New("Volume not found")
+	ErrSnapshotNotFound   = errors.New("Snapshot not found")
+	ErrInvalidRepoHeader  = errors.New("Invalid repository header")
+	ErrUnknownRepoVersion = errors.New("Repository was created by a newer version of knoxite")
 )
 
 // NewRepository returns a new repository
 func NewRepository(path, password string) (Repository, error) {
+	return NewRepositoryWithKDF(path, password, DefaultKDFParams)
+}
+
+// NewRepositoryWithKDF returns a new repository, whose key gets derived
+// from password with the given key derivation parameters
+func NewRepositoryWithKDF(path, password string, kdf KDFParams) (Repository, error) {
 	repository := Repository{
 		Password: password,
+		Chunker:  DefaultChunkerOptions,
 	}
 	backend, err := BackendFromURL(path)
 	if err != nil {
@@ -42,6 +79,19 @@ func NewRepository(path, password string) (Repository, error) {
 	}
 	repository.Backend.AddBackend(&backend)
 
+	repository.Key, err = newMasterKey()
+	if err != nil {
+		return repository, err
+	}
+	repository.Header = &RepositoryHeader{
+		Version: repoHeaderVersion,
+	}
+	slot, err := repository.AddKey(password, "", kdf)
+	if err != nil {
+		return repository, err
+	}
+	repository.keyID = slot.ID
+
 	err = repository.init()
 	return repository, err
 }
@@ -57,11 +107,29 @@ func OpenRepository(path, password string) (Repository, error) {
 	}
 
 	b, err := backend.LoadRepository()
+	if err != nil {
+		return repository, err
+	}
 
-	decb, err := Decrypt(b, password)
-	if err == nil {
-		err = json.Unmarshal(decb, &repository)
+	if len(password) == 0 {
+		return repository, ErrInvalidPassword
+	}
+	header, b, err := splitRepositoryHeader(b)
+	if err != nil {
+		return repository, err
+	}
+	repository.Header = header
+	err = repository.unlock(password)
+	if err != nil {
+		return repository, err
+	}
+
+	// only repositories without a header may contain legacy metadata
+	decb, err := decryptWithKey(b, repository.Key, header == nil)
+	if err != nil {
+		return repository, err
 	}
+	err = json.Unmarshal(decb, &repository)
 	repository.RawJSON = decb
 
 	for _, url := range repository.Paths {
@@ -71,6 +139,12 @@ func OpenRepository(path, password string) (Repository, error) {
 		}
 		repository.Backend.AddBackend(&backend)
 	}
+	placement, perr := ParsePlacement(string(repository.Placement))
+	if perr != nil {
+		return repository, perr
+	}
+	repository.Backend.Placement = placement
+	copy(repository.Backend.Weights, repository.Weights)
 
 	return repository, err
 }
@@ -114,9 +188,24 @@ func (r *Repository) init() error {
 	return err
 }
 
+// legacyEncryption returns true if the repository may contain data encrypted
+// by older versions of knoxite
+func (r *Repository) legacyEncryption() bool {
+	return r.Header == nil || r.LegacyEncryption
+}
+
 // Save writes a repository's metadata
 func (r *Repository) Save() error {
 	r.Paths = r.Backend.Locations()
+	r.Placement = r.Backend.Placement
+	r.Weights = nil
+	for _, w := range r.Backend.Weights {
+		if w != 1 {
+			// only store weights once they have been configured
+			r.Weights = r.Backend.Weights
+			break
+		}
+	}
 
 	//	b, err := json.MarshalIndent(*r, "", "    ")
 	b, err := json.Marshal(*r)
@@ -124,9 +213,62 @@ func (r *Repository) Save() error {
 		return err
 	}
 
-	encb, err := Encrypt(b, r.Password)
-	if err == nil {
-		err = r.Backend.SaveRepository(encb)
+	encb, err := encryptWithKey(b, r.Key)
+	if err != nil {
+		return err
 	}
-	return err
+	if r.Header != nil {
+		encb, err = joinRepositoryHeader(r.Header, encb)
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.Backend.SaveRepository(encb)
+}
+
+// splitRepositoryHeader separates the plaintext header from a repository's
+// encrypted metadata. The returned header is nil for repositories without one
+func splitRepositoryHeader(b []byte) (*RepositoryHeader, []byte, error) {
+	if !bytes.HasPrefix(b, repoHeaderMagic) {
+		return nil, b, nil
+	}
+
+	b = b[len(repoHeaderMagic):]
+	if len(b) < 4 {
+		return nil, b, ErrInvalidRepoHeader
+	}
+	size := binary.BigEndian.Uint32(b)
+	b = b[4:]
+	if uint64(len(b)) < uint64(size) {
+		return nil, b, ErrInvalidRepoHeader
+	}
+
+	header := RepositoryHeader{}
+	err := json.Unmarshal(b[:size], &header)
+	if err != nil {
+		return nil, b, ErrInvalidRepoHeader
+	}
+	if header.Version > repoHeaderVersion {
+		return nil, b, ErrUnknownRepoVersion
+	}
+
+	return &header, b[size:], nil
+}
+
+// joinRepositoryHeader prepends header to a repository's encrypted metadata
+func joinRepositoryHeader(header *RepositoryHeader, b []byte) ([]byte, error) {
+	hb, err := json.Marshal(header)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(hb)))
+
+	out := make([]byte, 0, len(repoHeaderMagic)+len(size)+len(hb)+len(b))
+	out = append(out, repoHeaderMagic...)
+	out = append(out, size...)
+	out = append(out, hb...)
+	return append(out, b...), nil
 }
@@ -10,6 +10,7 @@ package knoxite
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -44,3 +45,183 @@ func TestCreateRepositoryError(t *testing.T) {
 		t.Errorf("Expected %v, got %v", ErrInvalidRepositoryURL, err)
 	}
 }
+
+func TestOpenRepositoryWrongPassword(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	_, err = NewRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+
+	_, err = OpenRepository(dir, "wrong_password")
+	if err != ErrDecryptionFailed {
+		t.Errorf("Expected %v, got %v", ErrDecryptionFailed, err)
+	}
+}
+
+func TestRepositoryKDF(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	kdf := KDFParams{Algorithm: KDFScrypt, N: 1 << 10, R: 4, P: 2}
+	r, err := NewRepositoryWithKDF(dir, testPassword, kdf)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+	if len(r.Header.Keys) != 1 || len(r.Header.Keys[0].KDF.Salt) == 0 {
+		t.Error("Expected repository header to contain a salted key slot")
+		return
+	}
+
+	r2, err := OpenRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed opening repository: %s", err)
+		return
+	}
+	if r2.Header == nil || len(r2.Header.Keys) != 1 {
+		t.Errorf("Expected a single key slot, got %v", r2.Header)
+		return
+	}
+	if k := r2.Header.Keys[0].KDF; k.N != kdf.N || k.R != kdf.R || k.P != kdf.P {
+		t.Errorf("Expected KDF parameters %v, got %v", kdf, k)
+	}
+	if string(r.Key) != string(r2.Key) {
+		t.Error("Key mismatch after re-opening repository")
+	}
+
+	_, err = NewRepositoryWithKDF(dir+".invalid", testPassword, KDFParams{Algorithm: KDFScrypt, N: 1000})
+	if err != ErrInvalidKDFParams {
+		t.Errorf("Expected %v, got %v", ErrInvalidKDFParams, err)
+	}
+}
+
+func TestOpenLegacyRepository(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	// repositories created by older versions have no header and are
+	// encrypted with AES-CFB and the sha256 of their password
+	b := []byte(`{"volumes":[],"storage":["` + dir + `"]}`)
+	key := passwordKey(testPassword)
+	encb := make([]byte, len(b))
+	err = encryptAESCFB(encb, b, key, key[:16])
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, repoFilename), encb, 0600)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	r, err := OpenRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed opening repository: %s", err)
+		return
+	}
+	if r.Header != nil {
+		t.Error("Expected legacy repository to have no header")
+	}
+
+	// changing the password converts the repository to use key slots
+	err = r.ChangePassword("this_is_a_new_password")
+	if err != nil {
+		t.Errorf("Failed changing password: %s", err)
+		return
+	}
+	err = r.Save()
+	if err != nil {
+		t.Errorf("Failed saving repository: %s", err)
+		return
+	}
+	r, err = OpenRepository(dir, "this_is_a_new_password")
+	if err != nil {
+		t.Errorf("Failed opening repository: %s", err)
+		return
+	}
+	if string(r.Key) != string(key) {
+		t.Error("Master key changed along with the password")
+	}
+	if !r.LegacyEncryption {
+		t.Error("Expected converted repository to accept legacy snapshots")
+	}
+}
+
+func TestRejectUnauthenticatedData(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewRepositoryWithKDF(dir, testPassword, testKDFParams)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+
+	// data without the AES-GCM header is encrypted the way old versions did
+	legacy := func(b []byte) []byte {
+		encb := make([]byte, len(b))
+		if err := encryptAESCFB(encb, b, r.Key, r.Key[:16]); err != nil {
+			t.Fatal(err)
+		}
+		return encb
+	}
+
+	err = r.Backend.SaveSnapshot("forged", legacy([]byte(`{"id":"forged"}`)))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = openSnapshot("forged", &r)
+	if err != ErrUnknownEncryption {
+		t.Errorf("Expected %v, got %v", ErrUnknownEncryption, err)
+	}
+	r.LegacyEncryption = true
+	s, err := openSnapshot("forged", &r)
+	if err != nil || s.ID != "forged" {
+		t.Errorf("Failed opening legacy snapshot: %v", err)
+	}
+
+	b, err := joinRepositoryHeader(r.Header, legacy([]byte(`{"volumes":[]}`)))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	err = r.Backend.SaveRepository(b)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = OpenRepository(dir, testPassword)
+	if err != ErrUnknownEncryption {
+		t.Errorf("Expected %v, got %v", ErrUnknownEncryption, err)
+	}
+}
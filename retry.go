@@ -0,0 +1,211 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"math/rand"
+	"net/textproto"
+	"os"
+	"time"
+
+	"github.com/minio/minio-go"
+)
+
+// RetryOptions configure how often and how fast failed storage operations
+// get retried
+type RetryOptions struct {
+	Attempts   int           // total number of attempts, 1 disables retrying
+	Backoff    time.Duration // delay before the first retry, doubled for every further one
+	MaxBackoff time.Duration // upper limit for the delay between two attempts
+	Jitter     float64       // randomizes each delay by up to this fraction
+}
+
+// DefaultRetryOptions are used for all backends added to a BackendManager
+var DefaultRetryOptions = RetryOptions{
+	Attempts:   5,
+	Backoff:    500 * time.Millisecond,
+	MaxBackoff: 30 * time.Second,
+	Jitter:     0.2,
+}
+
+// RetryBackend wraps a Backend and retries operations failing with a
+// transient error, waiting exponentially longer between attempts
+type RetryBackend struct {
+	Backend
+	Options RetryOptions
+
+	sleep func(time.Duration)
+}
+
+// NewRetryBackend returns a RetryBackend wrapping backend
+func NewRetryBackend(backend Backend, opts RetryOptions) *RetryBackend {
+	return &RetryBackend{
+		Backend: backend,
+		Options: opts,
+		sleep:   time.Sleep,
+	}
+}
+
+// AvailableSpace returns the free and the total space of the wrapped backend
+func (backend *RetryBackend) AvailableSpace() (free, total uint64, err error) {
+	err = backend.retry(func() error {
+		free, total, err = BackendSpace(backend.Backend)
+		return err
+	})
+	return free, total, err
+}
+
+// LoadChunk loads a Chunk
+func (backend *RetryBackend) LoadChunk(shasum string, part, totalParts uint) (b *[]byte, err error) {
+	err = backend.retry(func() error {
+		b, err = backend.Backend.LoadChunk(shasum, part, totalParts)
+		return err
+	})
+	return b, err
+}
+
+// StoreChunk stores a single Chunk
+func (backend *RetryBackend) StoreChunk(shasum string, part, totalParts uint, data *[]byte) (size uint64, err error) {
+	err = backend.retry(func() error {
+		size, err = backend.Backend.StoreChunk(shasum, part, totalParts, data)
+		return err
+	})
+	return size, err
+}
+
+// StatChunk returns the size of a stored Chunk
+func (backend *RetryBackend) StatChunk(shasum string, part, totalParts uint) (size uint64, err error) {
+	err = backend.retry(func() error {
+		size, err = backend.Backend.StatChunk(shasum, part, totalParts)
+		return err
+	})
+	return size, err
+}
+
+// ListChunks returns the names of all stored chunk parts
+func (backend *RetryBackend) ListChunks() (names []string, err error) {
+	err = backend.retry(func() error {
+		names, err = backend.Backend.ListChunks()
+		return err
+	})
+	return names, err
+}
+
+// DeleteChunk deletes a single Chunk
+func (backend *RetryBackend) DeleteChunk(shasum string, part, totalParts uint) error {
+	return backend.retry(func() error {
+		return backend.Backend.DeleteChunk(shasum, part, totalParts)
+	})
+}
+
+// LoadSnapshot loads a snapshot
+func (backend *RetryBackend) LoadSnapshot(id string) (b []byte, err error) {
+	err = backend.retry(func() error {
+		b, err = backend.Backend.LoadSnapshot(id)
+		return err
+	})
+	return b, err
+}
+
+// SaveSnapshot stores a snapshot
+func (backend *RetryBackend) SaveSnapshot(id string, data []byte) error {
+	return backend.retry(func() error {
+		return backend.Backend.SaveSnapshot(id, data)
+	})
+}
+
+// ListSnapshots returns the IDs of all stored snapshots
+func (backend *RetryBackend) ListSnapshots() (ids []string, err error) {
+	err = backend.retry(func() error {
+		ids, err = backend.Backend.ListSnapshots()
+		return err
+	})
+	return ids, err
+}
+
+// DeleteSnapshot deletes a snapshot
+func (backend *RetryBackend) DeleteSnapshot(id string) error {
+	return backend.retry(func() error {
+		return backend.Backend.DeleteSnapshot(id)
+	})
+}
+
+// InitRepository creates a new repository
+func (backend *RetryBackend) InitRepository() error {
+	return backend.retry(backend.Backend.InitRepository)
+}
+
+// LoadRepository reads the metadata for a repository
+func (backend *RetryBackend) LoadRepository() (b []byte, err error) {
+	err = backend.retry(func() error {
+		b, err = backend.Backend.LoadRepository()
+		return err
+	})
+	return b, err
+}
+
+// SaveRepository stores the metadata for a repository
+func (backend *RetryBackend) SaveRepository(data []byte) error {
+	return backend.retry(func() error {
+		return backend.Backend.SaveRepository(data)
+	})
+}
+
+// retry runs op until it succeeds, fails permanently or runs out of attempts
+func (backend *RetryBackend) retry(op func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || isPermanentError(err) || attempt >= backend.Options.Attempts {
+			return err
+		}
+
+		backend.sleep(backend.delay(attempt))
+	}
+}
+
+// delay returns how long to wait after the given failed attempt
+func (backend *RetryBackend) delay(attempt int) time.Duration {
+	d := backend.Options.Backoff
+	for i := 1; i < attempt && (backend.Options.MaxBackoff <= 0 || d < backend.Options.MaxBackoff); i++ {
+		d *= 2
+	}
+	if backend.Options.MaxBackoff > 0 && d > backend.Options.MaxBackoff {
+		d = backend.Options.MaxBackoff
+	}
+
+	if backend.Options.Jitter > 0 {
+		d += time.Duration(float64(d) * backend.Options.Jitter * (2*rand.Float64() - 1))
+	}
+	return d
+}
+
+// isPermanentError returns true for errors which won't go away by retrying,
+// like missing data or denied access
+func isPermanentError(err error) bool {
+	switch err {
+	case ErrChunkNotFound, ErrSnapshotNotFound, ErrLoadRepositoryFailed,
+		ErrRepositoryExists, ErrNotSupported, ErrAccessDenied,
+		ErrInvalidRepositoryURL, ErrInvalidChunkName,
+		ErrInvalidUsername, ErrInvalidPassword, ErrStorageFull:
+		return true
+	}
+	if os.IsNotExist(err) || os.IsExist(err) || os.IsPermission(err) {
+		return true
+	}
+
+	switch e := err.(type) {
+	case minio.ErrorResponse:
+		// client errors, except for timeouts and throttling
+		return e.StatusCode >= 400 && e.StatusCode < 500 &&
+			e.StatusCode != 408 && e.StatusCode != 429
+	case *textproto.Error:
+		// FTP distinguishes transient (4xx) and permanent (5xx) replies
+		return e.Code >= 500
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go"
+)
+
+var errTransient = errors.New("Internal server error")
+
+// flakyBackend fails the next failures operations with err
+type flakyBackend struct {
+	*StorageLocal
+
+	failures int
+	err      error
+	calls    int
+}
+
+func (backend *flakyBackend) fail() error {
+	backend.calls++
+	if backend.failures > 0 {
+		backend.failures--
+		return backend.err
+	}
+	return nil
+}
+
+func (backend *flakyBackend) StoreChunk(shasum string, part, totalParts uint, data *[]byte) (uint64, error) {
+	if err := backend.fail(); err != nil {
+		return 0, err
+	}
+	return backend.StorageLocal.StoreChunk(shasum, part, totalParts, data)
+}
+
+func (backend *flakyBackend) LoadChunk(shasum string, part, totalParts uint) (*[]byte, error) {
+	if err := backend.fail(); err != nil {
+		return &[]byte{}, err
+	}
+	return backend.StorageLocal.LoadChunk(shasum, part, totalParts)
+}
+
+func newFlakyBackend(t *testing.T, failures int, err error) (*flakyBackend, func()) {
+	dir, derr := ioutil.TempDir("", "knoxite")
+	if derr != nil {
+		t.Fatal(derr)
+	}
+	local := &StorageLocal{Path: dir}
+	if derr := local.SaveRepository([]byte("repository")); derr != nil {
+		t.Fatal(derr)
+	}
+
+	return &flakyBackend{StorageLocal: local, failures: failures, err: err}, func() {
+		os.RemoveAll(dir)
+	}
+}
+
+func TestRetryBackend(t *testing.T) {
+	opts := RetryOptions{Attempts: 4, Backoff: time.Second, MaxBackoff: 3 * time.Second}
+	tests := []struct {
+		failures int
+		err      error
+		calls    int
+		delays   []time.Duration
+		fails    bool
+	}{
+		{0, errTransient, 1, nil, false},
+		{2, errTransient, 3, []time.Duration{time.Second, 2 * time.Second}, false},
+		{10, errTransient, 4, []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}, true},
+		{1, ErrAccessDenied, 1, nil, true},
+		{1, minio.ErrorResponse{Code: "AccessDenied", StatusCode: 403}, 1, nil, true},
+		{1, minio.ErrorResponse{Code: "InternalError", StatusCode: 500}, 2, []time.Duration{time.Second}, false},
+		{1, minio.ErrorResponse{Code: "SlowDown", StatusCode: 429}, 2, []time.Duration{time.Second}, false},
+	}
+
+	for i, test := range tests {
+		flaky, cleanup := newFlakyBackend(t, test.failures, test.err)
+		delays := []time.Duration{}
+		backend := NewRetryBackend(flaky, opts)
+		backend.sleep = func(d time.Duration) {
+			delays = append(delays, d)
+		}
+
+		data := []byte("chunk")
+		_, err := backend.StoreChunk("abc", 0, 1, &data)
+		if (err != nil) != test.fails {
+			t.Errorf("Test %d: unexpected error %v", i, err)
+		}
+		if flaky.calls != test.calls {
+			t.Errorf("Test %d: expected %d calls, got %d", i, test.calls, flaky.calls)
+		}
+		if len(delays) != len(test.delays) {
+			t.Errorf("Test %d: expected delays %v, got %v", i, test.delays, delays)
+		} else {
+			for j := range delays {
+				if delays[j] != test.delays[j] {
+					t.Errorf("Test %d: expected delays %v, got %v", i, test.delays, delays)
+					break
+				}
+			}
+		}
+		cleanup()
+	}
+}
+
+func TestRetryBackendNotFound(t *testing.T) {
+	flaky, cleanup := newFlakyBackend(t, 0, nil)
+	defer cleanup()
+	backend := NewRetryBackend(flaky, RetryOptions{Attempts: 5})
+	backend.sleep = func(time.Duration) {
+		t.Error("Missing chunks should not be retried")
+	}
+
+	if _, err := backend.LoadChunk("missing", 0, 1); !os.IsNotExist(err) {
+		t.Errorf("Expected chunk to be missing, got %v", err)
+	}
+	if flaky.calls != 1 {
+		t.Errorf("Expected a single call, got %d", flaky.calls)
+	}
+}
+
+func TestRetryBackendJitter(t *testing.T) {
+	backend := NewRetryBackend(&StorageLocal{}, RetryOptions{Backoff: time.Second, Jitter: 0.5})
+	for i := 0; i < 100; i++ {
+		d := backend.delay(2)
+		if d < time.Second || d > 3*time.Second {
+			t.Fatalf("Delay %v out of jitter range", d)
+		}
+	}
+}
+
+func TestBackendManagerRetries(t *testing.T) {
+	flaky, cleanup := newFlakyBackend(t, 2, errTransient)
+	defer cleanup()
+
+	opts := DefaultRetryOptions
+	defer func() {
+		DefaultRetryOptions = opts
+	}()
+	DefaultRetryOptions = RetryOptions{Attempts: 3, Backoff: time.Millisecond}
+
+	var be Backend = flaky
+	manager := BackendManager{}
+	manager.AddBackend(&be)
+
+	chunk := Chunk{ShaSum: "abc", DataParts: 1, Size: 5, Data: &[][]byte{[]byte("chunk")}}
+	if _, err := manager.StoreChunk(&chunk); err != nil {
+		t.Fatal(err)
+	}
+	b, err := manager.LoadChunk(chunk, 0)
+	if err != nil || string(b) != "chunk" {
+		t.Errorf("Expected chunk data, got %s (%v)", b, err)
+	}
+	if flaky.calls != 4 {
+		t.Errorf("Expected 4 calls, got %d", flaky.calls)
+	}
+
+	// disabling retries keeps the backend unwrapped
+	DefaultRetryOptions.Attempts = 1
+	manager.AddBackend(&be)
+	if _, ok := (*manager.Backends[1]).(*RetryBackend); ok {
+		t.Error("Expected backend not to be wrapped")
+	}
+}
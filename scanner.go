@@ -33,35 +33,46 @@ type ItemData struct {
 	StorageSize uint64      `json:"storagesize"`        // size in storage
 	UID         uint32      `json:"uid"`                // owner
 	GID         uint32      `json:"gid"`                // group
+	Inode       uint64      `json:"inode,omitempty"`    // inode number
 	Chunks      []Chunk     `json:"chunks,omitempty"`
 	AbsPath     string      `json:"-"`
 	FileInfo    os.FileInfo `json:"-"`
 }
 
-func findFiles(rootPath string) chan ItemData {
+func findFiles(rootPath string, filter *Filter) chan ItemData {
 	c := make(chan ItemData)
 	go func() {
-		filepath.Walk(rootPath, func(path string, fi os.FileInfo, _ error) (err error) {
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "error for %v: %v\n", path, err)
+		var rootDev uint64
+		filepath.Walk(rootPath, func(path string, fi os.FileInfo, werr error) (err error) {
+			if werr != nil {
+				// files and directories which can't be read get skipped.
+				// fi is nil if path itself couldn't be accessed
+				fmt.Fprintf(os.Stderr, "error for %v: %v\n", path, werr)
 				return nil
 			}
-			if fi == nil {
-				fmt.Fprintf(os.Stderr, "error for %v: FileInfo is nil\n", path)
-				return nil
+
+			statT, ok := toStatT(fi.Sys())
+			if !ok {
+				return fmt.Errorf("error reading metadata for: %s", path)
 			}
 
-			/*		if !filter(str, fi) {
-					debug.Log("Scan.Walk", "path %v excluded", str)
+			if filter != nil {
+				if path == rootPath {
+					rootDev = statT.dev()
+				}
+				if (filter.OneFileSystem && statT.dev() != rootDev) || filter.excluded(rootPath, path, fi) {
+					// excluded directories aren't descended into, so
+					// nothing below them can be included again
 					if fi.IsDir() {
 						return filepath.SkipDir
 					}
 					return nil
-				}*/
-
-			statT, ok := toStatT(fi.Sys())
-			if !ok {
-				return fmt.Errorf("error reading metadata for: %s", path)
+				}
+				if fi.IsDir() {
+					if err := filter.loadIgnoreFile(path); err != nil {
+						fmt.Fprintf(os.Stderr, "error reading ignore file in %v: %v\n", path, err)
+					}
+				}
 			}
 			id := ItemData{
 				Path:     path,
@@ -70,6 +81,7 @@ func findFiles(rootPath string) chan ItemData {
 				ModTime:  fi.ModTime(),
 				UID:      statT.uid(),
 				GID:      statT.gid(),
+				Inode:    statT.ino(),
 				FileInfo: fi,
 			}
 			if isSymLink(fi) {
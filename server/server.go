@@ -1,17 +1,20 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
-const storagePath = "/tmp/knoxite.storage"
+var storagePath = "/tmp/knoxite.storage"
 
 func authPath(w http.ResponseWriter, r *http.Request) (string, error) {
 	auth, _, ok := r.BasicAuth()
@@ -86,11 +89,20 @@ func download(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if r.Method == "GET" {
+	switch r.Method {
+	case "GET", "HEAD":
 		http.ServeFile(w, r, filepath.Join(path, "chunks", r.URL.Path[10:]))
+	case "DELETE":
+		deleteFile(w, filepath.Join(path, "chunks", r.URL.Path[10:]))
 	}
 }
 
+// listChunks logic
+func listChunks(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Listing chunks")
+	listFiles(w, r, "chunks")
+}
+
 // uploadRepo logic
 func uploadRepo(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("Receiving repository")
@@ -185,15 +197,115 @@ func downloadSnapshot(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	http.ServeFile(w, r, filepath.Join(path, "snapshots", r.URL.Path[10:]))
+	switch r.Method {
+	case "GET", "HEAD":
+		http.ServeFile(w, r, filepath.Join(path, "snapshots", r.URL.Path[10:]))
+	case "DELETE":
+		deleteFile(w, filepath.Join(path, "snapshots", r.URL.Path[10:]))
+	}
+}
+
+// listSnapshots logic
+func listSnapshots(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Listing snapshots")
+	listFiles(w, r, "snapshots")
+}
+
+func listFiles(w http.ResponseWriter, r *http.Request, dir string) {
+	path, err := authPath(w, r)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return
+	}
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(path, dir))
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	names := []string{}
+	for _, fi := range files {
+		if !fi.IsDir() {
+			names = append(names, fi.Name())
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(names)
+}
+
+// space logic: reports the user's quota, which is configured by putting the
+// number of bytes into a file called "quota" in the user's directory
+func space(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Reporting space")
+
+	path, err := authPath(w, r)
+	if err != nil {
+		fmt.Println("ERROR:", err)
+		return
+	}
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	q, err := ioutil.ReadFile(filepath.Join(path, "quota"))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	quota, err := strconv.ParseUint(strings.TrimSpace(string(q)), 10, 64)
+	if err != nil {
+		fmt.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var used uint64
+	filepath.Walk(path, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			used += uint64(fi.Size())
+		}
+		return nil
+	})
+	free := uint64(0)
+	if used < quota {
+		free = quota - used
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]uint64{"free": free, "total": quota})
+}
+
+func deleteFile(w http.ResponseWriter, fileName string) {
+	err := os.Remove(fileName)
+	if err != nil {
+		fmt.Println(err)
+		if os.IsNotExist(err) {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	fmt.Println("Deleted", fileName)
 }
 
 func main() {
 	http.HandleFunc("/upload", upload)
 	http.HandleFunc("/download/", download)
+	http.HandleFunc("/chunks", listChunks)
 	http.HandleFunc("/repository", repository)
 	http.HandleFunc("/snapshot", uploadSnapshot)
 	http.HandleFunc("/snapshot/", downloadSnapshot)
+	http.HandleFunc("/snapshots", listSnapshots)
+	http.HandleFunc("/space", space)
 	err := http.ListenAndServe(":42024", nil) // setting listening port
 	if err != nil {
 		log.Fatal("ListenAndServe:", err)
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/knoxite/knoxite"
+)
+
+func TestSpace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storagePath = dir
+
+	user := filepath.Join(dir, "user")
+	if err := os.Mkdir(user, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(user, "quota"), []byte("1000\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(user, "chunk"), make([]byte, 95), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/space", space)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	// the user gets authenticated with the URL's user info
+	backend, err := knoxite.BackendFromURL(strings.Replace(server.URL, "http://", "http://user@", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	free, total, err := knoxite.BackendSpace(backend)
+	if err != nil || free != 900 || total != 1000 {
+		t.Errorf("Expected 900 of 1000 bytes free, got %d of %d (%v)", free, total, err)
+	}
+
+	backend, err = knoxite.BackendFromURL(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := knoxite.BackendSpace(backend); err == nil {
+		t.Error("Expected querying space without credentials to fail")
+	}
+}
@@ -9,6 +9,7 @@ package knoxite
 
 import (
 	"encoding/json"
+	"fmt"
 	"math"
 	"path/filepath"
 	"strings"
@@ -44,16 +45,32 @@ func NewSnapshot(description string) (Snapshot, error) {
 	return snapshot, nil
 }
 
-// Add adds a path to a Snapshot
-func (snapshot *Snapshot) Add(cwd string, paths []string, repository Repository, compress, encrypt bool, dataParts, parityParts uint) (chan Progress, error) {
+// Add adds a path to a Snapshot. If parent is not nil, files which didn't
+// change since the parent snapshot was taken re-use its chunks instead of
+// being read and stored again. If filter is not nil, only files passing it
+// get added
+func (snapshot *Snapshot) Add(cwd string, paths []string, repository Repository, compress, encrypt bool, dataParts, parityParts uint, parent *Snapshot, filter *Filter) (chan Progress, error) {
+	if filter != nil {
+		if err := filter.compile(); err != nil {
+			return nil, err
+		}
+	}
+
 	progress := make(chan Progress)
 	fwd := make(chan ItemData, 256) // TODO: reconsider buffer size
 	m := new(sync.Mutex)
 	var totalSize uint64
 
+	parentItems := make(map[string]ItemData)
+	if parent != nil {
+		for _, item := range parent.Items {
+			parentItems[item.Path] = item
+		}
+	}
+
 	go func() {
 		for _, path := range paths {
-			c := findFiles(path)
+			c := findFiles(path, filter)
 
 			for id := range c {
 				rel, err := filepath.Rel(cwd, id.Path)
@@ -72,7 +89,22 @@ func (snapshot *Snapshot) Add(cwd string, paths []string, repository Repository,
 		close(fwd)
 	}()
 
+	// fail reports err and discards the pending files and chunks, so the
+	// goroutines producing them can finish
+	fail := func(err error, chunks chan Chunk) {
+		progress <- Progress{Error: err}
+		go func() {
+			if chunks != nil {
+				for range chunks {
+				}
+			}
+			for range fwd {
+			}
+		}()
+	}
+
 	go func() {
+		defer close(progress)
 		var totalTransferredSize uint64
 		for id := range fwd {
 			rel, err := filepath.Rel(cwd, id.Path)
@@ -90,19 +122,33 @@ func (snapshot *Snapshot) Add(cwd string, paths []string, repository Repository,
 			m.Unlock()
 			progress <- p
 
-			if isRegularFile(id.FileInfo) {
+			if pid, ok := parentItems[id.Path]; ok && isRegularFile(id.FileInfo) && isUnchanged(id, pid) &&
+				chunksMatch(pid.Chunks, compress, encrypt, dataParts, parityParts) {
+				id.Chunks = pid.Chunks
+				id.StorageSize = pid.StorageSize
+				totalTransferredSize += pid.StorageSize
+
+				p := newProgress(&id)
+				m.Lock()
+				p.Statistics.Size = totalSize
+				p.Statistics.StorageSize = totalTransferredSize
+				m.Unlock()
+				progress <- p
+			} else if isRegularFile(id.FileInfo) {
 				dataParts = uint(math.Max(1, float64(dataParts)))
-				chunkchan, err := chunkFile(id.AbsPath, compress, encrypt, repository.Password, int(dataParts), int(parityParts))
+				chunkchan, err := chunkFile(id.AbsPath, compress, encrypt, repository.Key, int(dataParts), int(parityParts), repository.Chunker)
 				if err != nil {
-					panic(err)
+					fail(err, nil)
+					return
 				}
 				for cd := range chunkchan {
 					// fmt.Printf("\tSplit %s (#%d, %d bytes), compression: %s, encryption: %s, sha256: %s\n", id.Path, cd.Num, cd.Size, CompressionText(cd.Compressed), EncryptionText(cd.Encrypted), cd.ShaSum)
 
 					// store this chunk
-					n, err := repository.Backend.StoreChunk(cd)
+					n, err := repository.Backend.StoreChunk(&cd)
 					if err != nil {
-						panic(err)
+						fail(fmt.Errorf("storing %s failed: %v", id.Path, err), chunkchan)
+						return
 					}
 
 					// release the memory, we don't need the data anymore
@@ -123,11 +169,47 @@ func (snapshot *Snapshot) Add(cwd string, paths []string, repository Repository,
 
 			snapshot.AddItem(&id)
 		}
-		close(progress)
 	}()
 	return progress, nil
 }
 
+// isUnchanged returns true if item seems to be identical to its counterpart
+// in a parent snapshot
+func isUnchanged(item, parent ItemData) bool {
+	return parent.Type == File &&
+		item.Path == parent.Path &&
+		item.Size == parent.Size &&
+		item.ModTime.Equal(parent.ModTime) &&
+		item.Inode == parent.Inode &&
+		(item.Size == 0 || len(parent.Chunks) > 0)
+}
+
+// chunksMatch returns true if chunks were stored with the given settings.
+// Files stored differently get stored again, so e.g. raising the failure
+// tolerance also applies to unchanged files
+func chunksMatch(chunks []Chunk, compress, encrypt bool, dataParts, parityParts uint) bool {
+	compressed := CompressionNone
+	if compress {
+		compressed = CompressionGZip
+	}
+	encrypted := EncryptionNone
+	if encrypt {
+		encrypted = EncryptionAESGCM
+	}
+	if parityParts == 0 {
+		// without parity, chunks consist of a single part
+		dataParts = 1
+	}
+
+	for _, chunk := range chunks {
+		if chunk.DataParts != dataParts || chunk.ParityParts != parityParts ||
+			chunk.Compressed != compressed || chunk.Encrypted != encrypted {
+			return false
+		}
+	}
+	return true
+}
+
 // Clone clones a snapshot
 func (snapshot *Snapshot) Clone() (*Snapshot, error) {
 	s, err := NewSnapshot(snapshot.Description)
@@ -146,7 +228,11 @@ func openSnapshot(id string, repository *Repository) (Snapshot, error) {
 	snapshot := Snapshot{}
 	b, err := repository.Backend.LoadSnapshot(id)
 
-	decb, err := Decrypt(b, repository.Password)
+	if err != nil {
+		return snapshot, err
+	}
+
+	decb, err := decryptWithKey(b, repository.Key, repository.legacyEncryption())
 	if err == nil {
 		err = json.Unmarshal(decb, &snapshot)
 	}
@@ -162,7 +248,7 @@ func (snapshot *Snapshot) Save(repository *Repository) error {
 	}
 	//	fmt.Printf("Repository created: %s\n", string(b))
 
-	encb, err := Encrypt(b, repository.Password)
+	encb, err := encryptWithKey(b, repository.Key)
 	if err == nil {
 		err = repository.Backend.SaveSnapshot(snapshot.ID, encb)
 	}
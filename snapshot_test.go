@@ -65,7 +65,7 @@ func TestCreateSnapshot(t *testing.T) {
 			t.Errorf("Failed getting working dir: %s", err)
 			return
 		}
-		progress, err := snapshot.Add(wd, []string{"snapshot_test.go"}, r, false, true, 1, 0)
+		progress, err := snapshot.Add(wd, []string{"snapshot_test.go"}, r, false, true, 1, 0, nil, nil)
 		if err != nil {
 			t.Errorf("Failed adding to snapshot: %s", err)
 		}
@@ -182,3 +182,152 @@ func TestFindUnknownSnapshot(t *testing.T) {
 		t.Errorf("Expected %v, got %v", ErrSnapshotNotFound, err)
 	}
 }
+
+func TestSnapshotStoreError(t *testing.T) {
+	opts := DefaultRetryOptions
+	defer func() {
+		DefaultRetryOptions = opts
+	}()
+	DefaultRetryOptions.Attempts = 1
+
+	defer RemoveStorageMemory("store-error")
+	r, err := NewRepository("mem://store-error", "this_is_a_password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := *r.Backend.Backends[0]
+	r.Backend = BackendManager{}
+	backend = NewStorageFaulty(backend, FaultOptions{FailureRate: 1})
+	r.Backend.AddBackend(&backend)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := NewSnapshot("test_snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress, err := snapshot.Add(wd, []string{"snapshot.go", "snapshot_test.go"}, r, false, true, 1, 0, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failed error
+	for p := range progress {
+		if p.Error != nil {
+			failed = p.Error
+		}
+	}
+	if failed == nil {
+		t.Error("Expected storing to fail")
+	}
+}
+
+func TestIncrementalSnapshot(t *testing.T) {
+	testPassword := "this_is_a_password"
+
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for repository: %s", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	srcdir, err := ioutil.TempDir("", "knoxite.src")
+	if err != nil {
+		t.Errorf("Failed creating temporary dir for source: %s", err)
+		return
+	}
+	defer os.RemoveAll(srcdir)
+
+	file := filepath.Join(srcdir, "data")
+	err = ioutil.WriteFile(file, []byte("original content"), 0600)
+	if err != nil {
+		t.Errorf("Failed writing source file: %s", err)
+		return
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Errorf("Failed reading source file: %s", err)
+		return
+	}
+
+	r, err := NewRepository(dir, testPassword)
+	if err != nil {
+		t.Errorf("Failed creating repository: %s", err)
+		return
+	}
+
+	parent, err := NewSnapshot("parent")
+	if err != nil {
+		t.Errorf("Failed creating snapshot: %s", err)
+		return
+	}
+	progress, err := parent.Add(srcdir, []string{file}, r, false, true, 1, 0, nil, nil)
+	if err != nil {
+		t.Errorf("Failed adding to snapshot: %s", err)
+		return
+	}
+	for range progress {
+	}
+
+	// same size and modification time, but different content: an
+	// incremental snapshot must not notice this and re-use the parent's chunks
+	err = ioutil.WriteFile(file, []byte("modified content"), 0600)
+	if err != nil {
+		t.Errorf("Failed writing source file: %s", err)
+		return
+	}
+	err = os.Chtimes(file, fi.ModTime(), fi.ModTime())
+	if err != nil {
+		t.Errorf("Failed resetting modification time: %s", err)
+		return
+	}
+
+	snapshot, err := NewSnapshot("incremental")
+	if err != nil {
+		t.Errorf("Failed creating snapshot: %s", err)
+		return
+	}
+	progress, err = snapshot.Add(srcdir, []string{file}, r, false, true, 1, 0, &parent, nil)
+	if err != nil {
+		t.Errorf("Failed adding to snapshot: %s", err)
+		return
+	}
+	for range progress {
+	}
+
+	if len(snapshot.Items) != 1 || len(parent.Items) != 1 {
+		t.Errorf("Expected one item per snapshot, got %d and %d", len(snapshot.Items), len(parent.Items))
+		return
+	}
+	if len(snapshot.Items[0].Chunks) != 1 || snapshot.Items[0].Chunks[0].ShaSum != parent.Items[0].Chunks[0].ShaSum {
+		t.Error("Expected unchanged file to re-use the parent's chunks")
+	}
+
+	// changed store settings apply to unchanged files, too
+	for _, opts := range []struct {
+		compress               bool
+		dataParts, parityParts uint
+	}{
+		{false, 1, 1},
+		{true, 1, 0},
+	} {
+		snapshot, err := NewSnapshot("settings")
+		if err != nil {
+			t.Fatal(err)
+		}
+		progress, err = snapshot.Add(srcdir, []string{file}, r, opts.compress, true, opts.dataParts, opts.parityParts, &parent, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for range progress {
+		}
+
+		chunk := snapshot.Items[0].Chunks[0]
+		if chunk.ParityParts != opts.parityParts || (chunk.Compressed == CompressionGZip) != opts.compress {
+			t.Errorf("Expected chunks stored with %+v, got %+v", opts, chunk)
+		}
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux
+// +build !darwin,!dragonfly,!freebsd,!linux
+
+package knoxite
+
+// diskSpace returns the free and the total space of the filesystem path is on
+func diskSpace(path string) (free, total uint64, err error) {
+	return 0, 0, ErrNotSupported
+}
@@ -8,7 +8,15 @@
 package knoxite
 
 import (
+	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Error declarations
+var (
+	ErrInvalidSize = errors.New("Invalid size")
 )
 
 // Stats contains a bunch of Stats counters
@@ -70,6 +78,27 @@ func SizeToString(size uint64) (str string) {
 	return
 }
 
+// ParseSize parses sizes like "512", "64K" or "1.5GiB". Units are powers of 1024
+func ParseSize(str string) (uint64, error) {
+	s := strings.ToUpper(strings.TrimSpace(str))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+
+	multiplier := float64(1)
+	units := "KMGTPE"
+	if s != "" {
+		if i := strings.IndexByte(units, s[len(s)-1]); i >= 0 {
+			multiplier = float64(uint64(1) << (10 * uint(i+1)))
+			s = s[:len(s)-1]
+		}
+	}
+
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || f < 0 {
+		return 0, ErrInvalidSize
+	}
+	return uint64(f * multiplier), nil
+}
+
 // String returns human-readable Stats
 func (s Stats) String() string {
 	return fmt.Sprintf("%d files, %d dirs, %d symlinks, %d errors, %v Original Size, %v Storage Size",
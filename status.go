@@ -0,0 +1,189 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"sync"
+	"time"
+)
+
+// BackendStatus describes the health of a single storage backend
+type BackendStatus struct {
+	Location string
+	Err      error         // why the backend is unreachable, nil if it's online
+	Latency  time.Duration // time it took to load the repository metadata
+
+	Listed    bool   // whether the backend could list its objects
+	Chunks    uint64 // stored chunk parts
+	Snapshots uint64 // stored snapshots
+	Used      uint64 // bytes used by the chunk parts of all snapshots
+
+	SpaceKnown bool // whether the backend could report its free space
+	Free       uint64
+	Total      uint64
+}
+
+// Online returns true if the backend is reachable
+func (s BackendStatus) Online() bool {
+	return s.Err == nil
+}
+
+// RepositoryStatus describes the health of a repository's storage backends
+type RepositoryStatus struct {
+	Backends []BackendStatus
+
+	Chunks        uint64 // chunks referenced by snapshots
+	Tolerance     uint   // backend failures the chunks were stored to survive
+	Required      uint   // backends needed to store every part of a chunk on a different one
+	Degraded      uint64 // chunks with parts missing on the reachable backends
+	Unrecoverable uint64 // chunks which can't be restored from the reachable backends
+}
+
+// Online returns how many backends are reachable
+func (s RepositoryStatus) Online() uint {
+	n := uint(0)
+	for _, b := range s.Backends {
+		if b.Online() {
+			n++
+		}
+	}
+	return n
+}
+
+// Status checks which storage backends are reachable, how much data they
+// store and whether the repository's chunks can still be restored from them
+func (r *Repository) Status() (RepositoryStatus, error) {
+	status := RepositoryStatus{Backends: make([]BackendStatus, len(r.Backend.Backends))}
+	stored := make([]map[string]bool, len(r.Backend.Backends))
+
+	var wg sync.WaitGroup
+	for i, be := range r.Backend.Backends {
+		wg.Add(1)
+		go func(i int, be Backend) {
+			defer wg.Done()
+			status.Backends[i], stored[i] = backendStatus(be)
+		}(i, *be)
+	}
+	wg.Wait()
+
+	checked := make(map[string]bool)
+	first := true
+	for _, volume := range r.Volumes {
+		for _, id := range volume.Snapshots {
+			snapshot, err := volume.LoadSnapshot(id, r)
+			if err != nil {
+				return status, err
+			}
+
+			for _, item := range snapshot.Items {
+				for _, chunk := range item.Chunks {
+					if checked[chunkKey(chunk)] {
+						continue
+					}
+					checked[chunkKey(chunk)] = true
+					status.Chunks++
+
+					if first || chunk.ParityParts < status.Tolerance {
+						status.Tolerance = chunk.ParityParts
+					}
+					first = false
+					if total := chunk.DataParts + chunk.ParityParts; total > status.Required {
+						status.Required = total
+					}
+
+					status.checkChunk(r.Backend.Placement, chunk, stored)
+				}
+			}
+		}
+	}
+
+	return status, nil
+}
+
+// checkChunk finds the reachable backends holding the parts of chunk and
+// accounts for the space they use
+func (status *RepositoryStatus) checkChunk(placement Placement, chunk Chunk, stored []map[string]bool) {
+	needed := chunk.DataParts
+	total := chunk.DataParts + chunk.ParityParts
+	size := uint64(chunk.Size)
+	if chunk.ParityParts == 0 {
+		needed = 1
+		total = 1
+	} else {
+		size = uint64((chunk.Size + int(chunk.DataParts) - 1) / int(chunk.DataParts))
+	}
+
+	found := uint(0)
+	for part := uint(0); part < total; part++ {
+		name := chunkName(chunk.ShaSum, part, chunk.DataParts)
+		held := false
+		for i := range status.Backends {
+			b := &status.Backends[i]
+			if !b.Online() {
+				continue
+			}
+
+			// backends which can't list their chunks are trusted to
+			// hold what got stored on them
+			if (stored[i] != nil && stored[i][name]) ||
+				(stored[i] == nil && (placement == PlacementMirror || (int(part) < len(chunk.Backends) && chunk.Backends[part] == i))) {
+				b.Used += size
+				held = true
+			}
+		}
+		if held {
+			found++
+		}
+	}
+
+	if found < needed {
+		status.Unrecoverable++
+	} else if found < total {
+		status.Degraded++
+	}
+}
+
+// backendStatus pings a backend and collects its statistics. It also
+// returns the names of its chunk parts, or nil if it can't list them
+func backendStatus(be Backend) (BackendStatus, map[string]bool) {
+	status := BackendStatus{Location: be.Location()}
+
+	start := time.Now()
+	_, status.Err = be.LoadRepository()
+	status.Latency = time.Since(start)
+	if status.Err != nil {
+		return status, nil
+	}
+
+	if free, total, err := BackendSpace(be); err == nil {
+		status.SpaceKnown = true
+		status.Free = free
+		status.Total = total
+	}
+
+	if !be.Capabilities().List {
+		return status, nil
+	}
+	names, err := be.ListChunks()
+	if err != nil {
+		return status, nil
+	}
+	snapshots, err := be.ListSnapshots()
+	if err != nil {
+		return status, nil
+	}
+
+	status.Listed = true
+	status.Chunks = uint64(len(names))
+	status.Snapshots = uint64(len(snapshots))
+	stored := make(map[string]bool)
+	for _, name := range names {
+		stored[name] = true
+	}
+	return status, stored
+}
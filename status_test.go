@@ -0,0 +1,104 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRepositoryStatus(t *testing.T) {
+	opts := DefaultRetryOptions
+	defer func() {
+		DefaultRetryOptions = opts
+	}()
+	DefaultRetryOptions.Attempts = 1
+
+	urls := []string{"mem://status0?size=16M", "mem://status1", "mem://status2"}
+	defer func() {
+		for i := range urls {
+			RemoveStorageMemory(fmt.Sprintf("status%d", i))
+		}
+	}()
+	r := storeMemorySnapshot(t, urls, "status_test.go", 2, 1)
+
+	status, err := r.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Online() != 3 || status.Chunks == 0 || status.Tolerance != 1 || status.Required != 3 {
+		t.Errorf("Unexpected status %+v", status)
+	}
+	if status.Degraded != 0 || status.Unrecoverable != 0 {
+		t.Errorf("Expected all chunks to be intact, got %d degraded and %d unrecoverable", status.Degraded, status.Unrecoverable)
+	}
+
+	memories := []*StorageMemory{}
+	for i, b := range status.Backends {
+		be, err := BackendFromURL(urls[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		memory := be.(*StorageMemory)
+		memories = append(memories, memory)
+
+		if !b.Online() || !b.Listed || b.Chunks != status.Chunks || b.Snapshots != 1 {
+			t.Errorf("Expected %d chunks and 1 snapshot on %s, got %+v", status.Chunks, b.Location, b)
+		}
+		if b.Used == 0 || b.Used > memory.Size() {
+			t.Errorf("Unexpected space used on %s: %d", b.Location, b.Used)
+		}
+		if b.SpaceKnown != (i == 0) {
+			t.Errorf("Expected only the size limited backend to report its space, got %+v", b)
+		}
+	}
+	if b := status.Backends[0]; b.Total != 16<<20 || b.Free != b.Total-memories[0].Size() {
+		t.Errorf("Unexpected space on %s: %d of %d bytes free", b.Location, b.Free, b.Total)
+	}
+
+	// an unreachable backend takes a part of every chunk with it
+	r.Backend = BackendManager{}
+	for i := range memories {
+		var backend Backend = memories[i]
+		if i == 1 {
+			backend = NewStorageFaulty(backend, FaultOptions{FailureRate: 1})
+		}
+		r.Backend.AddBackend(&backend)
+	}
+	status, err = r.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Online() != 2 || status.Backends[1].Err != ErrInjectedFault {
+		t.Errorf("Expected backend 1 to be offline, got %+v", status.Backends)
+	}
+	if status.Degraded != status.Chunks || status.Unrecoverable != 0 {
+		t.Errorf("Expected %d degraded chunks, got %d degraded and %d unrecoverable", status.Chunks, status.Degraded, status.Unrecoverable)
+	}
+
+	// ...and losing a second one loses data
+	for _, name := range mustList(t, memories[2]) {
+		shasum, part, total, _ := ParseChunkName(name)
+		memories[2].DeleteChunk(shasum, part, total)
+	}
+	status, err = r.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Unrecoverable != status.Chunks || status.Backends[2].Used != 0 {
+		t.Errorf("Expected %d unrecoverable chunks, got %d", status.Chunks, status.Unrecoverable)
+	}
+}
+
+func mustList(t *testing.T, backend Backend) []string {
+	names, err := backend.ListChunks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
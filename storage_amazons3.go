@@ -12,27 +12,52 @@ import (
 	"errors"
 	"io/ioutil"
 	"net/url"
-	"strconv"
 	"strings"
 
 	"github.com/minio/minio-go"
 )
 
 // StorageAmazonS3 stores data on a remote AmazonS3
+//
+// By default a repository uses three buckets, named after the bucket prefix
+// in the URL with "-chunks", "-snapshots" and "-repository" appended. With
+// the URL query parameter "layout=single" everything is kept in the bucket
+// given in the URL, separated by key prefixes instead
 type StorageAmazonS3 struct {
 	url              url.URL
 	chunkBucket      string
 	snapshotBucket   string
 	repositoryBucket string
+	chunkPrefix      string
+	snapshotPrefix   string
+	repositoryPrefix string
+	singleBucket     bool
 	region           string
+	metadata         map[string][]string
 	client           *minio.Client
 }
 
+func init() {
+	RegisterBackendType(&StorageAmazonS3{}, func(u url.URL) (Backend, error) {
+		return NewStorageAmazonS3(u)
+	})
+}
+
+// Error declarations
 var (
-	ErrInvalidUsername = errors.New("Username wrong or missing")
+	ErrInvalidUsername     = errors.New("Username wrong or missing")
+	ErrInvalidS3Layout     = errors.New("Invalid S3 layout, must be either 'buckets' or 'single'")
+	ErrInvalidS3Encryption = errors.New("Invalid S3 server-side encryption, must be either 'AES256' or 'aws:kms'")
 )
 
 // NewStorageAmazonS3 returns a StorageAmazonS3 object.
+//
+// Supported URL query parameters:
+//
+//	layout:       "buckets" (default) or "single"
+//	prefix:       key prefix used within the bucket of a single-bucket layout
+//	storageclass: storage class for stored objects, e.g. "STANDARD_IA"
+//	sse:          server-side encryption, either "AES256" or "aws:kms"
 func NewStorageAmazonS3(URL url.URL) (*StorageAmazonS3, error) {
 
 	ssl := true
@@ -59,18 +84,55 @@ func NewStorageAmazonS3(URL url.URL) (*StorageAmazonS3, error) {
 		return &StorageAmazonS3{}, ErrInvalidRepositoryURL
 	}
 
+	backend := StorageAmazonS3{url: URL,
+		region:   regionAndBucketPrefix[1],
+		metadata: map[string][]string{"Content-Type": {"application/octet-stream"}},
+	}
+
+	q := URL.Query()
+	switch q.Get("layout") {
+	case "", "buckets":
+		if q.Get("prefix") != "" {
+			// a custom prefix only makes sense within a single bucket
+			return &StorageAmazonS3{}, ErrInvalidS3Layout
+		}
+		backend.chunkBucket = regionAndBucketPrefix[2] + "-chunks"
+		backend.snapshotBucket = regionAndBucketPrefix[2] + "-snapshots"
+		backend.repositoryBucket = regionAndBucketPrefix[2] + "-repository"
+	case "single":
+		prefix := strings.Trim(q.Get("prefix"), "/")
+		if prefix != "" {
+			prefix += "/"
+		}
+		backend.singleBucket = true
+		backend.chunkBucket = regionAndBucketPrefix[2]
+		backend.snapshotBucket = regionAndBucketPrefix[2]
+		backend.repositoryBucket = regionAndBucketPrefix[2]
+		backend.chunkPrefix = prefix + "chunks/"
+		backend.snapshotPrefix = prefix + "snapshots/"
+		backend.repositoryPrefix = prefix
+	default:
+		return &StorageAmazonS3{}, ErrInvalidS3Layout
+	}
+
+	if class := q.Get("storageclass"); class != "" {
+		backend.metadata["X-Amz-Storage-Class"] = []string{strings.ToUpper(class)}
+	}
+	switch sse := q.Get("sse"); sse {
+	case "":
+	case "AES256", "aws:kms":
+		backend.metadata["X-Amz-Server-Side-Encryption"] = []string{sse}
+	default:
+		return &StorageAmazonS3{}, ErrInvalidS3Encryption
+	}
+
 	cl, err := minio.New(URL.Host, URL.User.Username(), pw, ssl)
 	if err != nil {
 		return &StorageAmazonS3{}, err
 	}
+	backend.client = cl
 
-	return &StorageAmazonS3{url: URL,
-		client:           cl,
-		region:           regionAndBucketPrefix[1],
-		chunkBucket:      regionAndBucketPrefix[2] + "-chunks",
-		snapshotBucket:   regionAndBucketPrefix[2] + "-snapshots",
-		repositoryBucket: regionAndBucketPrefix[2] + "-repository",
-	}, nil
+	return &backend, nil
 }
 
 // Location returns the type and location of the repository
@@ -93,9 +155,14 @@ func (backend *StorageAmazonS3) Description() string {
 	return "Amazon S3 Storage"
 }
 
+// Capabilities returns which optional operations the backend supports
+func (backend *StorageAmazonS3) Capabilities() Capabilities {
+	return Capabilities{List: true, Delete: true}
+}
+
 // LoadChunk loads a Chunk from network
 func (backend *StorageAmazonS3) LoadChunk(shasum string, part, totalParts uint) (*[]byte, error) {
-	fileName := shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10)
+	fileName := backend.chunkPrefix + chunkName(shasum, part, totalParts)
 	obj, err := backend.client.GetObject(backend.chunkBucket, fileName)
 	if err != nil {
 		return nil, err
@@ -106,21 +173,42 @@ func (backend *StorageAmazonS3) LoadChunk(shasum string, part, totalParts uint)
 
 // StoreChunk stores a single Chunk on network
 func (backend *StorageAmazonS3) StoreChunk(shasum string, part, totalParts uint, data *[]byte) (size uint64, err error) {
-	fileName := shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10)
+	fileName := backend.chunkPrefix + chunkName(shasum, part, totalParts)
 
 	if _, err := backend.client.StatObject(backend.chunkBucket, fileName); err == nil {
 		// Chunk is already stored
 		return 0, nil
 	}
 
-	buf := bytes.NewBuffer(*data)
-	i, err := backend.client.PutObject(backend.chunkBucket, fileName, buf, "application/octet-stream")
+	i, err := backend.put(backend.chunkBucket, fileName, *data)
 	return uint64(i), err
 }
 
+// StatChunk returns the size of a stored Chunk
+func (backend *StorageAmazonS3) StatChunk(shasum string, part, totalParts uint) (size uint64, err error) {
+	info, err := backend.client.StatObject(backend.chunkBucket, backend.chunkPrefix+chunkName(shasum, part, totalParts))
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return 0, ErrChunkNotFound
+		}
+		return 0, err
+	}
+	return uint64(info.Size), nil
+}
+
+// ListChunks returns the names of all stored chunk parts
+func (backend *StorageAmazonS3) ListChunks() ([]string, error) {
+	return backend.list(backend.chunkBucket, backend.chunkPrefix)
+}
+
+// DeleteChunk deletes a single Chunk
+func (backend *StorageAmazonS3) DeleteChunk(shasum string, part, totalParts uint) error {
+	return backend.client.RemoveObject(backend.chunkBucket, backend.chunkPrefix+chunkName(shasum, part, totalParts))
+}
+
 // LoadSnapshot loads a snapshot
 func (backend *StorageAmazonS3) LoadSnapshot(id string) ([]byte, error) {
-	obj, err := backend.client.GetObject(backend.snapshotBucket, id)
+	obj, err := backend.client.GetObject(backend.snapshotBucket, backend.snapshotPrefix+id)
 	if err != nil {
 		return nil, err
 	}
@@ -129,13 +217,26 @@ func (backend *StorageAmazonS3) LoadSnapshot(id string) ([]byte, error) {
 
 // SaveSnapshot stores a snapshot
 func (backend *StorageAmazonS3) SaveSnapshot(id string, data []byte) error {
-	buf := bytes.NewBuffer(data)
-	_, err := backend.client.PutObject(backend.snapshotBucket, id, buf, "application/octet-stream")
+	_, err := backend.put(backend.snapshotBucket, backend.snapshotPrefix+id, data)
 	return err
 }
 
+// ListSnapshots returns the IDs of all stored snapshots
+func (backend *StorageAmazonS3) ListSnapshots() ([]string, error) {
+	return backend.list(backend.snapshotBucket, backend.snapshotPrefix)
+}
+
+// DeleteSnapshot deletes a snapshot
+func (backend *StorageAmazonS3) DeleteSnapshot(id string) error {
+	return backend.client.RemoveObject(backend.snapshotBucket, backend.snapshotPrefix+id)
+}
+
 // InitRepository creates a new repository
 func (backend *StorageAmazonS3) InitRepository() error {
+	if backend.singleBucket {
+		return backend.initSingleBucket()
+	}
+
 	chunkBucketExist, err := backend.client.BucketExists(backend.chunkBucket)
 	if err != nil {
 		return err
@@ -180,7 +281,7 @@ func (backend *StorageAmazonS3) InitRepository() error {
 
 // LoadRepository reads the metadata for a repository
 func (backend *StorageAmazonS3) LoadRepository() ([]byte, error) {
-	obj, err := backend.client.GetObject(backend.repositoryBucket, repoFilename)
+	obj, err := backend.client.GetObject(backend.repositoryBucket, backend.repositoryPrefix+repoFilename)
 	if err != nil {
 		return nil, err
 	}
@@ -189,7 +290,49 @@ func (backend *StorageAmazonS3) LoadRepository() ([]byte, error) {
 
 // SaveRepository stores the metadata for a repository
 func (backend *StorageAmazonS3) SaveRepository(data []byte) error {
-	buf := bytes.NewBuffer(data)
-	_, err := backend.client.PutObject(backend.repositoryBucket, repoFilename, buf, "application/octet-stream")
+	_, err := backend.put(backend.repositoryBucket, backend.repositoryPrefix+repoFilename, data)
 	return err
 }
+
+// initSingleBucket prepares a repository sharing one bucket. The bucket
+// may already exist, as long as it doesn't contain a repository yet
+func (backend *StorageAmazonS3) initSingleBucket() error {
+	exists, err := backend.client.BucketExists(backend.repositoryBucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return backend.client.MakeBucket(backend.repositoryBucket, backend.region)
+	}
+
+	_, err = backend.client.StatObject(backend.repositoryBucket, backend.repositoryPrefix+repoFilename)
+	if err == nil {
+		return ErrRepositoryExists
+	}
+	if minio.ToErrorResponse(err).Code != "NoSuchKey" {
+		return err
+	}
+	return nil
+}
+
+// put stores an object, applying the configured storage class and
+// server-side encryption
+func (backend *StorageAmazonS3) put(bucket, key string, data []byte) (int64, error) {
+	return backend.client.PutObjectWithMetadata(bucket, key, bytes.NewReader(data), backend.metadata, nil)
+}
+
+// list returns the names of all objects in bucket starting with prefix,
+// with the prefix removed
+func (backend *StorageAmazonS3) list(bucket, prefix string) ([]string, error) {
+	names := []string{}
+	doneCh := make(chan struct{})
+	defer close(doneCh)
+
+	for obj := range backend.client.ListObjects(bucket, prefix, true, doneCh) {
+		if obj.Err != nil {
+			return names, obj.Err
+		}
+		names = append(names, strings.TrimPrefix(obj.Key, prefix))
+	}
+	return names, nil
+}
@@ -311,6 +311,66 @@ func TestStorageAmazonS3LoadChunk(t *testing.T) {
 	}
 }
 
+func TestStorageAmazonS3Layout(t *testing.T) {
+	accesskey := "USWUXHGYZQYFYFFIT3RE"
+	secretkey := "MOJRH0mkL1IPauahWITSVvyDrQbEEIwljvmxdq03"
+	base := "s3://" + accesskey + ":" + secretkey + "@127.0.0.1:9000/us-east-1/test"
+
+	tests := []struct {
+		query          string
+		err            error
+		bucket         string
+		chunkPrefix    string
+		snapshotPrefix string
+		repoPrefix     string
+	}{
+		{"", nil, "test-chunks", "", "", ""},
+		{"?layout=buckets", nil, "test-chunks", "", "", ""},
+		{"?layout=single", nil, "test", "chunks/", "snapshots/", ""},
+		{"?layout=single&prefix=/backups/host/", nil, "test", "backups/host/chunks/", "backups/host/snapshots/", "backups/host/"},
+		{"?prefix=backups", ErrInvalidS3Layout, "", "", "", ""},
+		{"?layout=bogus", ErrInvalidS3Layout, "", "", "", ""},
+		{"?sse=rot13", ErrInvalidS3Encryption, "", "", "", ""},
+	}
+
+	for _, test := range tests {
+		u, err := url.Parse(base + test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s3, err := NewStorageAmazonS3(*u)
+		if err != test.err {
+			t.Errorf("Expected %v for %s, got %v", test.err, test.query, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if s3.chunkBucket != test.bucket {
+			t.Errorf("Expected chunk bucket %s for %s, got %s", test.bucket, test.query, s3.chunkBucket)
+		}
+		if s3.chunkPrefix != test.chunkPrefix || s3.snapshotPrefix != test.snapshotPrefix || s3.repositoryPrefix != test.repoPrefix {
+			t.Errorf("Unexpected prefixes for %s: %q %q %q", test.query, s3.chunkPrefix, s3.snapshotPrefix, s3.repositoryPrefix)
+		}
+		if s3.singleBucket && (s3.snapshotBucket != test.bucket || s3.repositoryBucket != test.bucket) {
+			t.Errorf("Expected all data in bucket %s for %s", test.bucket, test.query)
+		}
+	}
+
+	u, _ := url.Parse(base + "?layout=single&storageclass=standard_ia&sse=AES256")
+	s3, err := NewStorageAmazonS3(*u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s3.metadata["X-Amz-Storage-Class"][0] != "STANDARD_IA" {
+		t.Errorf("Expected storage class STANDARD_IA, got %v", s3.metadata["X-Amz-Storage-Class"])
+	}
+	if s3.metadata["X-Amz-Server-Side-Encryption"][0] != "AES256" {
+		t.Errorf("Expected SSE AES256, got %v", s3.metadata["X-Amz-Server-Side-Encryption"])
+	}
+}
+
 func createValidStorageAmazonS3Object() *StorageAmazonS3 {
 	s3, _ := NewStorageAmazonS3(*createValidStorageURL())
 	return s3
@@ -7,11 +7,21 @@
 
 package knoxite
 
+import "net/url"
+
 // StorageDropbox stores data on a remote Dropbox
 type StorageDropbox struct {
 	URL string
 }
 
+func init() {
+	RegisterBackendType(&StorageDropbox{}, func(u url.URL) (Backend, error) {
+		return &StorageDropbox{
+			URL: u.String(),
+		}, nil
+	})
+}
+
 // Location returns the type and location of the repository
 func (backend *StorageDropbox) Location() string {
 	return backend.URL
@@ -32,6 +42,11 @@ func (backend *StorageDropbox) Description() string {
 	return "Dropbox Storage"
 }
 
+// Capabilities returns which optional operations the backend supports
+func (backend *StorageDropbox) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
 // LoadChunk loads a Chunk from network
 func (backend *StorageDropbox) LoadChunk(shasum string, part, totalParts uint) (*[]byte, error) {
 	return &[]byte{}, ErrChunkNotFound
@@ -42,6 +57,21 @@ func (backend *StorageDropbox) StoreChunk(shasum string, part, totalParts uint,
 	return 0, ErrStoreChunkFailed
 }
 
+// StatChunk returns the size of a stored Chunk
+func (backend *StorageDropbox) StatChunk(shasum string, part, totalParts uint) (size uint64, err error) {
+	return 0, ErrNotSupported
+}
+
+// ListChunks returns the names of all stored chunk parts
+func (backend *StorageDropbox) ListChunks() ([]string, error) {
+	return []string{}, ErrNotSupported
+}
+
+// DeleteChunk deletes a single Chunk
+func (backend *StorageDropbox) DeleteChunk(shasum string, part, totalParts uint) error {
+	return ErrNotSupported
+}
+
 // LoadSnapshot loads a snapshot
 func (backend *StorageDropbox) LoadSnapshot(id string) ([]byte, error) {
 	return []byte{}, ErrSnapshotNotFound
@@ -52,6 +82,16 @@ func (backend *StorageDropbox) SaveSnapshot(id string, data []byte) error {
 	return ErrStoreSnapshotFailed
 }
 
+// ListSnapshots returns the IDs of all stored snapshots
+func (backend *StorageDropbox) ListSnapshots() ([]string, error) {
+	return []string{}, ErrNotSupported
+}
+
+// DeleteSnapshot deletes a snapshot
+func (backend *StorageDropbox) DeleteSnapshot(id string) error {
+	return ErrNotSupported
+}
+
 // InitRepository creates a new repository
 func (backend *StorageDropbox) InitRepository() error {
 	return nil
@@ -0,0 +1,296 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"math/rand"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FaultOptions configure which faults a StorageFaulty injects
+type FaultOptions struct {
+	FailureRate  float64       // probability of an operation failing
+	Latency      time.Duration // delay added to every operation
+	BitFlipRate  float64       // probability of a loaded chunk having a flipped bit
+	TruncateRate float64       // probability of a loaded chunk being truncated
+	OfflineAfter int           // all operations fail after this many, 0 disables
+	Seed         int64         // makes the injected faults reproducible
+}
+
+// StorageFaulty wraps a Backend and injects faults into its operations. It
+// is meant for testing how knoxite copes with unreliable storage
+type StorageFaulty struct {
+	Backend
+	Options FaultOptions
+
+	url  url.URL
+	m    sync.Mutex
+	rand *rand.Rand
+	ops  int
+}
+
+// Error declarations
+var (
+	ErrInjectedFault  = errors.New("Injected storage fault")
+	ErrBackendOffline = errors.New("Storage backend is offline")
+)
+
+func init() {
+	RegisterBackendType(&StorageFaulty{}, func(u url.URL) (Backend, error) {
+		return NewStorageFaultyFromURL(u)
+	})
+}
+
+// NewStorageFaulty returns a StorageFaulty wrapping backend
+func NewStorageFaulty(backend Backend, opts FaultOptions) *StorageFaulty {
+	return &StorageFaulty{
+		Backend: backend,
+		Options: opts,
+		rand:    rand.New(rand.NewSource(opts.Seed)),
+	}
+}
+
+// NewStorageFaultyFromURL returns a StorageFaulty for a URL like
+// faulty://?backend=mem%3A%2F%2Fname&fail=0.1. The URL query parameters are:
+//
+//	backend:  URL of the wrapped backend
+//	fail:     probability of an operation failing
+//	latency:  delay added to every operation, e.g. "50ms"
+//	bitflip:  probability of a loaded chunk having a flipped bit
+//	truncate: probability of a loaded chunk being truncated
+//	offline:  number of operations after which the backend goes offline
+//	seed:     seed for the random faults
+func NewStorageFaultyFromURL(u url.URL) (*StorageFaulty, error) {
+	q := u.Query()
+	if q.Get("backend") == "" {
+		return &StorageFaulty{}, ErrInvalidRepositoryURL
+	}
+
+	opts := FaultOptions{}
+	var err error
+	for _, p := range []struct {
+		name  string
+		value *float64
+	}{
+		{"fail", &opts.FailureRate},
+		{"bitflip", &opts.BitFlipRate},
+		{"truncate", &opts.TruncateRate},
+	} {
+		if v := q.Get(p.name); v != "" {
+			if *p.value, err = strconv.ParseFloat(v, 64); err != nil {
+				return &StorageFaulty{}, err
+			}
+		}
+	}
+	if v := q.Get("latency"); v != "" {
+		if opts.Latency, err = time.ParseDuration(v); err != nil {
+			return &StorageFaulty{}, err
+		}
+	}
+	if v := q.Get("offline"); v != "" {
+		if opts.OfflineAfter, err = strconv.Atoi(v); err != nil {
+			return &StorageFaulty{}, err
+		}
+	}
+	if v := q.Get("seed"); v != "" {
+		if opts.Seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return &StorageFaulty{}, err
+		}
+	}
+
+	backend, err := BackendFromURL(q.Get("backend"))
+	if err != nil {
+		return &StorageFaulty{}, err
+	}
+
+	faulty := NewStorageFaulty(backend, opts)
+	faulty.url = u
+	return faulty, nil
+}
+
+// Location returns the type and location of the repository
+func (backend *StorageFaulty) Location() string {
+	if backend.url.Scheme == "" {
+		return backend.Backend.Location()
+	}
+	// url.URL drops the slashes without a host
+	return backend.url.Scheme + "://" + backend.url.Host + backend.url.Path + "?" + backend.url.RawQuery
+}
+
+// Protocols returns the Protocol Schemes supported by this backend
+func (backend *StorageFaulty) Protocols() []string {
+	return []string{"faulty"}
+}
+
+// Description returns a user-friendly description for this backend
+func (backend *StorageFaulty) Description() string {
+	return "Fault-Injection Storage (testing only)"
+}
+
+// Operations returns how many operations have been run on the backend
+func (backend *StorageFaulty) Operations() int {
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	return backend.ops
+}
+
+// AvailableSpace returns the free and the total space of the wrapped backend
+func (backend *StorageFaulty) AvailableSpace() (free, total uint64, err error) {
+	if err := backend.fault(); err != nil {
+		return 0, 0, err
+	}
+	return BackendSpace(backend.Backend)
+}
+
+// LoadChunk loads a Chunk
+func (backend *StorageFaulty) LoadChunk(shasum string, part, totalParts uint) (*[]byte, error) {
+	if err := backend.fault(); err != nil {
+		return &[]byte{}, err
+	}
+	b, err := backend.Backend.LoadChunk(shasum, part, totalParts)
+	if err != nil {
+		return b, err
+	}
+
+	data := backend.corrupt(*b)
+	return &data, nil
+}
+
+// StoreChunk stores a single Chunk
+func (backend *StorageFaulty) StoreChunk(shasum string, part, totalParts uint, data *[]byte) (size uint64, err error) {
+	if err := backend.fault(); err != nil {
+		return 0, err
+	}
+	return backend.Backend.StoreChunk(shasum, part, totalParts, data)
+}
+
+// StatChunk returns the size of a stored Chunk
+func (backend *StorageFaulty) StatChunk(shasum string, part, totalParts uint) (size uint64, err error) {
+	if err := backend.fault(); err != nil {
+		return 0, err
+	}
+	return backend.Backend.StatChunk(shasum, part, totalParts)
+}
+
+// ListChunks returns the names of all stored chunk parts
+func (backend *StorageFaulty) ListChunks() ([]string, error) {
+	if err := backend.fault(); err != nil {
+		return []string{}, err
+	}
+	return backend.Backend.ListChunks()
+}
+
+// DeleteChunk deletes a single Chunk
+func (backend *StorageFaulty) DeleteChunk(shasum string, part, totalParts uint) error {
+	if err := backend.fault(); err != nil {
+		return err
+	}
+	return backend.Backend.DeleteChunk(shasum, part, totalParts)
+}
+
+// LoadSnapshot loads a snapshot
+func (backend *StorageFaulty) LoadSnapshot(id string) ([]byte, error) {
+	if err := backend.fault(); err != nil {
+		return []byte{}, err
+	}
+	return backend.Backend.LoadSnapshot(id)
+}
+
+// SaveSnapshot stores a snapshot
+func (backend *StorageFaulty) SaveSnapshot(id string, data []byte) error {
+	if err := backend.fault(); err != nil {
+		return err
+	}
+	return backend.Backend.SaveSnapshot(id, data)
+}
+
+// ListSnapshots returns the IDs of all stored snapshots
+func (backend *StorageFaulty) ListSnapshots() ([]string, error) {
+	if err := backend.fault(); err != nil {
+		return []string{}, err
+	}
+	return backend.Backend.ListSnapshots()
+}
+
+// DeleteSnapshot deletes a snapshot
+func (backend *StorageFaulty) DeleteSnapshot(id string) error {
+	if err := backend.fault(); err != nil {
+		return err
+	}
+	return backend.Backend.DeleteSnapshot(id)
+}
+
+// InitRepository creates a new repository
+func (backend *StorageFaulty) InitRepository() error {
+	if err := backend.fault(); err != nil {
+		return err
+	}
+	return backend.Backend.InitRepository()
+}
+
+// LoadRepository reads the metadata for a repository
+func (backend *StorageFaulty) LoadRepository() ([]byte, error) {
+	if err := backend.fault(); err != nil {
+		return []byte{}, err
+	}
+	return backend.Backend.LoadRepository()
+}
+
+// SaveRepository stores the metadata for a repository
+func (backend *StorageFaulty) SaveRepository(data []byte) error {
+	if err := backend.fault(); err != nil {
+		return err
+	}
+	return backend.Backend.SaveRepository(data)
+}
+
+// fault counts an operation and decides whether it fails
+func (backend *StorageFaulty) fault() error {
+	backend.m.Lock()
+	backend.ops++
+	offline := backend.Options.OfflineAfter > 0 && backend.ops > backend.Options.OfflineAfter
+	fail := backend.Options.FailureRate > 0 && backend.rand.Float64() < backend.Options.FailureRate
+	backend.m.Unlock()
+
+	if backend.Options.Latency > 0 {
+		time.Sleep(backend.Options.Latency)
+	}
+	if offline {
+		return ErrBackendOffline
+	}
+	if fail {
+		return ErrInjectedFault
+	}
+	return nil
+}
+
+// corrupt returns a copy of b, which may have a flipped bit or be truncated
+func (backend *StorageFaulty) corrupt(b []byte) []byte {
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	data := make([]byte, len(b))
+	copy(data, b)
+	if len(data) == 0 {
+		return data
+	}
+
+	if backend.Options.BitFlipRate > 0 && backend.rand.Float64() < backend.Options.BitFlipRate {
+		i := backend.rand.Intn(len(data))
+		data[i] ^= 1 << uint(backend.rand.Intn(8))
+	}
+	if backend.Options.TruncateRate > 0 && backend.rand.Float64() < backend.Options.TruncateRate {
+		data = data[:backend.rand.Intn(len(data))]
+	}
+	return data
+}
@@ -0,0 +1,202 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestStorageFaultyURL(t *testing.T) {
+	defer RemoveStorageMemory("faulty-url")
+
+	u := "faulty://?backend=" + url.QueryEscape("mem://faulty-url") +
+		"&fail=0.25&latency=1ms&bitflip=0.5&truncate=0.125&offline=10&seed=42"
+	be, err := BackendFromURL(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := be.(*StorageFaulty)
+
+	expected := FaultOptions{
+		FailureRate:  0.25,
+		Latency:      time.Millisecond,
+		BitFlipRate:  0.5,
+		TruncateRate: 0.125,
+		OfflineAfter: 10,
+		Seed:         42,
+	}
+	if backend.Options != expected {
+		t.Errorf("Expected options %+v, got %+v", expected, backend.Options)
+	}
+	if backend.Location() != u {
+		t.Errorf("Expected location %s, got %s", u, backend.Location())
+	}
+	if _, ok := backend.Backend.(*StorageMemory); !ok {
+		t.Errorf("Expected wrapped memory backend, got %T", backend.Backend)
+	}
+
+	for _, invalid := range []string{
+		"faulty://",
+		"faulty://?backend=unknown%3A%2F%2Fx",
+		"faulty://?backend=mem%3A%2F%2Fx&fail=often",
+		"faulty://?backend=mem%3A%2F%2Fx&latency=long",
+	} {
+		if _, err := BackendFromURL(invalid); err == nil {
+			t.Errorf("Expected error for %s", invalid)
+		}
+	}
+}
+
+func TestStorageFaultyInjection(t *testing.T) {
+	defer RemoveStorageMemory("faulty")
+	inner := newTestStorageMemory(t, "mem://faulty")
+	data := []byte("some chunk data")
+	if _, err := inner.StoreChunk("abc", 0, 1, &data); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := NewStorageFaulty(inner, FaultOptions{OfflineAfter: 2})
+	for i := 0; i < 2; i++ {
+		if _, err := backend.LoadChunk("abc", 0, 1); err != nil {
+			t.Errorf("Expected backend to be online, got %v", err)
+		}
+	}
+	if _, err := backend.LoadChunk("abc", 0, 1); err != ErrBackendOffline {
+		t.Errorf("Expected %v, got %v", ErrBackendOffline, err)
+	}
+	if backend.Operations() != 3 {
+		t.Errorf("Expected 3 operations, got %d", backend.Operations())
+	}
+
+	backend = NewStorageFaulty(inner, FaultOptions{FailureRate: 1})
+	if err := backend.SaveSnapshot("snap", data); err != ErrInjectedFault {
+		t.Errorf("Expected %v, got %v", ErrInjectedFault, err)
+	}
+
+	backend = NewStorageFaulty(inner, FaultOptions{BitFlipRate: 1})
+	b, err := backend.LoadChunk("abc", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := 0
+	for i := range data {
+		for x := (*b)[i] ^ data[i]; x != 0; x &= x - 1 {
+			diff++
+		}
+	}
+	if diff != 1 {
+		t.Errorf("Expected a single flipped bit, got %d", diff)
+	}
+	if raw, _ := inner.RawChunk(chunkName("abc", 0, 1)); string(raw) != string(data) {
+		t.Error("Expected stored data to stay intact")
+	}
+
+	backend = NewStorageFaulty(inner, FaultOptions{TruncateRate: 1})
+	b, err = backend.LoadChunk("abc", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*b) >= len(data) {
+		t.Errorf("Expected truncated data, got %d bytes", len(*b))
+	}
+}
+
+// failureToleranceRepository stores a snapshot on n in-memory backends,
+// tolerating the failure of tolerance of them, like the store command does
+func failureToleranceRepository(t *testing.T, name string, n, tolerance uint) (Repository, Snapshot, []Backend) {
+	urls := []string{}
+	for i := uint(0); i < n; i++ {
+		urls = append(urls, fmt.Sprintf("mem://%s%d", name, i))
+	}
+	r := storeMemorySnapshot(t, urls, "storage_faulty_test.go", n-tolerance, tolerance)
+
+	_, snapshot, err := r.FindSnapshot(r.Volumes[0].Snapshots[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := []Backend{}
+	for _, u := range urls {
+		backend, err := BackendFromURL(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends = append(backends, backend)
+	}
+	return r, *snapshot, backends
+}
+
+// loadWithFaults tries to load all chunks of snapshot, with faults injected
+// into some of the backends
+func loadWithFaults(r Repository, snapshot Snapshot, backends []Backend, faults map[int]FaultOptions) error {
+	r.Backend = BackendManager{}
+	for i := range backends {
+		backend := backends[i]
+		if opts, ok := faults[i]; ok {
+			backend = NewStorageFaulty(backend, opts)
+		}
+		r.Backend.AddBackend(&backend)
+	}
+
+	for _, item := range snapshot.Items {
+		for _, chunk := range item.Chunks {
+			if _, err := loadChunk(r, chunk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func TestFailureTolerance(t *testing.T) {
+	opts := DefaultRetryOptions
+	defer func() {
+		DefaultRetryOptions = opts
+	}()
+	DefaultRetryOptions.Attempts = 1
+
+	const n, tolerance = 4, 2
+	r, snapshot, backends := failureToleranceRepository(t, "tolerance", n, tolerance)
+	defer func() {
+		for i := 0; i < n; i++ {
+			RemoveStorageMemory(fmt.Sprintf("tolerance%d", i))
+		}
+	}()
+
+	faults := map[string]FaultOptions{
+		"offline":   {OfflineAfter: 1},
+		"failing":   {FailureRate: 1},
+		"bit flips": {BitFlipRate: 1},
+		"truncated": {TruncateRate: 1},
+	}
+
+	// any combination of tolerance failing backends must be survived
+	for name1, fault1 := range faults {
+		for name2, fault2 := range faults {
+			for i := 0; i < n; i++ {
+				j := (i + 1) % n
+				err := loadWithFaults(r, snapshot, backends, map[int]FaultOptions{i: fault1, j: fault2})
+				if err != nil {
+					t.Errorf("Failed loading data with backend %d %s and backend %d %s: %v", i, name1, j, name2, err)
+				}
+			}
+		}
+	}
+
+	// ...but not more than that
+	err := loadWithFaults(r, snapshot, backends, map[int]FaultOptions{
+		0: faults["failing"],
+		1: faults["truncated"],
+		2: faults["bit flips"],
+	})
+	if err == nil {
+		t.Error("Expected loading data to fail with more failing backends than tolerated")
+	}
+}
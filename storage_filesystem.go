@@ -0,0 +1,200 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// fileSystem is the set of file operations needed to store a repository in
+// a directory tree, like it's done locally or over SFTP
+type fileSystem interface {
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	Remove(name string) error
+	Mkdir(name string, perm os.FileMode) error
+	Join(elem ...string) string
+}
+
+// localFileSystem accesses the local disk
+type localFileSystem struct{}
+
+func (localFileSystem) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (localFileSystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return ioutil.WriteFile(name, data, perm)
+}
+
+func (localFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (localFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(name)
+}
+
+func (localFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (localFileSystem) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (localFileSystem) Join(elem ...string) string {
+	return filepath.Join(elem...)
+}
+
+// storageFileSystem implements the data handling of a Backend on top of a
+// fileSystem. Chunks and snapshots are kept in sub-directories of Path
+type storageFileSystem struct {
+	fs   fileSystem
+	Path string
+}
+
+// Capabilities returns which optional operations the backend supports
+func (backend *storageFileSystem) Capabilities() Capabilities {
+	return Capabilities{List: true, Delete: true}
+}
+
+// LoadChunk loads a Chunk
+func (backend *storageFileSystem) LoadChunk(shasum string, part, totalParts uint) (*[]byte, error) {
+	b, err := backend.fs.ReadFile(backend.fs.Join(backend.Path, "chunks", chunkName(shasum, part, totalParts)))
+	return &b, err
+}
+
+// StoreChunk stores a single Chunk
+func (backend *storageFileSystem) StoreChunk(shasum string, part, totalParts uint, data *[]byte) (size uint64, err error) {
+	fileName := backend.fs.Join(backend.Path, "chunks", chunkName(shasum, part, totalParts))
+	if _, err = backend.fs.Stat(fileName); err == nil {
+		// Chunk is already stored
+		return 0, nil
+	}
+
+	err = backend.fs.WriteFile(fileName, *data, 0600)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return uint64(len(*data)), err
+}
+
+// StatChunk returns the size of a stored Chunk
+func (backend *storageFileSystem) StatChunk(shasum string, part, totalParts uint) (size uint64, err error) {
+	fi, err := backend.fs.Stat(backend.fs.Join(backend.Path, "chunks", chunkName(shasum, part, totalParts)))
+	if os.IsNotExist(err) {
+		return 0, ErrChunkNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return uint64(fi.Size()), nil
+}
+
+// ListChunks returns the names of all stored chunk parts
+func (backend *storageFileSystem) ListChunks() ([]string, error) {
+	return backend.list("chunks")
+}
+
+// DeleteChunk deletes a single Chunk
+func (backend *storageFileSystem) DeleteChunk(shasum string, part, totalParts uint) error {
+	return backend.fs.Remove(backend.fs.Join(backend.Path, "chunks", chunkName(shasum, part, totalParts)))
+}
+
+// LoadSnapshot loads a snapshot
+func (backend *storageFileSystem) LoadSnapshot(id string) ([]byte, error) {
+	b, err := backend.fs.ReadFile(backend.fs.Join(backend.Path, "snapshots", id))
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	return b, err
+}
+
+// SaveSnapshot stores a snapshot
+func (backend *storageFileSystem) SaveSnapshot(id string, b []byte) error {
+	return backend.fs.WriteFile(backend.fs.Join(backend.Path, "snapshots", id), b, 0600)
+}
+
+// ListSnapshots returns the IDs of all stored snapshots
+func (backend *storageFileSystem) ListSnapshots() ([]string, error) {
+	return backend.list("snapshots")
+}
+
+// DeleteSnapshot deletes a snapshot
+func (backend *storageFileSystem) DeleteSnapshot(id string) error {
+	return backend.fs.Remove(backend.fs.Join(backend.Path, "snapshots", id))
+}
+
+// InitRepository creates a new repository
+func (backend *storageFileSystem) InitRepository() error {
+	fileName := backend.fs.Join(backend.Path, repoFilename)
+	if _, err := backend.fs.Stat(fileName); err == nil {
+		// Repo seems to already exist
+		return ErrRepositoryExists
+	}
+
+	return nil
+}
+
+// LoadRepository reads the metadata for a repository
+func (backend *storageFileSystem) LoadRepository() ([]byte, error) {
+	b, err := backend.fs.ReadFile(backend.fs.Join(backend.Path, repoFilename))
+	if err != nil {
+		fmt.Println(err)
+	}
+
+	return b, err
+}
+
+// SaveRepository stores the metadata for a repository
+func (backend *storageFileSystem) SaveRepository(b []byte) error {
+	fileName := backend.fs.Join(backend.Path, repoFilename)
+	err := backend.fs.WriteFile(fileName, b, 0600)
+	if err == nil {
+		reqPaths := []string{"chunks", "snapshots"}
+		for _, reqPath := range reqPaths {
+			path := backend.fs.Join(backend.Path, reqPath)
+			if stat, serr := backend.fs.Stat(path); serr == nil {
+				if !stat.IsDir() {
+					return errors.New("Repository contains an invalid file named " + reqPath)
+				}
+			} else {
+				err = backend.fs.Mkdir(path, 0700)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return err
+}
+
+// list returns the names of all files in one of the repository's directories
+func (backend *storageFileSystem) list(dir string) ([]string, error) {
+	names := []string{}
+	files, err := backend.fs.ReadDir(backend.fs.Join(backend.Path, dir))
+	if err != nil {
+		return names, err
+	}
+
+	for _, fi := range files {
+		if !fi.IsDir() {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
@@ -7,7 +7,16 @@
 package knoxite
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
 	"net/url"
+	"os"
+	"path"
+	"sync"
 	"time"
 
 	"github.com/jlaffaye/ftp"
@@ -16,44 +25,76 @@ import (
 // StorageFTP stores data on a remote FTP
 type StorageFTP struct {
 	url      url.URL
-	c        *ftp.ServerConn
+	c        *ftp.ServerConn // nil while disconnected
 	loggedIn bool
+
+	// the connection can only handle one command at a time
+	m sync.Mutex
+}
+
+func init() {
+	RegisterBackendType(&StorageFTP{}, func(u url.URL) (Backend, error) {
+		return NewStorageFTP(u)
+	})
 }
 
 // NewStorageFTP establishs a FTP connection and returns a StorageFTP object.
 func NewStorageFTP(u url.URL) (*StorageFTP, error) {
-	conn, err := ftp.DialTimeout(u.Host, 30*time.Second)
-	if err != nil {
+	backend := &StorageFTP{
+		url: u,
+	}
+	if err := backend.connect(); err != nil {
 		return nil, err
 	}
-	loggedIn := false
-	if u.User.Username() != "" {
-		if pw, set := u.User.Password(); set {
-			err := conn.Login(u.User.Username(), pw)
-			if err != nil {
-				return nil, err
-			}
-			loggedIn = true
-		} else {
-			err := conn.Login(u.User.Username(), "")
-			if err != nil {
-				return nil, err
-			}
-			loggedIn = true
-		}
-	} else {
-		err := conn.Login("anonymous", "anonymous")
-		if err != nil {
-			return nil, err
+
+	return backend, nil
+}
+
+// connect establishes a new connection to the server and logs in
+func (backend *StorageFTP) connect() error {
+	conn, err := ftp.DialTimeout(backend.url.Host, 30*time.Second)
+	if err != nil {
+		return err
+	}
+
+	user, pw := "anonymous", "anonymous"
+	if backend.url.User.Username() != "" {
+		user = backend.url.User.Username()
+		pw, _ = backend.url.User.Password()
+	}
+	if err := conn.Login(user, pw); err != nil {
+		conn.Quit()
+		return err
+	}
+
+	backend.c = conn
+	backend.loggedIn = true
+	return nil
+}
+
+// run runs op on the connection. If the connection got lost, it reconnects
+// and runs op once more
+func (backend *StorageFTP) run(op func(c *ftp.ServerConn) error) error {
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	if backend.c == nil {
+		if err := backend.connect(); err != nil {
+			return err
 		}
-		loggedIn = true
+	}
+	err := op(backend.c)
+	if !isFTPConnError(err) {
+		return err
 	}
 
-	return &StorageFTP{
-		url:      u,
-		c:        conn,
-		loggedIn: loggedIn,
-	}, nil
+	backend.c.Quit()
+	backend.c = nil
+	backend.loggedIn = false
+	if cerr := backend.connect(); cerr != nil {
+		return err
+	}
+	return op(backend.c)
 }
 
 // Location returns the type and location of the repository
@@ -63,6 +104,12 @@ func (backend *StorageFTP) Location() string {
 
 // Close the backend
 func (backend *StorageFTP) Close() error {
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	if backend.c == nil {
+		return nil
+	}
 	if backend.loggedIn {
 		err := backend.c.Logout()
 		if err != nil {
@@ -83,37 +130,215 @@ func (backend *StorageFTP) Description() string {
 	return "FTP Storage"
 }
 
+// Capabilities returns which optional operations the backend supports
+func (backend *StorageFTP) Capabilities() Capabilities {
+	return Capabilities{List: true, Delete: true}
+}
+
 // LoadChunk loads a Chunk from network
 func (backend *StorageFTP) LoadChunk(shasum string, part, totalParts uint) (*[]byte, error) {
-	return &[]byte{}, ErrChunkNotFound
+	b, err := backend.retrieve(path.Join(backend.url.Path, "chunks", chunkName(shasum, part, totalParts)))
+	if isFTPNotFound(err) {
+		err = ErrChunkNotFound
+	}
+	return &b, err
 }
 
 // StoreChunk stores a single Chunk on network
 func (backend *StorageFTP) StoreChunk(shasum string, part, totalParts uint, data *[]byte) (size uint64, err error) {
-	return 0, ErrStoreChunkFailed
+	if _, err = backend.StatChunk(shasum, part, totalParts); err == nil {
+		// Chunk is already stored
+		return 0, nil
+	}
+
+	err = backend.store(path.Join(backend.url.Path, "chunks", chunkName(shasum, part, totalParts)), *data)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(len(*data)), nil
+}
+
+// StatChunk returns the size of a stored Chunk
+func (backend *StorageFTP) StatChunk(shasum string, part, totalParts uint) (size uint64, err error) {
+	var n int64
+	err = backend.run(func(c *ftp.ServerConn) (err error) {
+		n, err = c.FileSize(path.Join(backend.url.Path, "chunks", chunkName(shasum, part, totalParts)))
+		return err
+	})
+	if isFTPNotFound(err) {
+		return 0, ErrChunkNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	return uint64(n), nil
+}
+
+// ListChunks returns the names of all stored chunk parts
+func (backend *StorageFTP) ListChunks() ([]string, error) {
+	return backend.list("chunks")
+}
+
+// DeleteChunk deletes a single Chunk
+func (backend *StorageFTP) DeleteChunk(shasum string, part, totalParts uint) error {
+	return backend.delete(path.Join(backend.url.Path, "chunks", chunkName(shasum, part, totalParts)))
 }
 
 // LoadSnapshot loads a snapshot
 func (backend *StorageFTP) LoadSnapshot(id string) ([]byte, error) {
-	return []byte{}, ErrSnapshotNotFound
+	b, err := backend.retrieve(path.Join(backend.url.Path, "snapshots", id))
+	if isFTPNotFound(err) {
+		err = ErrSnapshotNotFound
+	}
+	return b, err
 }
 
 // SaveSnapshot stores a snapshot
 func (backend *StorageFTP) SaveSnapshot(id string, data []byte) error {
-	return ErrStoreSnapshotFailed
+	return backend.store(path.Join(backend.url.Path, "snapshots", id), data)
+}
+
+// ListSnapshots returns the IDs of all stored snapshots
+func (backend *StorageFTP) ListSnapshots() ([]string, error) {
+	return backend.list("snapshots")
+}
+
+// DeleteSnapshot deletes a snapshot
+func (backend *StorageFTP) DeleteSnapshot(id string) error {
+	return backend.delete(path.Join(backend.url.Path, "snapshots", id))
 }
 
 // InitRepository creates a new repository
 func (backend *StorageFTP) InitRepository() error {
-	return nil
+	if _, err := backend.retrieve(path.Join(backend.url.Path, repoFilename)); err == nil {
+		// Repo seems to already exist
+		return ErrRepositoryExists
+	}
+
+	return backend.run(func(c *ftp.ServerConn) error {
+		if backend.url.Path != "" && backend.url.Path != "/" {
+			if err := makeFTPDir(c, backend.url.Path); err != nil {
+				return err
+			}
+		}
+		for _, dir := range []string{"chunks", "snapshots"} {
+			if err := makeFTPDir(c, path.Join(backend.url.Path, dir)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // LoadRepository reads the metadata for a repository
 func (backend *StorageFTP) LoadRepository() ([]byte, error) {
-	return []byte{}, ErrLoadRepositoryFailed
+	b, err := backend.retrieve(path.Join(backend.url.Path, repoFilename))
+	if isFTPNotFound(err) {
+		err = ErrLoadRepositoryFailed
+	}
+	return b, err
 }
 
 // SaveRepository stores the metadata for a repository
 func (backend *StorageFTP) SaveRepository(data []byte) error {
-	return ErrStoreRepositoryFailed
+	return backend.store(path.Join(backend.url.Path, repoFilename), data)
+}
+
+// list returns the names of all files in one of the repository's directories
+func (backend *StorageFTP) list(dir string) ([]string, error) {
+	var entries []string
+	err := backend.run(func(c *ftp.ServerConn) (err error) {
+		entries, err = c.NameList(path.Join(backend.url.Path, dir))
+		return err
+	})
+	if err != nil {
+		return []string{}, err
+	}
+
+	// some servers return full paths, others just the file names
+	names := []string{}
+	for _, entry := range entries {
+		name := path.Base(entry)
+		if name != "." && name != ".." {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// retrieve downloads a file from the server
+func (backend *StorageFTP) retrieve(fileName string) ([]byte, error) {
+	var b []byte
+	err := backend.run(func(c *ftp.ServerConn) error {
+		resp, err := c.Retr(fileName)
+		if err != nil {
+			return err
+		}
+
+		b, err = ioutil.ReadAll(resp)
+		cerr := resp.Close()
+		if err != nil {
+			return err
+		}
+		return cerr
+	})
+	if err != nil {
+		return []byte{}, err
+	}
+	return b, nil
+}
+
+// store uploads a file to the server
+func (backend *StorageFTP) store(fileName string, data []byte) error {
+	return backend.run(func(c *ftp.ServerConn) error {
+		return c.Stor(fileName, bytes.NewReader(data))
+	})
+}
+
+// delete removes a file from the server
+func (backend *StorageFTP) delete(fileName string) error {
+	err := backend.run(func(c *ftp.ServerConn) error {
+		return c.Delete(fileName)
+	})
+	if isFTPNotFound(err) {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+// makeFTPDir creates dir, unless it already exists
+func makeFTPDir(c *ftp.ServerConn, dir string) error {
+	err := c.MakeDir(dir)
+	if !isFTPNotFound(err) {
+		return err
+	}
+
+	// servers also reply with 550 when a directory already exists
+	cwd, cerr := c.CurrentDir()
+	if cerr != nil {
+		return cerr
+	}
+	if cderr := c.ChangeDir(dir); cderr != nil {
+		if isFTPNotFound(cderr) {
+			return err
+		}
+		return cderr
+	}
+	return c.ChangeDir(cwd)
+}
+
+// isFTPNotFound returns true if err is the server's reply for unavailable files
+func isFTPNotFound(err error) bool {
+	perr, ok := err.(*textproto.Error)
+	return ok && perr.Code == ftp.StatusFileUnavailable
+}
+
+// isFTPConnError returns true if err means the connection to the server got
+// lost or the server is about to close it
+func isFTPConnError(err error) bool {
+	if perr, ok := err.(*textproto.Error); ok {
+		return perr.Code == ftp.StatusNotAvailable
+	}
+	var nerr net.Error
+	return errors.As(err, &nerr) || err == io.EOF || err == io.ErrUnexpectedEOF
 }
@@ -0,0 +1,441 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Stefan Luecke <glaxx@glaxx.net>
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ftpTestServer is a minimal in-memory FTP server, supporting just enough
+// commands for StorageFTP
+type ftpTestServer struct {
+	listener net.Listener
+	files    map[string][]byte
+	dirs     map[string]bool
+	drop     int // how many of the next commands get answered with 421
+	m        sync.Mutex
+}
+
+func newFTPTestServer(t *testing.T) *ftpTestServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &ftpTestServer{
+		listener: l,
+		files:    make(map[string][]byte),
+		dirs:     map[string]bool{"/": true},
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+func (s *ftpTestServer) Close() {
+	s.listener.Close()
+}
+
+func (s *ftpTestServer) URL(p string) url.URL {
+	return url.URL{Scheme: "ftp", User: url.UserPassword("knoxite", "secret"), Host: s.listener.Addr().String(), Path: p}
+}
+
+func (s *ftpTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+	rd := bufio.NewReader(conn)
+	reply := func(code int, msg string) {
+		fmt.Fprintf(conn, "%d %s\r\n", code, msg)
+	}
+
+	var data net.Listener
+	accept := func() net.Conn {
+		if data == nil {
+			reply(425, "Use EPSV first")
+			return nil
+		}
+		defer func() {
+			data.Close()
+			data = nil
+		}()
+		c, err := data.Accept()
+		if err != nil {
+			reply(425, "Can't open data connection")
+			return nil
+		}
+		return c
+	}
+
+	reply(220, "Ready")
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd, arg := line, ""
+		if i := strings.Index(line, " "); i >= 0 {
+			cmd, arg = line[:i], line[i+1:]
+		}
+		p := path.Clean("/" + arg)
+
+		s.m.Lock()
+		drop := s.drop > 0
+		if drop {
+			s.drop--
+		}
+		s.m.Unlock()
+		if drop {
+			reply(421, "Service not available")
+			return
+		}
+
+		switch strings.ToUpper(cmd) {
+		case "USER":
+			reply(331, "Password required")
+		case "PASS":
+			if arg != "secret" {
+				reply(530, "Login incorrect")
+				continue
+			}
+			reply(230, "Logged in")
+		case "TYPE", "NOOP":
+			reply(200, "OK")
+		case "PWD":
+			reply(257, `"/" is the current directory`)
+		case "CWD":
+			s.m.Lock()
+			ok := s.dirs[p]
+			s.m.Unlock()
+			if !ok {
+				reply(550, "No such directory")
+				continue
+			}
+			reply(250, "OK")
+		case "REIN":
+			reply(220, "Ready")
+		case "QUIT":
+			reply(221, "Bye")
+			return
+		case "EPSV":
+			data, err = net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				reply(425, err.Error())
+				continue
+			}
+			reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", data.Addr().(*net.TCPAddr).Port))
+		case "MKD":
+			s.m.Lock()
+			if s.dirs[p] || !s.dirs[path.Dir(p)] {
+				s.m.Unlock()
+				reply(550, "Can't create directory")
+				continue
+			}
+			s.dirs[p] = true
+			s.m.Unlock()
+			reply(257, "Created")
+		case "DELE":
+			s.m.Lock()
+			_, ok := s.files[p]
+			delete(s.files, p)
+			s.m.Unlock()
+			if !ok {
+				reply(550, "No such file")
+				continue
+			}
+			reply(250, "Deleted")
+		case "SIZE":
+			s.m.Lock()
+			b, ok := s.files[p]
+			s.m.Unlock()
+			if !ok {
+				reply(550, "No such file")
+				continue
+			}
+			reply(213, strconv.Itoa(len(b)))
+		case "RETR":
+			s.m.Lock()
+			b, ok := s.files[p]
+			s.m.Unlock()
+			if !ok {
+				if data != nil {
+					data.Close()
+					data = nil
+				}
+				reply(550, "No such file")
+				continue
+			}
+			c := accept()
+			if c == nil {
+				continue
+			}
+			reply(150, "Sending")
+			c.Write(b)
+			c.Close()
+			reply(226, "Done")
+		case "STOR":
+			s.m.Lock()
+			ok := s.dirs[path.Dir(p)]
+			s.m.Unlock()
+			if !ok {
+				if data != nil {
+					data.Close()
+					data = nil
+				}
+				reply(550, "No such directory")
+				continue
+			}
+			c := accept()
+			if c == nil {
+				continue
+			}
+			reply(150, "Receiving")
+			b, _ := ioutil.ReadAll(c)
+			c.Close()
+			s.m.Lock()
+			s.files[p] = b
+			s.m.Unlock()
+			reply(226, "Done")
+		case "NLST":
+			s.m.Lock()
+			ok := s.dirs[p]
+			names := []string{}
+			for name := range s.files {
+				if path.Dir(name) == p {
+					names = append(names, name)
+				}
+			}
+			s.m.Unlock()
+			if !ok {
+				if data != nil {
+					data.Close()
+					data = nil
+				}
+				reply(550, "No such directory")
+				continue
+			}
+			c := accept()
+			if c == nil {
+				continue
+			}
+			reply(150, "Listing")
+			for _, name := range names {
+				fmt.Fprintf(c, "%s\r\n", name)
+			}
+			c.Close()
+			reply(226, "Done")
+		default:
+			reply(502, "Not implemented")
+		}
+	}
+}
+
+func newTestStorageFTP(t *testing.T, server *ftpTestServer) *StorageFTP {
+	backend, err := NewStorageFTP(server.URL("/repo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func TestStorageFTPRepository(t *testing.T) {
+	server := newFTPTestServer(t)
+	defer server.Close()
+	backend := newTestStorageFTP(t, server)
+	defer backend.Close()
+
+	if _, err := backend.LoadRepository(); err != ErrLoadRepositoryFailed {
+		t.Errorf("Expected %v, got %v", ErrLoadRepositoryFailed, err)
+	}
+	if err := backend.InitRepository(); err != nil {
+		t.Fatal(err)
+	}
+	if !server.dirs["/repo/chunks"] || !server.dirs["/repo/snapshots"] {
+		t.Error("Expected chunks and snapshots directories to be created")
+	}
+
+	data := []byte("repository")
+	if err := backend.SaveRepository(data); err != nil {
+		t.Fatal(err)
+	}
+	b, err := backend.LoadRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("Expected %s, got %s", data, b)
+	}
+
+	if err := backend.InitRepository(); err != ErrRepositoryExists {
+		t.Errorf("Expected %v, got %v", ErrRepositoryExists, err)
+	}
+}
+
+func TestStorageFTPInitMissingParent(t *testing.T) {
+	server := newFTPTestServer(t)
+	defer server.Close()
+	backend, err := NewStorageFTP(server.URL("/missing/repo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	if err := backend.InitRepository(); !isFTPNotFound(err) {
+		t.Errorf("Expected creating a repository in a missing directory to fail, got %v", err)
+	}
+}
+
+func TestStorageFTPReconnect(t *testing.T) {
+	server := newFTPTestServer(t)
+	defer server.Close()
+	backend := newTestStorageFTP(t, server)
+	defer backend.Close()
+
+	if err := backend.InitRepository(); err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("repository")
+	if err := backend.SaveRepository(data); err != nil {
+		t.Fatal(err)
+	}
+
+	// the server closes the connection, which gets established again
+	server.m.Lock()
+	server.drop = 1
+	server.m.Unlock()
+	b, err := backend.LoadRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("Expected %s, got %s", data, b)
+	}
+}
+
+func TestStorageFTPChunks(t *testing.T) {
+	server := newFTPTestServer(t)
+	defer server.Close()
+	backend := newTestStorageFTP(t, server)
+	defer backend.Close()
+
+	if err := backend.InitRepository(); err != nil {
+		t.Fatal(err)
+	}
+
+	// backends get used concurrently while storing snapshots
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := []byte(fmt.Sprintf("chunk %d", i))
+			size, err := backend.StoreChunk(fmt.Sprintf("%064x", i), 0, 1, &data)
+			if err != nil {
+				t.Error(err)
+			}
+			if size != uint64(len(data)) {
+				t.Errorf("Expected size %d, got %d", len(data), size)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 8; i++ {
+		b, err := backend.LoadChunk(fmt.Sprintf("%064x", i), 0, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(*b) != fmt.Sprintf("chunk %d", i) {
+			t.Errorf("Unexpected chunk data: %s", *b)
+		}
+	}
+	if _, err := backend.LoadChunk("missing", 0, 1); err != ErrChunkNotFound {
+		t.Errorf("Expected %v, got %v", ErrChunkNotFound, err)
+	}
+
+	// parts which are already stored don't get uploaded again
+	data := []byte("other data")
+	if size, err := backend.StoreChunk(fmt.Sprintf("%064x", 1), 0, 1, &data); err != nil || size != 0 {
+		t.Errorf("Expected an existing chunk to be skipped, got size %d (%v)", size, err)
+	}
+
+	names, err := backend.ListChunks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if len(names) != 8 || names[0] != chunkName(fmt.Sprintf("%064x", 0), 0, 1) {
+		t.Errorf("Unexpected chunk list: %v", names)
+	}
+
+	size, err := backend.StatChunk(fmt.Sprintf("%064x", 1), 0, 1)
+	if err != nil || size != uint64(len("chunk 1")) {
+		t.Errorf("Expected size %d, got %d (%v)", len("chunk 1"), size, err)
+	}
+
+	if err := backend.DeleteChunk(fmt.Sprintf("%064x", 0), 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.LoadChunk(fmt.Sprintf("%064x", 0), 0, 1); err != ErrChunkNotFound {
+		t.Errorf("Expected %v, got %v", ErrChunkNotFound, err)
+	}
+	if _, err := backend.StatChunk(fmt.Sprintf("%064x", 0), 0, 1); err != ErrChunkNotFound {
+		t.Errorf("Expected %v, got %v", ErrChunkNotFound, err)
+	}
+}
+
+func TestStorageFTPSnapshots(t *testing.T) {
+	server := newFTPTestServer(t)
+	defer server.Close()
+	backend := newTestStorageFTP(t, server)
+	defer backend.Close()
+
+	if err := backend.InitRepository(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("snapshot")
+	if err := backend.SaveSnapshot("abcdef", data); err != nil {
+		t.Fatal(err)
+	}
+	b, err := backend.LoadSnapshot("abcdef")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("Expected %s, got %s", data, b)
+	}
+	ids, err := backend.ListSnapshots()
+	if err != nil || len(ids) != 1 || ids[0] != "abcdef" {
+		t.Errorf("Unexpected snapshot list %v (%v)", ids, err)
+	}
+
+	if err := backend.DeleteSnapshot("abcdef"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.LoadSnapshot("abcdef"); err != ErrSnapshotNotFound {
+		t.Errorf("Expected %v, got %v", ErrSnapshotNotFound, err)
+	}
+}
@@ -9,13 +9,14 @@ package knoxite
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"mime/multipart"
 	"net/http"
-	"strconv"
+	"net/url"
+	"os"
 )
 
 // Error declarations
@@ -26,11 +27,20 @@ var (
 	ErrStoreRepositoryFailed = errors.New("Storing repository failed")
 )
 
-// StorageHTTP stores data on a remote HTTP server
+// StorageHTTP stores data on a remote HTTP server. The user info of its URL
+// authenticates every request with basic auth
 type StorageHTTP struct {
 	URL string
 }
 
+func init() {
+	RegisterBackendType(&StorageHTTP{}, func(u url.URL) (Backend, error) {
+		return &StorageHTTP{
+			URL: u.String(),
+		}, nil
+	})
+}
+
 // Location returns the type and location of the repository
 func (backend *StorageHTTP) Location() string {
 	return backend.URL
@@ -51,12 +61,43 @@ func (backend *StorageHTTP) Description() string {
 	return "HTTP(S) Storage"
 }
 
+// Capabilities returns which optional operations the backend supports
+func (backend *StorageHTTP) Capabilities() Capabilities {
+	return Capabilities{List: true, Delete: true}
+}
+
+// AvailableSpace returns the free and the total space of the user's quota
+// on the server
+func (backend *StorageHTTP) AvailableSpace() (free, total uint64, err error) {
+	res, err := http.Get(backend.URL + "/space")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		// no quota configured, or a server predating this call
+		return 0, 0, ErrNotSupported
+	default:
+		return 0, 0, fmt.Errorf("Querying space failed: %s", res.Status)
+	}
+
+	var space struct {
+		Free  uint64 `json:"free"`
+		Total uint64 `json:"total"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&space)
+	return space.Free, space.Total, err
+}
+
 // LoadChunk loads a Chunk from network
 func (backend *StorageHTTP) LoadChunk(shasum string, part, totalParts uint) (*[]byte, error) {
 	//	fmt.Printf("Fetching from: %s.\n", backend.URL+"/download/"+chunk.ShaSum)
-	res, err := http.Get(backend.URL + "/download/" + shasum + "." + strconv.FormatUint(uint64(part), 10) + "_" + strconv.FormatUint(uint64(totalParts), 10))
+	res, err := http.Get(backend.URL + "/download/" + chunkName(shasum, part, totalParts))
 	if err != nil {
-		log.Fatal(err)
+		return &[]byte{}, err
 	}
 	defer res.Body.Close()
 
@@ -74,7 +115,7 @@ func (backend *StorageHTTP) StoreChunk(shasum string, part, totalParts uint, dat
 	bodyWriter := multipart.NewWriter(bodyBuf)
 
 	// this step is very important
-	fileWriter, werr := bodyWriter.CreateFormFile("uploadfile", shasum+"."+strconv.FormatUint(uint64(part), 10)+"_"+strconv.FormatUint(uint64(totalParts), 10))
+	fileWriter, werr := bodyWriter.CreateFormFile("uploadfile", chunkName(shasum, part, totalParts))
 	if werr != nil {
 		fmt.Println("error writing to buffer")
 		return 0, werr
@@ -105,12 +146,39 @@ func (backend *StorageHTTP) StoreChunk(shasum string, part, totalParts uint, dat
 	return uint64(len(*data)), err
 }
 
+// StatChunk returns the size of a stored Chunk
+func (backend *StorageHTTP) StatChunk(shasum string, part, totalParts uint) (size uint64, err error) {
+	res, err := http.Head(backend.URL + "/download/" + chunkName(shasum, part, totalParts))
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		return uint64(res.ContentLength), nil
+	case http.StatusNotFound:
+		return 0, ErrChunkNotFound
+	}
+	return 0, fmt.Errorf("Loading chunk failed: %s", res.Status)
+}
+
+// ListChunks returns the names of all stored chunk parts
+func (backend *StorageHTTP) ListChunks() ([]string, error) {
+	return backend.list("/chunks")
+}
+
+// DeleteChunk deletes a single Chunk
+func (backend *StorageHTTP) DeleteChunk(shasum string, part, totalParts uint) error {
+	return backend.delete("/download/" + chunkName(shasum, part, totalParts))
+}
+
 // LoadSnapshot loads a snapshot
 func (backend *StorageHTTP) LoadSnapshot(id string) ([]byte, error) {
 	//	fmt.Printf("Fetching snapshot from: %s.\n", backend.URL+"/snapshot/"+id)
 	res, err := http.Get(backend.URL + "/snapshot/" + id)
 	if err != nil {
-		log.Fatal(err)
+		return []byte{}, err
 	}
 	defer res.Body.Close()
 	b, err := ioutil.ReadAll(res.Body)
@@ -157,6 +225,16 @@ func (backend *StorageHTTP) SaveSnapshot(id string, data []byte) error {
 	return err
 }
 
+// ListSnapshots returns the IDs of all stored snapshots
+func (backend *StorageHTTP) ListSnapshots() ([]string, error) {
+	return backend.list("/snapshots")
+}
+
+// DeleteSnapshot deletes a snapshot
+func (backend *StorageHTTP) DeleteSnapshot(id string) error {
+	return backend.delete("/snapshot/" + id)
+}
+
 // InitRepository creates a new repository
 func (backend *StorageHTTP) InitRepository() error {
 	return nil
@@ -167,7 +245,7 @@ func (backend *StorageHTTP) LoadRepository() ([]byte, error) {
 	//	fmt.Printf("Fetching repository from: %s.\n", backend.URL+"/repository")
 	res, err := http.Get(backend.URL + "/repository")
 	if err != nil {
-		log.Fatal(err)
+		return []byte{}, err
 	}
 	defer res.Body.Close()
 	b, err := ioutil.ReadAll(res.Body)
@@ -213,3 +291,48 @@ func (backend *StorageHTTP) SaveRepository(data []byte) error {
 	//	fmt.Printf("Uploaded repository: %d bytes\n", len(data))
 	return err
 }
+
+// list fetches a list of names from the server
+func (backend *StorageHTTP) list(endpoint string) ([]string, error) {
+	names := []string{}
+	res, err := http.Get(backend.URL + endpoint)
+	if err != nil {
+		return names, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		// servers predating this call don't know the endpoint
+		return names, ErrNotSupported
+	default:
+		return names, fmt.Errorf("Listing %s failed: %s", endpoint, res.Status)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&names)
+	return names, err
+}
+
+// delete sends a DELETE request to the server
+func (backend *StorageHTTP) delete(endpoint string) error {
+	req, err := http.NewRequest("DELETE", backend.URL+endpoint, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return os.ErrNotExist
+	case http.StatusMethodNotAllowed:
+		return ErrNotSupported
+	}
+	return fmt.Errorf("Deleting %s failed: %s", endpoint, res.Status)
+}
@@ -9,11 +9,7 @@ package knoxite
 
 import (
 	"errors"
-	"fmt"
-	"io/ioutil"
-	"os"
-	"path/filepath"
-	"strconv"
+	"net/url"
 )
 
 const (
@@ -31,6 +27,31 @@ type StorageLocal struct {
 	//	repository Repository
 }
 
+func init() {
+	RegisterBackendType(&StorageLocal{}, func(u url.URL) (Backend, error) {
+		// local paths may contain characters with a special meaning in
+		// URLs, which get used as they are without being decoded
+		path := u.RawPath
+		if path == "" {
+			path = u.EscapedPath()
+		}
+		if u.RawQuery != "" || u.ForceQuery {
+			path += "?" + u.RawQuery
+		}
+		fragment := u.RawFragment
+		if fragment == "" {
+			fragment = u.EscapedFragment()
+		}
+		if fragment != "" {
+			path += "#" + fragment
+		}
+
+		return &StorageLocal{
+			Path: path,
+		}, nil
+	})
+}
+
 // Location returns the type and location of the repository
 func (backend *StorageLocal) Location() string {
 	return backend.Path
@@ -51,85 +72,77 @@ func (backend *StorageLocal) Description() string {
 	return "Local File Storage"
 }
 
+func (backend *StorageLocal) storage() *storageFileSystem {
+	return &storageFileSystem{fs: localFileSystem{}, Path: backend.Path}
+}
+
+// Capabilities returns which optional operations the backend supports
+func (backend *StorageLocal) Capabilities() Capabilities {
+	return backend.storage().Capabilities()
+}
+
+// AvailableSpace returns the free and the total space of the filesystem the
+// repository is stored on
+func (backend *StorageLocal) AvailableSpace() (free, total uint64, err error) {
+	return diskSpace(backend.Path)
+}
+
 // LoadChunk loads a Chunk from disk
 func (backend *StorageLocal) LoadChunk(shasum string, part, totalParts uint) (*[]byte, error) {
-	fileName := filepath.Join(backend.Path, "chunks", shasum+"."+strconv.FormatUint(uint64(part), 10)+"_"+strconv.FormatUint(uint64(totalParts), 10))
-	b := []byte{}
-	b, err := ioutil.ReadFile(fileName)
-	return &b, err
+	return backend.storage().LoadChunk(shasum, part, totalParts)
 }
 
 // StoreChunk stores a single Chunk on disk
 func (backend *StorageLocal) StoreChunk(shasum string, part, totalParts uint, data *[]byte) (size uint64, err error) {
-	fileName := filepath.Join(backend.Path, "chunks", shasum+"."+strconv.FormatUint(uint64(part), 10)+"_"+strconv.FormatUint(uint64(totalParts), 10))
-	if _, err = os.Stat(fileName); err == nil {
-		// Chunk is already stored
-		return 0, nil
-	}
+	return backend.storage().StoreChunk(shasum, part, totalParts, data)
+}
 
-	err = ioutil.WriteFile(fileName, *data, 0600)
-	if err != nil {
-		fmt.Println(err)
-	}
-	return uint64(len(*data)), err
+// StatChunk returns the size of a Chunk stored on disk
+func (backend *StorageLocal) StatChunk(shasum string, part, totalParts uint) (size uint64, err error) {
+	return backend.storage().StatChunk(shasum, part, totalParts)
+}
+
+// ListChunks returns the names of all stored chunk parts
+func (backend *StorageLocal) ListChunks() ([]string, error) {
+	return backend.storage().ListChunks()
+}
+
+// DeleteChunk deletes a single Chunk from disk
+func (backend *StorageLocal) DeleteChunk(shasum string, part, totalParts uint) error {
+	return backend.storage().DeleteChunk(shasum, part, totalParts)
 }
 
 // LoadSnapshot loads a snapshot
 func (backend *StorageLocal) LoadSnapshot(id string) ([]byte, error) {
-	b, err := ioutil.ReadFile(filepath.Join(backend.Path, "snapshots", id))
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	return b, err
+	return backend.storage().LoadSnapshot(id)
 }
 
 // SaveSnapshot stores a snapshot
 func (backend *StorageLocal) SaveSnapshot(id string, b []byte) error {
-	return ioutil.WriteFile(filepath.Join(backend.Path, "snapshots", id), b, 0600)
+	return backend.storage().SaveSnapshot(id, b)
+}
+
+// ListSnapshots returns the IDs of all stored snapshots
+func (backend *StorageLocal) ListSnapshots() ([]string, error) {
+	return backend.storage().ListSnapshots()
+}
+
+// DeleteSnapshot deletes a snapshot
+func (backend *StorageLocal) DeleteSnapshot(id string) error {
+	return backend.storage().DeleteSnapshot(id)
 }
 
 // InitRepository creates a new repository
 func (backend *StorageLocal) InitRepository() error {
-	fileName := filepath.Join(backend.Path, repoFilename)
-	if _, err := os.Stat(fileName); err == nil {
-		// Repo seems to already exist
-		return ErrRepositoryExists
-	}
-
-	return nil
+	return backend.storage().InitRepository()
 }
 
 // LoadRepository reads the metadata for a repository
 func (backend *StorageLocal) LoadRepository() ([]byte, error) {
-	b, err := ioutil.ReadFile(filepath.Join(backend.Path, repoFilename))
-	if err != nil {
-		fmt.Println(err)
-	}
-
-	return b, err
+	return backend.storage().LoadRepository()
 }
 
 // SaveRepository stores the metadata for a repository
 func (backend *StorageLocal) SaveRepository(b []byte) error {
-	fileName := filepath.Join(backend.Path, repoFilename)
-	err := ioutil.WriteFile(fileName, b, 0600)
-	if err == nil {
-		reqPaths := []string{"chunks", "snapshots"}
-		for _, reqPath := range reqPaths {
-			path := filepath.Join(backend.Path, reqPath)
-			if stat, serr := os.Stat(path); serr == nil {
-				if !stat.IsDir() {
-					return errors.New("Repository contains an invalid file named " + reqPath)
-				}
-			} else {
-				err = os.Mkdir(path, 0700)
-				if err != nil {
-					return err
-				}
-			}
-		}
-	}
-
-	return err
+	return backend.storage().SaveRepository(b)
 }
@@ -0,0 +1,343 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+)
+
+// StorageMemory keeps a repository in memory. All backends opened with the
+// same URL share their data for the lifetime of the process, so a repository
+// can be created and re-opened just like one stored on disk
+type StorageMemory struct {
+	url   url.URL
+	limit uint64
+
+	m          sync.RWMutex
+	chunks     map[string][]byte
+	snapshots  map[string][]byte
+	repository []byte
+	size       uint64
+}
+
+// Error declarations
+var (
+	ErrStorageFull = errors.New("Storage backend is full")
+)
+
+var (
+	memoryStoragesMutex sync.Mutex
+	memoryStorages      = make(map[string]*StorageMemory)
+)
+
+func init() {
+	RegisterBackendType(&StorageMemory{}, func(u url.URL) (Backend, error) {
+		return NewStorageMemory(u)
+	})
+}
+
+// NewStorageMemory returns the StorageMemory for a URL like mem://name. The
+// URL query parameter "size", e.g. "64M", limits how much data it accepts
+func NewStorageMemory(u url.URL) (*StorageMemory, error) {
+	if u.Host == "" {
+		return &StorageMemory{}, ErrInvalidRepositoryURL
+	}
+
+	var limit uint64
+	if size := u.Query().Get("size"); size != "" {
+		var err error
+		limit, err = ParseSize(size)
+		if err != nil {
+			return &StorageMemory{}, err
+		}
+	}
+
+	memoryStoragesMutex.Lock()
+	defer memoryStoragesMutex.Unlock()
+
+	backend, ok := memoryStorages[u.Host]
+	if !ok {
+		backend = &StorageMemory{
+			url:       u,
+			chunks:    make(map[string][]byte),
+			snapshots: make(map[string][]byte),
+		}
+		memoryStorages[u.Host] = backend
+	}
+
+	backend.m.Lock()
+	backend.limit = limit
+	backend.m.Unlock()
+	return backend, nil
+}
+
+// RemoveStorageMemory discards all data stored in the StorageMemory called
+// name
+func RemoveStorageMemory(name string) {
+	memoryStoragesMutex.Lock()
+	defer memoryStoragesMutex.Unlock()
+
+	delete(memoryStorages, name)
+}
+
+// Location returns the type and location of the repository
+func (backend *StorageMemory) Location() string {
+	return backend.url.String()
+}
+
+// Close the backend
+func (backend *StorageMemory) Close() error {
+	return nil
+}
+
+// Protocols returns the Protocol Schemes supported by this backend
+func (backend *StorageMemory) Protocols() []string {
+	return []string{"mem"}
+}
+
+// Description returns a user-friendly description for this backend
+func (backend *StorageMemory) Description() string {
+	return "In-Memory Storage"
+}
+
+// Capabilities returns which optional operations the backend supports
+func (backend *StorageMemory) Capabilities() Capabilities {
+	return Capabilities{List: true, Delete: true}
+}
+
+// AvailableSpace returns how much more data the backend accepts, if its size
+// is limited
+func (backend *StorageMemory) AvailableSpace() (free, total uint64, err error) {
+	backend.m.RLock()
+	defer backend.m.RUnlock()
+
+	if backend.limit == 0 {
+		return 0, 0, ErrNotSupported
+	}
+	if backend.size > backend.limit {
+		// e.g. after reopening it with a smaller size
+		return 0, backend.limit, nil
+	}
+	return backend.limit - backend.size, backend.limit, nil
+}
+
+// LoadChunk loads a Chunk
+func (backend *StorageMemory) LoadChunk(shasum string, part, totalParts uint) (*[]byte, error) {
+	b, ok := backend.load(backend.chunks, chunkName(shasum, part, totalParts))
+	if !ok {
+		return &[]byte{}, ErrChunkNotFound
+	}
+	return &b, nil
+}
+
+// StoreChunk stores a single Chunk
+func (backend *StorageMemory) StoreChunk(shasum string, part, totalParts uint, data *[]byte) (size uint64, err error) {
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	name := chunkName(shasum, part, totalParts)
+	if _, ok := backend.chunks[name]; ok {
+		// Chunk is already stored
+		return 0, nil
+	}
+
+	err = backend.store(backend.chunks, name, *data)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(len(*data)), nil
+}
+
+// StatChunk returns the size of a stored Chunk
+func (backend *StorageMemory) StatChunk(shasum string, part, totalParts uint) (size uint64, err error) {
+	backend.m.RLock()
+	defer backend.m.RUnlock()
+
+	b, ok := backend.chunks[chunkName(shasum, part, totalParts)]
+	if !ok {
+		return 0, ErrChunkNotFound
+	}
+	return uint64(len(b)), nil
+}
+
+// ListChunks returns the names of all stored chunk parts
+func (backend *StorageMemory) ListChunks() ([]string, error) {
+	return backend.list(backend.chunks), nil
+}
+
+// DeleteChunk deletes a single Chunk
+func (backend *StorageMemory) DeleteChunk(shasum string, part, totalParts uint) error {
+	return backend.delete(backend.chunks, chunkName(shasum, part, totalParts))
+}
+
+// LoadSnapshot loads a snapshot
+func (backend *StorageMemory) LoadSnapshot(id string) ([]byte, error) {
+	b, ok := backend.load(backend.snapshots, id)
+	if !ok {
+		return []byte{}, ErrSnapshotNotFound
+	}
+	return b, nil
+}
+
+// SaveSnapshot stores a snapshot
+func (backend *StorageMemory) SaveSnapshot(id string, data []byte) error {
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	return backend.store(backend.snapshots, id, data)
+}
+
+// ListSnapshots returns the IDs of all stored snapshots
+func (backend *StorageMemory) ListSnapshots() ([]string, error) {
+	return backend.list(backend.snapshots), nil
+}
+
+// DeleteSnapshot deletes a snapshot
+func (backend *StorageMemory) DeleteSnapshot(id string) error {
+	return backend.delete(backend.snapshots, id)
+}
+
+// InitRepository creates a new repository
+func (backend *StorageMemory) InitRepository() error {
+	backend.m.RLock()
+	defer backend.m.RUnlock()
+
+	if backend.repository != nil {
+		return ErrRepositoryExists
+	}
+	return nil
+}
+
+// LoadRepository reads the metadata for a repository
+func (backend *StorageMemory) LoadRepository() ([]byte, error) {
+	backend.m.RLock()
+	defer backend.m.RUnlock()
+
+	if backend.repository == nil {
+		return []byte{}, ErrLoadRepositoryFailed
+	}
+	return copyBytes(backend.repository), nil
+}
+
+// SaveRepository stores the metadata for a repository
+func (backend *StorageMemory) SaveRepository(data []byte) error {
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	if err := backend.reserve(uint64(len(backend.repository)), uint64(len(data))); err != nil {
+		return err
+	}
+	backend.repository = copyBytes(data)
+	return nil
+}
+
+// Size returns how many bytes are stored
+func (backend *StorageMemory) Size() uint64 {
+	backend.m.RLock()
+	defer backend.m.RUnlock()
+
+	return backend.size
+}
+
+// RawChunk returns the stored data of a chunk part, as named by ListChunks
+func (backend *StorageMemory) RawChunk(name string) ([]byte, bool) {
+	return backend.load(backend.chunks, name)
+}
+
+// SetRawChunk replaces the stored data of a chunk part, ignoring the size
+// limit. This allows tests to simulate corrupted storage
+func (backend *StorageMemory) SetRawChunk(name string, data []byte) {
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	backend.size -= uint64(len(backend.chunks[name]))
+	backend.size += uint64(len(data))
+	backend.chunks[name] = copyBytes(data)
+}
+
+// CorruptChunk flips a bit in the stored data of a chunk part
+func (backend *StorageMemory) CorruptChunk(name string, offset int) error {
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	b, ok := backend.chunks[name]
+	if !ok {
+		return ErrChunkNotFound
+	}
+	if offset < 0 || offset >= len(b) {
+		return errors.New("Offset out of range")
+	}
+	b[offset] ^= 0x01
+	return nil
+}
+
+// load returns a copy of an object
+func (backend *StorageMemory) load(objects map[string][]byte, name string) ([]byte, bool) {
+	backend.m.RLock()
+	defer backend.m.RUnlock()
+
+	b, ok := objects[name]
+	if !ok {
+		return []byte{}, false
+	}
+	return copyBytes(b), true
+}
+
+// store saves a copy of an object. The caller must hold the write lock
+func (backend *StorageMemory) store(objects map[string][]byte, name string, data []byte) error {
+	if err := backend.reserve(uint64(len(objects[name])), uint64(len(data))); err != nil {
+		return err
+	}
+	objects[name] = copyBytes(data)
+	return nil
+}
+
+// reserve accounts for replacing an object of size old with one of size new.
+// The caller must hold the write lock
+func (backend *StorageMemory) reserve(old, new uint64) error {
+	if backend.limit > 0 && backend.size-old+new > backend.limit {
+		return ErrStorageFull
+	}
+	backend.size = backend.size - old + new
+	return nil
+}
+
+func (backend *StorageMemory) delete(objects map[string][]byte, name string) error {
+	backend.m.Lock()
+	defer backend.m.Unlock()
+
+	b, ok := objects[name]
+	if !ok {
+		return os.ErrNotExist
+	}
+	backend.size -= uint64(len(b))
+	delete(objects, name)
+	return nil
+}
+
+func (backend *StorageMemory) list(objects map[string][]byte) []string {
+	backend.m.RLock()
+	defer backend.m.RUnlock()
+
+	names := []string{}
+	for name := range objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func copyBytes(b []byte) []byte {
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
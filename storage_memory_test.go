@@ -0,0 +1,273 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+func newTestStorageMemory(t *testing.T, u string) *StorageMemory {
+	backend, err := BackendFromURL(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return backend.(*StorageMemory)
+}
+
+func TestStorageMemory(t *testing.T) {
+	defer RemoveStorageMemory("test")
+	backend := newTestStorageMemory(t, "mem://test")
+
+	if _, err := BackendFromURL("mem://"); err != ErrInvalidRepositoryURL {
+		t.Errorf("Expected %v, got %v", ErrInvalidRepositoryURL, err)
+	}
+	if _, err := backend.LoadRepository(); err != ErrLoadRepositoryFailed {
+		t.Errorf("Expected %v, got %v", ErrLoadRepositoryFailed, err)
+	}
+	if err := backend.InitRepository(); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.SaveRepository([]byte("repository")); err != nil {
+		t.Fatal(err)
+	}
+
+	// backends with the same name share their data
+	other := newTestStorageMemory(t, "mem://test")
+	if err := other.InitRepository(); err != ErrRepositoryExists {
+		t.Errorf("Expected %v, got %v", ErrRepositoryExists, err)
+	}
+	b, err := other.LoadRepository()
+	if err != nil || string(b) != "repository" {
+		t.Errorf("Expected repository data, got %s (%v)", b, err)
+	}
+
+	data := []byte("chunk")
+	if size, err := backend.StoreChunk("abc", 0, 1, &data); err != nil || size != uint64(len(data)) {
+		t.Errorf("Expected size %d, got %d (%v)", len(data), size, err)
+	}
+	if size, _ := backend.StoreChunk("abc", 0, 1, &data); size != 0 {
+		t.Errorf("Expected already stored chunk to be skipped, got size %d", size)
+	}
+
+	// stored data must not change when the caller modifies its buffer
+	data[0] = 'X'
+	c, err := backend.LoadChunk("abc", 0, 1)
+	if err != nil || string(*c) != "chunk" {
+		t.Errorf("Expected chunk data, got %s (%v)", *c, err)
+	}
+	(*c)[0] = 'X'
+	if raw, _ := backend.RawChunk(chunkName("abc", 0, 1)); string(raw) != "chunk" {
+		t.Errorf("Expected chunk data, got %s", raw)
+	}
+
+	if size, err := backend.StatChunk("abc", 0, 1); err != nil || size != 5 {
+		t.Errorf("Expected size 5, got %d (%v)", size, err)
+	}
+	if _, err := backend.StatChunk("missing", 0, 1); err != ErrChunkNotFound {
+		t.Errorf("Expected %v, got %v", ErrChunkNotFound, err)
+	}
+	names, _ := backend.ListChunks()
+	if len(names) != 1 || names[0] != chunkName("abc", 0, 1) {
+		t.Errorf("Unexpected chunk list: %v", names)
+	}
+
+	if err := backend.CorruptChunk(chunkName("abc", 0, 1), 0); err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := backend.RawChunk(chunkName("abc", 0, 1)); string(raw) != "bhunk" {
+		t.Errorf("Expected corrupted chunk data, got %s", raw)
+	}
+
+	if err := backend.SaveSnapshot("snap", []byte("snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	ids, _ := backend.ListSnapshots()
+	if len(ids) != 1 || ids[0] != "snap" {
+		t.Errorf("Unexpected snapshot list: %v", ids)
+	}
+	if backend.Size() != uint64(len("repository")+len("chunk")+len("snapshot")) {
+		t.Errorf("Unexpected size %d", backend.Size())
+	}
+
+	if err := backend.DeleteChunk("abc", 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.DeleteChunk("abc", 0, 1); !os.IsNotExist(err) {
+		t.Errorf("Expected chunk to be missing, got %v", err)
+	}
+	if err := backend.DeleteSnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.LoadSnapshot("snap"); err != ErrSnapshotNotFound {
+		t.Errorf("Expected %v, got %v", ErrSnapshotNotFound, err)
+	}
+	if backend.Size() != uint64(len("repository")) {
+		t.Errorf("Unexpected size %d", backend.Size())
+	}
+}
+
+func TestStorageMemoryLimit(t *testing.T) {
+	defer RemoveStorageMemory("limited")
+	backend := newTestStorageMemory(t, "mem://limited?size=1K")
+
+	data := make([]byte, 600)
+	if _, err := backend.StoreChunk("abc", 0, 1, &data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.StoreChunk("def", 0, 1, &data); err != ErrStorageFull {
+		t.Errorf("Expected %v, got %v", ErrStorageFull, err)
+	}
+	if err := backend.DeleteChunk("abc", 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.StoreChunk("def", 0, 1, &data); err != nil {
+		t.Errorf("Expected enough space after deleting a chunk, got %v", err)
+	}
+
+	// reopening with a smaller size leaves no space
+	backend = newTestStorageMemory(t, "mem://limited?size=512")
+	if free, total, err := backend.AvailableSpace(); err != nil || free != 0 || total != 512 {
+		t.Errorf("Expected 0 of 512 bytes free, got %d of %d (%v)", free, total, err)
+	}
+}
+
+func TestStorageMemoryConcurrent(t *testing.T) {
+	defer RemoveStorageMemory("concurrent")
+	backend := newTestStorageMemory(t, "mem://concurrent")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := []byte(fmt.Sprintf("chunk %d", i))
+			shasum := fmt.Sprintf("%064x", i)
+			if _, err := backend.StoreChunk(shasum, 0, 1, &data); err != nil {
+				t.Error(err)
+			}
+			if _, err := backend.LoadChunk(shasum, 0, 1); err != nil {
+				t.Error(err)
+			}
+			backend.ListChunks()
+		}(i)
+	}
+	wg.Wait()
+
+	names, _ := backend.ListChunks()
+	if len(names) != 16 {
+		t.Errorf("Expected 16 chunks, got %d", len(names))
+	}
+}
+
+// storeMemorySnapshot creates a repository on the given in-memory backends
+// and stores a snapshot of file in it
+func storeMemorySnapshot(t *testing.T, urls []string, file string, dataParts, parityParts uint) Repository {
+	r, err := NewRepository(urls[0], "this_is_a_password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, u := range urls[1:] {
+		backend, err := BackendFromURL(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Backend.AddBackend(&backend)
+	}
+	vol, err := NewVolume("test_name", "test_description")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.AddVolume(vol)
+
+	addMemorySnapshot(t, &r, file, dataParts, parityParts)
+	return r
+}
+
+// addMemorySnapshot stores file in a new snapshot of the repository's first
+// volume
+func addMemorySnapshot(t *testing.T, r *Repository, file string, dataParts, parityParts uint) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot, err := NewSnapshot("test_snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	progress, err := snapshot.Add(wd, []string{file}, *r, false, true, dataParts, parityParts, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range progress {
+	}
+	snapshot.Save(r)
+	r.Volumes[0].AddSnapshot(snapshot.ID)
+	if err := r.Save(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorageMemoryCorruption(t *testing.T) {
+	defer RemoveStorageMemory("corrupt")
+	r := storeMemorySnapshot(t, []string{"mem://corrupt"}, "storage_memory_test.go", 1, 0)
+
+	// the repository can be re-opened from memory
+	r, err := OpenRepository("mem://corrupt", "this_is_a_password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err := r.Check(1.0)
+	if err != nil || len(stats.Errors) != 0 {
+		t.Fatalf("Expected no errors, got %v (%v)", stats.Errors, err)
+	}
+
+	backend := newTestStorageMemory(t, "mem://corrupt")
+	names, _ := backend.ListChunks()
+	if err := backend.CorruptChunk(names[0], 42); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = r.Check(1.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Errors) == 0 {
+		t.Error("Expected corrupted chunk to be detected")
+	}
+}
+
+func TestStorageMemoryRedundancy(t *testing.T) {
+	urls := []string{"mem://redundant1", "mem://redundant2", "mem://redundant3"}
+	for _, u := range urls {
+		defer RemoveStorageMemory(u[len("mem://"):])
+	}
+	r := storeMemorySnapshot(t, urls, "storage_memory_test.go", 2, 1)
+
+	// lose all data stored on one of the backends
+	backend := newTestStorageMemory(t, urls[1])
+	names, _ := backend.ListChunks()
+	for _, name := range names {
+		shasum, part, total, err := ParseChunkName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := backend.DeleteChunk(shasum, part, total); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats, err := r.Check(1.0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Errors) != 0 {
+		t.Errorf("Expected no errors after losing one backend, got %v", stats.Errors)
+	}
+}
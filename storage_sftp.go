@@ -0,0 +1,239 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// StorageSFTP stores data on a remote host via SFTP. It uses the same
+// directory layout as StorageLocal
+type StorageSFTP struct {
+	storageFileSystem
+
+	url    url.URL
+	ssh    *ssh.Client
+	client *sftp.Client
+}
+
+func init() {
+	RegisterBackendType(&StorageSFTP{}, func(u url.URL) (Backend, error) {
+		return NewStorageSFTP(u)
+	})
+}
+
+// NewStorageSFTP connects to an SSH server and returns a StorageSFTP object.
+// Authentication happens via ssh-agent, the user's private keys in ~/.ssh or
+// the key file given in the URL's "key" parameter, and a password if the
+// URL contains one. The server's host key gets verified with the user's
+// known_hosts file, or the one given in the "known_hosts" parameter
+func NewStorageSFTP(u url.URL) (*StorageSFTP, error) {
+	home := ""
+	username := u.User.Username()
+	if usr, err := user.Current(); err == nil {
+		home = usr.HomeDir
+		if username == "" {
+			username = usr.Username
+		}
+	}
+
+	knownHostsFile := u.Query().Get("known_hosts")
+	if knownHostsFile == "" {
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	auth := []ssh.AuthMethod{}
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if agentConn, err := net.Dial("unix", sock); err == nil {
+			// the agent is only needed while authenticating
+			defer agentConn.Close()
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+		}
+	}
+	keyAuth, err := sftpKeyAuth(u, home)
+	if err != nil {
+		return nil, err
+	}
+	auth = append(auth, keyAuth...)
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(host, "22")
+	}
+	conn, err := ssh.Dial("tcp", host, &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &StorageSFTP{
+		storageFileSystem: storageFileSystem{
+			fs:   sftpFileSystem{client},
+			Path: u.Path,
+		},
+		url:    u,
+		ssh:    conn,
+		client: client,
+	}, nil
+}
+
+// sftpKeyAuth returns the authentication methods using private keys and passwords
+func sftpKeyAuth(u url.URL, home string) ([]ssh.AuthMethod, error) {
+	auth := []ssh.AuthMethod{}
+	signers := []ssh.Signer{}
+	if keyFile := u.Query().Get("key"); keyFile != "" {
+		b, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			return auth, err
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return auth, err
+		}
+		signers = append(signers, signer)
+	} else {
+		// missing or passphrase protected default keys get skipped
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			b, err := ioutil.ReadFile(filepath.Join(home, ".ssh", name))
+			if err != nil {
+				continue
+			}
+			if signer, err := ssh.ParsePrivateKey(b); err == nil {
+				signers = append(signers, signer)
+			}
+		}
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+
+	if pw, ok := u.User.Password(); ok {
+		auth = append(auth, ssh.Password(pw))
+	}
+
+	return auth, nil
+}
+
+// Location returns the type and location of the repository
+func (backend *StorageSFTP) Location() string {
+	return backend.url.String()
+}
+
+// Close the backend
+func (backend *StorageSFTP) Close() error {
+	err := backend.client.Close()
+	if serr := backend.ssh.Close(); err == nil {
+		err = serr
+	}
+
+	return err
+}
+
+// Protocols returns the Protocol Schemes supported by this backend
+func (backend *StorageSFTP) Protocols() []string {
+	return []string{"sftp"}
+}
+
+// Description returns a user-friendly description for this backend
+func (backend *StorageSFTP) Description() string {
+	return "SSH/SFTP Storage"
+}
+
+// AvailableSpace returns the free and the total space of the remote
+// filesystem, if the server supports the statvfs extension
+func (backend *StorageSFTP) AvailableSpace() (free, total uint64, err error) {
+	st, err := backend.client.StatVFS(backend.Path)
+	if err != nil {
+		return 0, 0, ErrNotSupported
+	}
+
+	return st.Bavail * st.Frsize, st.Blocks * st.Frsize, nil
+}
+
+// sftpFileSystem accesses files on a remote host via SFTP
+type sftpFileSystem struct {
+	client *sftp.Client
+}
+
+func (fs sftpFileSystem) ReadFile(name string) ([]byte, error) {
+	f, err := fs.client.Open(name)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer f.Close()
+
+	return ioutil.ReadAll(f)
+}
+
+func (fs sftpFileSystem) WriteFile(name string, data []byte, perm os.FileMode) error {
+	f, err := fs.client.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return fs.client.Chmod(name, perm)
+}
+
+func (fs sftpFileSystem) Stat(name string) (os.FileInfo, error) {
+	return fs.client.Stat(name)
+}
+
+func (fs sftpFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	return fs.client.ReadDir(name)
+}
+
+func (fs sftpFileSystem) Remove(name string) error {
+	return fs.client.Remove(name)
+}
+
+func (fs sftpFileSystem) Mkdir(name string, perm os.FileMode) error {
+	err := fs.client.Mkdir(name)
+	if err != nil {
+		return err
+	}
+
+	return fs.client.Chmod(name, perm)
+}
+
+func (fs sftpFileSystem) Join(elem ...string) string {
+	return path.Join(elem...)
+}
@@ -0,0 +1,266 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpTestServer is an in-process SSH server providing the sftp subsystem
+type sftpTestServer struct {
+	listener net.Listener
+	hostKey  ssh.Signer
+	dir      string
+	keyFile  string
+}
+
+func newTestSigner(t *testing.T) (ssh.Signer, ed25519.PrivateKey) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer, priv
+}
+
+func newSFTPTestServer(t *testing.T) *sftpTestServer {
+	dir, err := ioutil.TempDir("", "knoxite")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client's key, which is the only one the server accepts
+	clientKey, priv := newTestSigner(t)
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, "id_ed25519")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	hostKey, _ := newTestSigner(t)
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), clientKey.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown public key")
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sftpTestServer{
+		listener: l,
+		hostKey:  hostKey,
+		dir:      dir,
+		keyFile:  keyFile,
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+
+	return s
+}
+
+func (s *sftpTestServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						channel.Close()
+						return
+					}
+					go func() {
+						server.Serve()
+						channel.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+func (s *sftpTestServer) Close() {
+	s.listener.Close()
+	os.RemoveAll(s.dir)
+}
+
+// writeKnownHosts creates a known_hosts file containing key for the server
+func (s *sftpTestServer) writeKnownHosts(t *testing.T, key ssh.PublicKey) string {
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.listener.Addr().String())}, key)
+	fileName := filepath.Join(s.dir, "known_hosts")
+	if err := ioutil.WriteFile(fileName, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func (s *sftpTestServer) URL(knownHosts string) url.URL {
+	q := url.Values{}
+	q.Set("key", s.keyFile)
+	q.Set("known_hosts", knownHosts)
+	return url.URL{
+		Scheme:   "sftp",
+		User:     url.User("knoxite"),
+		Host:     s.listener.Addr().String(),
+		Path:     filepath.ToSlash(filepath.Join(s.dir, "repo")),
+		RawQuery: q.Encode(),
+	}
+}
+
+func TestStorageSFTP(t *testing.T) {
+	// don't use the user's ssh-agent during tests
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	os.Unsetenv("SSH_AUTH_SOCK")
+	defer os.Setenv("SSH_AUTH_SOCK", sock)
+
+	server := newSFTPTestServer(t)
+	defer server.Close()
+	if err := os.Mkdir(filepath.Join(server.dir, "repo"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	u := server.URL(server.writeKnownHosts(t, server.hostKey.PublicKey()))
+	be, err := BackendFromURL(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := be.(*StorageSFTP)
+	defer backend.Close()
+
+	if err := backend.InitRepository(); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.SaveRepository([]byte("repository")); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.InitRepository(); err != ErrRepositoryExists {
+		t.Errorf("Expected %v, got %v", ErrRepositoryExists, err)
+	}
+
+	// the data must end up in the same layout as a local repository
+	local := &StorageLocal{Path: filepath.Join(server.dir, "repo")}
+	b, err := local.LoadRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "repository" {
+		t.Errorf("Expected repository data, got %s", b)
+	}
+
+	data := []byte("chunk")
+	size, err := backend.StoreChunk("abc", 0, 1, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != uint64(len(data)) {
+		t.Errorf("Expected size %d, got %d", len(data), size)
+	}
+	if size, _ = backend.StoreChunk("abc", 0, 1, &data); size != 0 {
+		t.Errorf("Expected already stored chunk to be skipped, got size %d", size)
+	}
+	lb, err := local.LoadChunk("abc", 0, 1)
+	if err != nil || !bytes.Equal(*lb, data) {
+		t.Errorf("Expected chunk to be stored locally, got %s (%v)", *lb, err)
+	}
+	names, err := backend.ListChunks()
+	if err != nil || len(names) != 1 || names[0] != chunkName("abc", 0, 1) {
+		t.Errorf("Unexpected chunk list %v (%v)", names, err)
+	}
+	if size, err = backend.StatChunk("abc", 0, 1); err != nil || size != uint64(len(data)) {
+		t.Errorf("Expected size %d, got %d (%v)", len(data), size, err)
+	}
+	if err := backend.DeleteChunk("abc", 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.LoadChunk("abc", 0, 1); !os.IsNotExist(err) {
+		t.Errorf("Expected chunk to be deleted, got %v", err)
+	}
+	if _, err := backend.StatChunk("abc", 0, 1); err != ErrChunkNotFound {
+		t.Errorf("Expected %v, got %v", ErrChunkNotFound, err)
+	}
+
+	if err := backend.SaveSnapshot("snap", []byte("snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	b, err = backend.LoadSnapshot("snap")
+	if err != nil || string(b) != "snapshot" {
+		t.Errorf("Expected snapshot data, got %s (%v)", b, err)
+	}
+	ids, err := backend.ListSnapshots()
+	if err != nil || len(ids) != 1 || ids[0] != "snap" {
+		t.Errorf("Unexpected snapshot list %v (%v)", ids, err)
+	}
+	if err := backend.DeleteSnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStorageSFTPUnknownHost(t *testing.T) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	os.Unsetenv("SSH_AUTH_SOCK")
+	defer os.Setenv("SSH_AUTH_SOCK", sock)
+
+	server := newSFTPTestServer(t)
+	defer server.Close()
+
+	otherKey, _ := newTestSigner(t)
+	u := server.URL(server.writeKnownHosts(t, otherKey.PublicKey()))
+	if _, err := NewStorageSFTP(u); err == nil {
+		t.Error("Expected connecting to a host with an unknown key to fail")
+	}
+}
@@ -0,0 +1,503 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// StorageWebDAV stores data on a WebDAV server
+type StorageWebDAV struct {
+	url      url.URL
+	base     url.URL
+	username string
+	password string
+	client   *http.Client
+	insecure bool
+
+	// auth state, set once the server asked for credentials
+	basic  bool
+	digest *digestChallenge
+	nc     uint32
+	m      sync.Mutex
+}
+
+// ErrInsecureAuth is returned if a server asks for a password in cleartext
+var ErrInsecureAuth = errors.New("WebDAV server requires basic auth over an unencrypted connection, use a webdavs:// URL or add ?insecure=1 to allow it")
+
+func init() {
+	RegisterBackendType(&StorageWebDAV{}, func(u url.URL) (Backend, error) {
+		return NewStorageWebDAV(u)
+	})
+}
+
+type digestChallenge struct {
+	realm  string
+	nonce  string
+	opaque string
+	qop    string
+	algo   string
+}
+
+// davMultistatus is the response to a PROPFIND request
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+const davPropfindBody = `<?xml version="1.0" encoding="utf-8"?><propfind xmlns="DAV:"><prop><resourcetype/></prop></propfind>`
+
+// NewStorageWebDAV returns a StorageWebDAV object for a webdav:// or
+// webdavs:// URL. Credentials in the URL are used for basic or digest auth,
+// whichever the server asks for. They are only sent after the server asked
+// for them, and only in cleartext over unencrypted connections if the URL
+// contains insecure=1
+func NewStorageWebDAV(u url.URL) (*StorageWebDAV, error) {
+	backend := &StorageWebDAV{
+		url:    u,
+		base:   u,
+		client: &http.Client{},
+	}
+
+	switch u.Scheme {
+	case "webdav":
+		backend.base.Scheme = "http"
+	case "webdavs":
+		backend.base.Scheme = "https"
+	default:
+		return nil, ErrInvalidRepositoryURL
+	}
+	if u.User != nil {
+		backend.username = u.User.Username()
+		backend.password, _ = u.User.Password()
+	}
+	backend.insecure = u.Query().Get("insecure") == "1"
+	backend.base.User = nil
+	backend.base.RawQuery = ""
+	backend.base.Fragment = ""
+
+	return backend, nil
+}
+
+// Location returns the type and location of the repository
+func (backend *StorageWebDAV) Location() string {
+	return backend.url.String()
+}
+
+// Close the backend
+func (backend *StorageWebDAV) Close() error {
+	return nil
+}
+
+// Protocols returns the Protocol Schemes supported by this backend
+func (backend *StorageWebDAV) Protocols() []string {
+	return []string{"webdav", "webdavs"}
+}
+
+// Description returns a user-friendly description for this backend
+func (backend *StorageWebDAV) Description() string {
+	return "WebDAV Storage"
+}
+
+// Capabilities returns which optional operations the backend supports
+func (backend *StorageWebDAV) Capabilities() Capabilities {
+	return Capabilities{List: true, Delete: true}
+}
+
+// LoadChunk loads a Chunk from network
+func (backend *StorageWebDAV) LoadChunk(shasum string, part, totalParts uint) (*[]byte, error) {
+	b, err := backend.get(path.Join("chunks", chunkName(shasum, part, totalParts)))
+	if os.IsNotExist(err) {
+		err = ErrChunkNotFound
+	}
+	return &b, err
+}
+
+// StoreChunk stores a single Chunk on network
+func (backend *StorageWebDAV) StoreChunk(shasum string, part, totalParts uint, data *[]byte) (size uint64, err error) {
+	err = backend.put(path.Join("chunks", chunkName(shasum, part, totalParts)), *data)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(len(*data)), nil
+}
+
+// StatChunk returns the size of a stored Chunk
+func (backend *StorageWebDAV) StatChunk(shasum string, part, totalParts uint) (size uint64, err error) {
+	name := path.Join("chunks", chunkName(shasum, part, totalParts))
+	resp, err := backend.do("HEAD", name, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return uint64(resp.ContentLength), nil
+	case http.StatusNotFound:
+		return 0, ErrChunkNotFound
+	}
+	return 0, fmt.Errorf("Loading %s failed: %s", name, resp.Status)
+}
+
+// ListChunks returns the names of all stored chunk parts
+func (backend *StorageWebDAV) ListChunks() ([]string, error) {
+	return backend.list("chunks")
+}
+
+// DeleteChunk deletes a single Chunk
+func (backend *StorageWebDAV) DeleteChunk(shasum string, part, totalParts uint) error {
+	return backend.delete(path.Join("chunks", chunkName(shasum, part, totalParts)))
+}
+
+// LoadSnapshot loads a snapshot
+func (backend *StorageWebDAV) LoadSnapshot(id string) ([]byte, error) {
+	b, err := backend.get(path.Join("snapshots", id))
+	if os.IsNotExist(err) {
+		err = ErrSnapshotNotFound
+	}
+	return b, err
+}
+
+// SaveSnapshot stores a snapshot
+func (backend *StorageWebDAV) SaveSnapshot(id string, data []byte) error {
+	return backend.put(path.Join("snapshots", id), data)
+}
+
+// ListSnapshots returns the IDs of all stored snapshots
+func (backend *StorageWebDAV) ListSnapshots() ([]string, error) {
+	return backend.list("snapshots")
+}
+
+// DeleteSnapshot deletes a snapshot
+func (backend *StorageWebDAV) DeleteSnapshot(id string) error {
+	return backend.delete(path.Join("snapshots", id))
+}
+
+// InitRepository creates a new repository
+func (backend *StorageWebDAV) InitRepository() error {
+	if _, err := backend.get(repoFilename); err == nil {
+		// Repo seems to already exist
+		return ErrRepositoryExists
+	}
+
+	for _, dir := range []string{"", "chunks", "snapshots"} {
+		resp, err := backend.do("MKCOL", dir+"/", nil, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		// 405 means the collection already exists
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			return fmt.Errorf("Creating collection %s failed: %s", dir, resp.Status)
+		}
+	}
+
+	return nil
+}
+
+// LoadRepository reads the metadata for a repository
+func (backend *StorageWebDAV) LoadRepository() ([]byte, error) {
+	b, err := backend.get(repoFilename)
+	if os.IsNotExist(err) {
+		err = ErrLoadRepositoryFailed
+	}
+	return b, err
+}
+
+// SaveRepository stores the metadata for a repository
+func (backend *StorageWebDAV) SaveRepository(data []byte) error {
+	return backend.put(repoFilename, data)
+}
+
+func (backend *StorageWebDAV) get(name string) ([]byte, error) {
+	resp, err := backend.do("GET", name, nil, nil)
+	if err != nil {
+		return []byte{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return ioutil.ReadAll(resp.Body)
+	case http.StatusNotFound:
+		return []byte{}, os.ErrNotExist
+	}
+	return []byte{}, fmt.Errorf("Loading %s failed: %s", name, resp.Status)
+}
+
+func (backend *StorageWebDAV) put(name string, data []byte) error {
+	resp, err := backend.do("PUT", name, data, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("Storing %s failed: %s", name, resp.Status)
+	}
+	return nil
+}
+
+func (backend *StorageWebDAV) delete(name string) error {
+	resp, err := backend.do("DELETE", name, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return os.ErrNotExist
+	}
+	return fmt.Errorf("Deleting %s failed: %s", name, resp.Status)
+}
+
+// list returns the names of all files in a collection
+func (backend *StorageWebDAV) list(dir string) ([]string, error) {
+	names := []string{}
+	resp, err := backend.do("PROPFIND", dir+"/", []byte(davPropfindBody), map[string]string{
+		"Depth":        "1",
+		"Content-Type": "application/xml",
+	})
+	if err != nil {
+		return names, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return names, fmt.Errorf("Listing %s failed: %s", dir, resp.Status)
+	}
+
+	ms := davMultistatus{}
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return names, err
+	}
+	for _, r := range ms.Responses {
+		collection := false
+		for _, ps := range r.Propstat {
+			if ps.Prop.ResourceType.Collection != nil {
+				collection = true
+			}
+		}
+		if collection || strings.HasSuffix(r.Href, "/") {
+			continue
+		}
+
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return names, err
+		}
+		names = append(names, path.Base(href.Path))
+	}
+
+	return names, nil
+}
+
+// do sends a request for name, relative to the repository's location. It
+// takes care of authentication, retrying with credentials when the server
+// asks for them
+func (backend *StorageWebDAV) do(method, name string, body []byte, header map[string]string) (*http.Response, error) {
+	u := backend.base
+	u.Path = path.Join(u.Path, name)
+	if strings.HasSuffix(name, "/") {
+		u.Path += "/"
+	}
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		backend.authorize(req)
+
+		resp, err := backend.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		challenge := authChallenge(resp.Header)
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 || backend.username == "" || challenge == "" {
+			if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+				resp.Body.Close()
+				return nil, ErrAccessDenied
+			}
+			return resp, nil
+		}
+
+		// the server wants credentials or the nonce expired: retry once
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		digest := strings.HasPrefix(strings.ToLower(challenge), "digest ")
+		if !digest && backend.base.Scheme != "https" && !backend.insecure {
+			return nil, ErrInsecureAuth
+		}
+
+		backend.m.Lock()
+		if digest {
+			backend.digest = parseDigestChallenge(challenge)
+			backend.nc = 0
+		} else {
+			if !backend.basic && backend.base.Scheme != "https" {
+				fmt.Fprintf(os.Stderr, "warning: sending the password for %s unencrypted\n", backend.base.Host)
+			}
+			backend.basic = true
+		}
+		backend.m.Unlock()
+	}
+}
+
+// authChallenge returns the auth challenge of a response, preferring digest
+// over basic auth, or an empty string if there's none knoxite supports
+func authChallenge(header http.Header) string {
+	basic := ""
+	for _, challenge := range header.Values("WWW-Authenticate") {
+		scheme := strings.ToLower(challenge)
+		if strings.HasPrefix(scheme, "digest ") {
+			return challenge
+		}
+		if strings.HasPrefix(scheme, "basic") {
+			basic = challenge
+		}
+	}
+
+	return basic
+}
+
+// authorize adds credentials to req
+func (backend *StorageWebDAV) authorize(req *http.Request) {
+	if backend.username == "" {
+		return
+	}
+
+	backend.m.Lock()
+	defer backend.m.Unlock()
+	if backend.digest == nil {
+		if backend.basic {
+			req.SetBasicAuth(backend.username, backend.password)
+		}
+		return
+	}
+
+	d := backend.digest
+	backend.nc++
+	nc := fmt.Sprintf("%08x", backend.nc)
+	cnonce := make([]byte, 8)
+	rand.Read(cnonce)
+	cn := hex.EncodeToString(cnonce)
+
+	ha1 := md5Hex(backend.username + ":" + d.realm + ":" + backend.password)
+	if strings.EqualFold(d.algo, "MD5-sess") {
+		ha1 = md5Hex(ha1 + ":" + d.nonce + ":" + cn)
+	}
+	ha2 := md5Hex(req.Method + ":" + req.URL.RequestURI())
+
+	var response string
+	auth := fmt.Sprintf(`Digest username="%s", realm="%s", nonce="%s", uri="%s"`,
+		backend.username, d.realm, d.nonce, req.URL.RequestURI())
+	if d.qop != "" {
+		response = md5Hex(ha1 + ":" + d.nonce + ":" + nc + ":" + cn + ":auth:" + ha2)
+		auth += fmt.Sprintf(`, qop=auth, nc=%s, cnonce="%s"`, nc, cn)
+	} else {
+		response = md5Hex(ha1 + ":" + d.nonce + ":" + ha2)
+	}
+	auth += fmt.Sprintf(`, response="%s"`, response)
+	if d.opaque != "" {
+		auth += fmt.Sprintf(`, opaque="%s"`, d.opaque)
+	}
+	if d.algo != "" {
+		auth += ", algorithm=" + d.algo
+	}
+
+	req.Header.Set("Authorization", auth)
+}
+
+// parseDigestChallenge parses the parameters of a WWW-Authenticate header
+func parseDigestChallenge(header string) *digestChallenge {
+	params := parseAuthParams(header[len("Digest "):])
+	d := &digestChallenge{
+		realm:  params["realm"],
+		nonce:  params["nonce"],
+		opaque: params["opaque"],
+		algo:   params["algorithm"],
+	}
+	for _, qop := range strings.Split(params["qop"], ",") {
+		if strings.TrimSpace(qop) == "auth" {
+			d.qop = "auth"
+		}
+	}
+
+	return d
+}
+
+// parseAuthParams splits a list of key=value or key="value" pairs
+func parseAuthParams(s string) map[string]string {
+	params := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ,")
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = s[eq+1:]
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.Index(s[1:], `"`)
+			if end < 0 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+		} else {
+			end := strings.Index(s, ",")
+			if end < 0 {
+				value, s = s, ""
+			} else {
+				value, s = s[:end], s[end:]
+			}
+		}
+		params[key] = strings.TrimSpace(value)
+	}
+
+	return params
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,252 @@
+/*
+ * knoxite
+ *     Copyright (c) 2016, Christian Muehlhaeuser <muesli@gmail.com>
+ *
+ *   For license see LICENSE.txt
+ */
+
+package knoxite
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+const (
+	webdavTestUser     = "knoxite"
+	webdavTestPassword = "secret"
+	webdavTestRealm    = "knoxite"
+	webdavTestNonce    = "dcd98b7102dd2f0e8b11d0f600bfb0c093"
+)
+
+// newWebDAVTestServer starts an in-memory WebDAV server, requiring either
+// basic auth over TLS or digest auth over plain HTTP
+func newWebDAVTestServer(digest bool) *httptest.Server {
+	handler := &webdav.Handler{
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}
+
+	newServer := httptest.NewTLSServer
+	if digest {
+		newServer = httptest.NewServer
+	}
+	return newServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if digest {
+			if !checkDigestAuth(r) {
+				w.Header().Set("WWW-Authenticate", `Digest realm="`+webdavTestRealm+`", qop="auth,auth-int", nonce="`+webdavTestNonce+`", opaque="5ccc069c403ebaf9f0171e9517f40e41"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		} else {
+			user, pw, ok := r.BasicAuth()
+			if !ok || user != webdavTestUser || pw != webdavTestPassword {
+				w.Header().Set("WWW-Authenticate", `Basic realm="`+webdavTestRealm+`"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+func checkDigestAuth(r *http.Request) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Digest ") {
+		return false
+	}
+	params := parseAuthParams(auth[len("Digest "):])
+	if params["username"] != webdavTestUser || params["nonce"] != webdavTestNonce || params["uri"] != r.URL.RequestURI() {
+		return false
+	}
+
+	ha1 := md5Hex(webdavTestUser + ":" + webdavTestRealm + ":" + webdavTestPassword)
+	ha2 := md5Hex(r.Method + ":" + params["uri"])
+	expected := md5Hex(ha1 + ":" + webdavTestNonce + ":" + params["nc"] + ":" + params["cnonce"] + ":" + params["qop"] + ":" + ha2)
+	return params["response"] == expected
+}
+
+func newTestStorageWebDAV(t *testing.T, server *httptest.Server, password string) *StorageWebDAV {
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.Scheme = "webdav"
+	if server.TLS != nil {
+		u.Scheme = "webdavs"
+	}
+	u.User = url.UserPassword(webdavTestUser, password)
+	u.Path = "/backups/repo"
+
+	backend, err := BackendFromURL(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dav := backend.(*StorageWebDAV)
+	dav.client = server.Client()
+	return dav
+}
+
+func testStorageWebDAV(t *testing.T, backend *StorageWebDAV) {
+	if _, err := backend.LoadRepository(); err != ErrLoadRepositoryFailed {
+		t.Errorf("Expected %v, got %v", ErrLoadRepositoryFailed, err)
+	}
+
+	// the parent collection has to exist already
+	if err := backend.InitRepository(); err == nil {
+		t.Error("Expected error creating a repository in a missing collection")
+	}
+	u := backend.url
+	u.Path = "/backups"
+	parent, err := NewStorageWebDAV(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent.client = backend.client
+	resp, err := parent.do("MKCOL", "/", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if err := backend.InitRepository(); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.SaveRepository([]byte("repository")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := backend.LoadRepository()
+	if err != nil || string(b) != "repository" {
+		t.Errorf("Expected repository data, got %s (%v)", b, err)
+	}
+	if err := backend.InitRepository(); err != ErrRepositoryExists {
+		t.Errorf("Expected %v, got %v", ErrRepositoryExists, err)
+	}
+
+	for _, shasum := range []string{"abc", "def"} {
+		data := []byte("chunk " + shasum)
+		size, err := backend.StoreChunk(shasum, 0, 1, &data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != uint64(len(data)) {
+			t.Errorf("Expected size %d, got %d", len(data), size)
+		}
+	}
+	c, err := backend.LoadChunk("abc", 0, 1)
+	if err != nil || !bytes.Equal(*c, []byte("chunk abc")) {
+		t.Errorf("Expected chunk data, got %s (%v)", *c, err)
+	}
+	if _, err := backend.LoadChunk("missing", 0, 1); err != ErrChunkNotFound {
+		t.Errorf("Expected %v, got %v", ErrChunkNotFound, err)
+	}
+
+	names, err := backend.ListChunks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != chunkName("abc", 0, 1) || names[1] != chunkName("def", 0, 1) {
+		t.Errorf("Unexpected chunk list: %v", names)
+	}
+	size, err := backend.StatChunk("abc", 0, 1)
+	if err != nil || size != uint64(len("chunk abc")) {
+		t.Errorf("Expected size %d, got %d (%v)", len("chunk abc"), size, err)
+	}
+	if err := backend.DeleteChunk("abc", 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.LoadChunk("abc", 0, 1); err != ErrChunkNotFound {
+		t.Errorf("Expected %v, got %v", ErrChunkNotFound, err)
+	}
+	if _, err := backend.StatChunk("abc", 0, 1); err != ErrChunkNotFound {
+		t.Errorf("Expected %v, got %v", ErrChunkNotFound, err)
+	}
+
+	if err := backend.SaveSnapshot("snap", []byte("snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	b, err = backend.LoadSnapshot("snap")
+	if err != nil || string(b) != "snapshot" {
+		t.Errorf("Expected snapshot data, got %s (%v)", b, err)
+	}
+	ids, err := backend.ListSnapshots()
+	if err != nil || len(ids) != 1 || ids[0] != "snap" {
+		t.Errorf("Unexpected snapshot list %v (%v)", ids, err)
+	}
+	if err := backend.DeleteSnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.LoadSnapshot("snap"); err != ErrSnapshotNotFound {
+		t.Errorf("Expected %v, got %v", ErrSnapshotNotFound, err)
+	}
+}
+
+func TestStorageWebDAVBasicAuth(t *testing.T) {
+	server := newWebDAVTestServer(false)
+	defer server.Close()
+
+	testStorageWebDAV(t, newTestStorageWebDAV(t, server, webdavTestPassword))
+}
+
+func TestStorageWebDAVDigestAuth(t *testing.T) {
+	server := newWebDAVTestServer(true)
+	defer server.Close()
+
+	testStorageWebDAV(t, newTestStorageWebDAV(t, server, webdavTestPassword))
+}
+
+func TestStorageWebDAVWrongPassword(t *testing.T) {
+	for _, digest := range []bool{false, true} {
+		server := newWebDAVTestServer(digest)
+		backend := newTestStorageWebDAV(t, server, "wrong")
+		if err := backend.SaveRepository([]byte("repository")); err != ErrAccessDenied {
+			t.Errorf("Expected %v using a wrong password (digest: %v), got %v", ErrAccessDenied, digest, err)
+		}
+		server.Close()
+	}
+}
+
+func TestStorageWebDAVInsecureBasicAuth(t *testing.T) {
+	authorized := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pw, ok := r.BasicAuth()
+		if !ok || user != webdavTestUser || pw != webdavTestPassword {
+			w.Header().Set("WWW-Authenticate", `Basic realm="`+webdavTestRealm+`"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		authorized = true
+	}))
+	defer server.Close()
+
+	backend := newTestStorageWebDAV(t, server, webdavTestPassword)
+	if err := backend.SaveRepository([]byte("repository")); err != ErrInsecureAuth {
+		t.Errorf("Expected %v, got %v", ErrInsecureAuth, err)
+	}
+	if authorized {
+		t.Error("Expected no credentials to be sent over plain HTTP")
+	}
+
+	// explicitly allowing basic auth over plain HTTP
+	u := backend.url
+	u.RawQuery = "insecure=1"
+	b, err := BackendFromURL(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend = b.(*StorageWebDAV)
+	if err := backend.SaveRepository([]byte("repository")); err != nil {
+		t.Error(err)
+	}
+	if !authorized {
+		t.Error("Expected credentials to be sent with insecure=1")
+	}
+}
@@ -16,6 +16,8 @@ type Volume struct {
 	Name        string   `json:"name"`
 	Description string   `json:"description"`
 	Snapshots   []string `json:"snapshots"`
+
+	Policy *RetentionPolicy `json:"policy,omitempty"`
 }
 
 // NewVolume creates a new volume
@@ -40,6 +42,22 @@ func (v *Volume) AddSnapshot(id string) error {
 	return nil
 }
 
+// RemoveSnapshot removes a snapshot from a volume
+func (v *Volume) RemoveSnapshot(id string) error {
+	snapshots := []string{}
+	for _, snapshot := range v.Snapshots {
+		if snapshot != id {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	if len(snapshots) == len(v.Snapshots) {
+		return ErrSnapshotNotFound
+	}
+
+	v.Snapshots = snapshots
+	return nil
+}
+
 // LoadSnapshot loads a snapshot within a volume from a repository
 func (v *Volume) LoadSnapshot(id string, repository *Repository) (Snapshot, error) {
 	for _, snapshot := range v.Snapshots {